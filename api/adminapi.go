@@ -0,0 +1,207 @@
+package api
+
+import (
+	"context"
+
+	"github.com/Gimulator/Gimulator/snapshot"
+	"google.golang.org/grpc"
+)
+
+// AdminAPI lets the master and operators manage a running Gimulator. Like
+// EventAPI, its messages are encoded with jsonCodec.
+
+type ReloadRequest struct{}
+
+// ReloadStatus is the outcome of the reloads of the config so far. Time is
+// formatted as RFC 3339 and is empty if there was no reload yet.
+type ReloadStatus struct {
+	Time     string `json:"time,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Reloads  uint64 `json:"reloads"`
+	Failures uint64 `json:"failures"`
+}
+
+type StatusRequest struct{}
+
+type StatusResponse struct {
+	Revision      int64         `json:"revision"`
+	Watchers      int           `json:"watchers"`
+	DroppedEvents uint64        `json:"dropped_events"`
+	Reload        *ReloadStatus `json:"reload"`
+}
+
+type SnapshotRequest struct{}
+
+// RestoreRequest restores Snapshot into a fresh Gimulator.
+type RestoreRequest struct {
+	Snapshot *snapshot.Snapshot `json:"snapshot"`
+}
+
+type RestoreResponse struct {
+	Revision int64 `json:"revision"`
+}
+
+type AdminAPIServer interface {
+	// Reload reloads rules.yaml and credentials.yaml, see manager.Reload.
+	Reload(context.Context, *ReloadRequest) (*ReloadStatus, error)
+	GetStatus(context.Context, *StatusRequest) (*StatusResponse, error)
+	// Snapshot returns the state of the match, see snapshot.Take.
+	Snapshot(context.Context, *SnapshotRequest) (*snapshot.Snapshot, error)
+	// Restore loads a snapshot, see snapshot.Restore.
+	Restore(context.Context, *RestoreRequest) (*RestoreResponse, error)
+}
+
+// AdminAPIClient calls AdminAPI. Its calls need the token of a master or
+// operator in the "token" metadata, like every other call.
+type AdminAPIClient interface {
+	Reload(ctx context.Context, in *ReloadRequest, opts ...grpc.CallOption) (*ReloadStatus, error)
+	GetStatus(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error)
+	Snapshot(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (*snapshot.Snapshot, error)
+	Restore(ctx context.Context, in *RestoreRequest, opts ...grpc.CallOption) (*RestoreResponse, error)
+}
+
+type adminAPIClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminAPIClient(cc grpc.ClientConnInterface) AdminAPIClient {
+	return &adminAPIClient{cc}
+}
+
+func (c *adminAPIClient) invoke(ctx context.Context, method string, in, out interface{}, opts []grpc.CallOption) error {
+	opts = append([]grpc.CallOption{grpc.CallContentSubtype("json")}, opts...)
+	return c.cc.Invoke(ctx, "/api.AdminAPI/"+method, in, out, opts...)
+}
+
+func (c *adminAPIClient) Reload(ctx context.Context, in *ReloadRequest, opts ...grpc.CallOption) (*ReloadStatus, error) {
+	out := new(ReloadStatus)
+	if err := c.invoke(ctx, "Reload", in, out, opts); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminAPIClient) GetStatus(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error) {
+	out := new(StatusResponse)
+	if err := c.invoke(ctx, "GetStatus", in, out, opts); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminAPIClient) Snapshot(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (*snapshot.Snapshot, error) {
+	out := new(snapshot.Snapshot)
+	if err := c.invoke(ctx, "Snapshot", in, out, opts); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminAPIClient) Restore(ctx context.Context, in *RestoreRequest, opts ...grpc.CallOption) (*RestoreResponse, error) {
+	out := new(RestoreResponse)
+	if err := c.invoke(ctx, "Restore", in, out, opts); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func RegisterAdminAPIServer(s *grpc.Server, srv AdminAPIServer) {
+	s.RegisterService(&adminAPIServiceDesc, srv)
+}
+
+func adminAPIReloadHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReloadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminAPIServer).Reload(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.AdminAPI/Reload",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminAPIServer).Reload(ctx, req.(*ReloadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func adminAPIGetStatusHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminAPIServer).GetStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.AdminAPI/GetStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminAPIServer).GetStatus(ctx, req.(*StatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func adminAPISnapshotHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SnapshotRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminAPIServer).Snapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.AdminAPI/Snapshot",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminAPIServer).Snapshot(ctx, req.(*SnapshotRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func adminAPIRestoreHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RestoreRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminAPIServer).Restore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.AdminAPI/Restore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminAPIServer).Restore(ctx, req.(*RestoreRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var adminAPIServiceDesc = grpc.ServiceDesc{
+	ServiceName: "api.AdminAPI",
+	HandlerType: (*AdminAPIServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Reload",
+			Handler:    adminAPIReloadHandler,
+		},
+		{
+			MethodName: "GetStatus",
+			Handler:    adminAPIGetStatusHandler,
+		},
+		{
+			MethodName: "Snapshot",
+			Handler:    adminAPISnapshotHandler,
+		},
+		{
+			MethodName: "Restore",
+			Handler:    adminAPIRestoreHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "api/adminapi.go",
+}
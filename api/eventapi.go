@@ -0,0 +1,72 @@
+package api
+
+import (
+	"github.com/Gimulator/protobuf/go/api"
+	"google.golang.org/grpc"
+)
+
+// EventAPI streams every change of the storage, including deletes, as an
+// Event. Unlike MessageAPI.Watch, which only streams put messages, it lets
+// clients keep an exact mirror of the state. Its messages are encoded with
+// jsonCodec.
+
+type WatchRequest struct {
+	Key *api.Key `json:"key"`
+
+	// Snapshot asks for every message currently matching Key as put events,
+	// followed by a synced event, before the live events.
+	Snapshot bool `json:"snapshot,omitempty"`
+
+	// SinceRevision asks for every change after this revision, replayed from
+	// the change log, before the live events. Zero means no replay.
+	SinceRevision int64 `json:"since_revision,omitempty"`
+}
+
+type Event struct {
+	Operation string       `json:"operation"`
+	Revision  int64        `json:"revision,omitempty"`
+	Message   *api.Message `json:"message,omitempty"`
+}
+
+type EventAPIServer interface {
+	WatchEvents(*WatchRequest, EventAPI_WatchEventsServer) error
+}
+
+type EventAPI_WatchEventsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type eventAPIWatchEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *eventAPIWatchEventsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func RegisterEventAPIServer(s *grpc.Server, srv EventAPIServer) {
+	s.RegisterService(&eventAPIServiceDesc, srv)
+}
+
+func eventAPIWatchEventsHandler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(EventAPIServer).WatchEvents(m, &eventAPIWatchEventsServer{stream})
+}
+
+var eventAPIServiceDesc = grpc.ServiceDesc{
+	ServiceName: "api.EventAPI",
+	HandlerType: (*EventAPIServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchEvents",
+			Handler:       eventAPIWatchEventsHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/eventapi.go",
+}
@@ -3,19 +3,39 @@ package api
 import (
 	"context"
 	"os"
-	"time"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/Gimulator/Gimulator/config"
 	"github.com/Gimulator/Gimulator/manager"
 	"github.com/Gimulator/Gimulator/simulator"
+	"github.com/Gimulator/Gimulator/snapshot"
 	"github.com/Gimulator/protobuf/go/api"
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
+const (
+	// revisionHeader is the response header which carries the revision of
+	// the message returned by Get or written by Put.
+	revisionHeader = "revision"
+
+	// Request headers which turn Put into a conditional write, see
+	// simulator.Condition.
+	ifRevisionHeader = "if-revision"
+	ifOwnerHeader    = "if-owner"
+	ifAbsentHeader   = "if-absent"
+
+	// ttlHeader is the request header which carries the time-to-live of the
+	// message written by Put, e.g. "30s".
+	ttlHeader = "ttl"
+)
+
 type Server struct {
 	api.UnimplementedMessageAPIServer
 	api.UnimplementedOperatorAPIServer
@@ -26,32 +46,37 @@ type Server struct {
 	simulator *simulator.Simulator
 	log       *logrus.Entry
 
-	mutex     sync.Mutex
+	sessionsMux sync.Mutex
+	sessions    map[*watchSession]struct{}
 }
 
 func NewServer(manager *manager.Manager, sim *simulator.Simulator) (*Server, error) {
-	return &Server{
+	s := &Server{
 		manager:   manager,
 		simulator: sim,
 		log:       logrus.WithField("component", "grpc"),
-	}, nil
+		sessions:  make(map[*watchSession]struct{}),
+	}
+	manager.OnReload(s.reauthorizeWatches)
+
+	return s, nil
 }
 
 func (s *Server) finalizeGame(result *api.Result) {
 	s.log.Debug("starting to process incoming request")
-	for {
-		err := s.manager.Epilogue.Write(result)
-		if err == nil {
-			break
-		}
+	s.manager.RecordResult(result)
+
+	// The epilogue retries on its own, so a failure here is final.
+	code := 0
+	if err := s.manager.Epilogue.Write(result); err != nil {
 		s.log.WithError(err).Error("could not write result into epilogue")
-		time.Sleep(5 * time.Second)
+		code = 1
 	}
 
 	// TODO Close the gRPC server gracefully
 
 	// Shutdown Gimulator
-	os.Exit(0)
+	os.Exit(code)
 }
 
 ///////////////////////////////////////////////////////
@@ -59,9 +84,6 @@ func (s *Server) finalizeGame(result *api.Result) {
 ///////////////////////////////////////////////////////
 
 func (s *Server) Get(ctx context.Context, key *api.Key) (*api.Message, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	log := s.log.WithField("key", key.String()).WithField("method", api.Method_get)
 	log.Debug("starting to handle incoming request")
 
@@ -87,19 +109,21 @@ func (s *Server) Get(ctx context.Context, key *api.Key) (*api.Message, error) {
 	}
 
 	log.Debug("starting to process incoming request")
-	message, err := s.simulator.Get(key)
+	message, revision, err := s.simulator.Get(key)
 	if err != nil {
 		log.WithError(err).Error("could not process incoming request")
 		return nil, err
 	}
 
+	// api.Meta has no field for the revision, so it is sent as a header.
+	if err := grpc.SetHeader(ctx, metadata.Pairs(revisionHeader, strconv.FormatInt(revision, 10))); err != nil {
+		log.WithError(err).Warn("could not set revision header")
+	}
+
 	return message, nil
 }
 
 func (s *Server) GetAll(key *api.Key, stream api.MessageAPI_GetAllServer) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	log := s.log.WithField("key", key.String()).WithField("method", api.Method_getAll)
 	log.Debug("starting to handle incoming request")
 
@@ -126,13 +150,35 @@ func (s *Server) GetAll(key *api.Key, stream api.MessageAPI_GetAllServer) error
 		return err
 	}
 
+	denied, err := s.manager.DenyFilter(user, api.Method_getAll)
+	if err != nil {
+		log.WithError(err).Error("could not authorize incoming request")
+		return err
+	}
+
 	log.Debug("starting to process incoming request")
-	messages, err := s.simulator.GetAll(key)
+	events, err := s.simulator.GetAllWithRevisions(key)
 	if err != nil {
 		log.WithError(err).Error("could not process incoming request")
 		return err
 	}
 
+	messages := make([]*api.Message, 0, len(events))
+	revisions := metadata.MD{}
+	for _, event := range events {
+		if denied != nil && denied(event.Message.Key) {
+			continue
+		}
+		messages = append(messages, event.Message)
+		revisions.Append(revisionHeader, strconv.FormatInt(event.Revision, 10))
+	}
+
+	// api.Meta has no field for the revision, so the revisions of the messages
+	// are sent as a header, one value for every message in the same order.
+	if err := grpc.SetHeader(ctx, revisions); err != nil {
+		log.WithError(err).Warn("could not set revision header")
+	}
+
 	log.Debug("starting to send messages")
 	for _, mes := range messages {
 		if err := stream.Send(mes); err != nil {
@@ -145,9 +191,6 @@ func (s *Server) GetAll(key *api.Key, stream api.MessageAPI_GetAllServer) error
 }
 
 func (s *Server) Put(ctx context.Context, message *api.Message) (*empty.Empty, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	log := s.log.WithField("key", message.Key.String()).WithField("method", api.Method_put)
 	log.Debug("starting to handle incoming request")
 
@@ -173,29 +216,37 @@ func (s *Server) Put(ctx context.Context, message *api.Message) (*empty.Empty, e
 	}
 
 	log.Debug("starting to setup the meta of the message")
-	message.Meta = &api.Meta{
-		Owner: &api.User{
-			Name:      user.Name,
-			Character: user.Character,
-			Role:      user.Role,
-			Readiness: user.Readiness,
-			Status:    user.Status,
-		},
+	message.Meta = s.newMeta(user)
+
+	log.Debug("starting to extract condition from context")
+	cond, err := s.extractConditionFromContext(ctx)
+	if err != nil {
+		log.WithError(err).Error("could not extract condition from context")
+		return nil, err
+	}
+
+	log.Debug("starting to extract time-to-live from context")
+	ttl, err := s.extractTTLFromContext(ctx)
+	if err != nil {
+		log.WithError(err).Error("could not extract time-to-live from context")
+		return nil, err
 	}
 
 	log.Debug("starting to process incoming request")
-	if err := s.simulator.Put(message); err != nil {
+	revision, err := s.simulator.PutIf(message, cond, ttl)
+	if err != nil {
 		log.WithError(err).Error("could not process incoming request")
 		return nil, err
 	}
 
+	if err := grpc.SetHeader(ctx, metadata.Pairs(revisionHeader, strconv.FormatInt(revision, 10))); err != nil {
+		log.WithError(err).Warn("could not set revision header")
+	}
+
 	return &empty.Empty{}, nil
 }
 
 func (s *Server) Delete(ctx context.Context, key *api.Key) (*empty.Empty, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	log := s.log.WithField("key", key.String()).WithField("method", api.Method_delete)
 	log.Debug("starting to handle incoming request")
 
@@ -230,9 +281,6 @@ func (s *Server) Delete(ctx context.Context, key *api.Key) (*empty.Empty, error)
 }
 
 func (s *Server) DeleteAll(ctx context.Context, key *api.Key) (*empty.Empty, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	log := s.log.WithField("key", key.String()).WithField("method", api.Method_deleteAll)
 	log.Debug("starting to handle incoming request")
 
@@ -257,8 +305,14 @@ func (s *Server) DeleteAll(ctx context.Context, key *api.Key) (*empty.Empty, err
 		return nil, err
 	}
 
+	denied, err := s.manager.DenyFilter(user, api.Method_deleteAll)
+	if err != nil {
+		log.WithError(err).Error("could not authorize incoming request")
+		return nil, err
+	}
+
 	log.Debug("starting to process incoming request")
-	if err := s.simulator.DeleteAll(key); err != nil {
+	if err := s.simulator.DeleteAllExcept(key, denied); err != nil {
 		log.WithError(err).Error("could not process incoming request")
 		return nil, err
 	}
@@ -267,9 +321,6 @@ func (s *Server) DeleteAll(ctx context.Context, key *api.Key) (*empty.Empty, err
 }
 
 func (s *Server) Watch(key *api.Key, stream api.MessageAPI_WatchServer) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	log := s.log.WithField("key", key.String()).WithField("method", api.Method_watch)
 	log.Debug("starting to handle incoming request")
 
@@ -295,24 +346,366 @@ func (s *Server) Watch(key *api.Key, stream api.MessageAPI_WatchServer) error {
 		return err
 	}
 
-	send := simulator.NewChannel()
-	defer send.Close()
+	log.Debug("starting to process incoming request")
+	return s.watch(ctx, user, key, false, 0, log, func(event *simulator.Event) error {
+		// MessageAPI has no way to tell a deleted message from a put one,
+		// clients who need deletes should use EventAPI.
+		if event.Operation != simulator.OperationPut {
+			return nil
+		}
+		return stream.Send(event.Message)
+	})
+}
+
+///////////////////////////////////////////////////////
+/////////////////////////// EventAPI Implementation ///
+///////////////////////////////////////////////////////
+
+func (s *Server) WatchEvents(req *WatchRequest, stream EventAPI_WatchEventsServer) error {
+	log := s.log.WithField("key", req.Key.String()).WithField("method", api.Method_watch)
+	log.Debug("starting to handle incoming request")
+
+	log.Debug("starting to extract token from context")
+	ctx := stream.Context()
+	token, err := s.extractTokenFromContext(ctx)
+	if err != nil {
+		log.WithError(err).Error("could not extract token form context")
+		return err
+	}
+
+	log.Debug("starting to authenticate incoming request")
+	user, err := s.manager.Authenticate(token)
+	if err != nil {
+		log.WithError(err).Error("could not authenticate incoming request")
+		return err
+	}
+	log = log.WithField("name", user.Name).WithField("role", user.Role)
+
+	log.Debug("starting to authorize incoming request")
+	if err := s.manager.AuthorizeWatchMethod(user, req.Key); err != nil {
+		log.WithError(err).Error("could not authorize incoming request")
+		return err
+	}
+
+	if req.Snapshot && req.SinceRevision > 0 {
+		err := status.Error(codes.InvalidArgument, "invalid request: snapshot and since_revision can not be used together")
+		log.WithError(err).Error("could not process incoming request")
+		return err
+	}
+
+	if req.Snapshot {
+		log.Debug("starting to authorize the snapshot of incoming request")
+		if err := s.manager.AuthorizeGetAllMethod(user, req.Key); err != nil {
+			log.WithError(err).Error("could not authorize the snapshot of incoming request")
+			return err
+		}
+	}
 
 	log.Debug("starting to process incoming request")
-	if err := s.simulator.Watch(key, send); err != nil {
+	return s.watch(ctx, user, req.Key, req.Snapshot, req.SinceRevision, log, func(event *simulator.Event) error {
+		return stream.Send(&Event{
+			Operation: string(event.Operation),
+			Revision:  event.Revision,
+			Message:   event.Message,
+		})
+	})
+}
+
+///////////////////////////////////////////////////////
+///////////////////////// HistoryAPI Implementation ///
+///////////////////////////////////////////////////////
+
+func (s *Server) GetHistory(req *HistoryRequest, stream HistoryAPI_GetHistoryServer) error {
+	log := s.log.WithField("key", req.Key.String()).WithField("method", "getHistory")
+	log.Debug("starting to handle incoming request")
+
+	log.Debug("starting to extract token from context")
+	ctx := stream.Context()
+	token, err := s.extractTokenFromContext(ctx)
+	if err != nil {
+		log.WithError(err).Error("could not extract token form context")
+		return err
+	}
+
+	log.Debug("starting to authenticate incoming request")
+	user, err := s.manager.Authenticate(token)
+	if err != nil {
+		log.WithError(err).Error("could not authenticate incoming request")
+		return err
+	}
+	log = log.WithField("name", user.Name).WithField("role", user.Role)
+
+	log.Debug("starting to authorize incoming request")
+	if err := s.manager.AuthorizeGetHistoryMethod(user, req.Key); err != nil {
+		log.WithError(err).Error("could not authorize incoming request")
+		return err
+	}
+
+	if req.Limit < 0 || req.Since < 0 {
+		err := status.Error(codes.InvalidArgument, "invalid request: limit and since can not be negative")
 		log.WithError(err).Error("could not process incoming request")
 		return err
 	}
 
-	log.Debug("starting to send answer of processed request")
-	for {
-		message := <-send.Ch
+	denied, err := s.manager.DenyFilter(user, config.MethodGetHistory)
+	if err != nil {
+		log.WithError(err).Error("could not authorize incoming request")
+		return err
+	}
 
-		if err := stream.Send(message); err != nil {
-			log.WithError(err).Error("could not send answer of processed request, closing the connection...")
+	log.Debug("starting to process incoming request")
+	// Denied versions are skipped here, so the limit is applied here too.
+	limit := req.Limit
+	if denied != nil {
+		limit = 0
+	}
+	versions, err := s.simulator.History(req.Key, req.Since, limit)
+	if err != nil {
+		log.WithError(err).Error("could not process incoming request")
+		return err
+	}
+
+	log.Debug("starting to send versions")
+	sent := 0
+	for _, version := range versions {
+		if req.Limit > 0 && sent == req.Limit {
+			break
+		}
+		if denied != nil && denied(version.Message.Key) {
+			continue
+		}
+		if err := stream.Send(&Version{
+			Operation: version.Operation,
+			Revision:  version.Revision,
+			Time:      version.Time.UTC().Format(time.RFC3339Nano),
+			Message:   version.Message,
+		}); err != nil {
+			log.WithError(err).Error("could not send version")
 			return err
 		}
+		sent++
 	}
+
+	return nil
+}
+
+///////////////////////////////////////////////////////
+///////////////////// TransactionAPI Implementation ///
+///////////////////////////////////////////////////////
+
+func (s *Server) Batch(ctx context.Context, req *BatchRequest) (*BatchResponse, error) {
+	log := s.log.WithField("operations", len(req.Operations)).WithField("method", "batch")
+	log.Debug("starting to handle incoming request")
+
+	log.Debug("starting to extract token from context")
+	token, err := s.extractTokenFromContext(ctx)
+	if err != nil {
+		log.WithError(err).Error("could not extract token form context")
+		return nil, err
+	}
+
+	log.Debug("starting to authenticate incoming request")
+	user, err := s.manager.Authenticate(token)
+	if err != nil {
+		log.WithError(err).Error("could not authenticate incoming request")
+		return nil, err
+	}
+	log = log.WithField("name", user.Name).WithField("role", user.Role)
+
+	log.Debug("starting to authorize incoming request")
+	writes := make([]*simulator.Write, 0, len(req.Operations))
+	for _, op := range req.Operations {
+		switch simulator.Operation(op.Operation) {
+		case simulator.OperationPut:
+			if err := s.manager.AuthorizePutMethod(user, op.Key); err != nil {
+				log.WithError(err).Error("could not authorize incoming request")
+				return nil, err
+			}
+			ttl, err := s.parseTTL(op.TTL)
+			if err != nil {
+				log.WithError(err).Error("could not authorize incoming request")
+				return nil, err
+			}
+			writes = append(writes, &simulator.Write{
+				Operation: simulator.OperationPut,
+				Key:       op.Key,
+				Message: &api.Message{
+					Key:     op.Key,
+					Meta:    s.newMeta(user),
+					Content: op.Content,
+				},
+				TTL: ttl,
+			})
+		case simulator.OperationDelete:
+			if err := s.manager.AuthorizeDeleteMethod(user, op.Key); err != nil {
+				log.WithError(err).Error("could not authorize incoming request")
+				return nil, err
+			}
+			writes = append(writes, &simulator.Write{
+				Operation: simulator.OperationDelete,
+				Key:       op.Key,
+			})
+		default:
+			err := status.Errorf(codes.InvalidArgument, "invalid operation: %v, operations of a batch can only be put or delete", op.Operation)
+			log.WithError(err).Error("could not authorize incoming request")
+			return nil, err
+		}
+	}
+
+	log.Debug("starting to process incoming request")
+	revision, err := s.simulator.Batch(writes)
+	if err != nil {
+		log.WithError(err).Error("could not process incoming request")
+		return nil, err
+	}
+
+	return &BatchResponse{Revision: revision}, nil
+}
+
+///////////////////////////////////////////////////////
+/////////////////////////// AdminAPI Implementation ///
+///////////////////////////////////////////////////////
+
+func (s *Server) Reload(ctx context.Context, req *ReloadRequest) (*ReloadStatus, error) {
+	log := s.log.WithField("method", "reload")
+	log.Debug("starting to handle incoming request")
+
+	log.Debug("starting to extract token from context")
+	token, err := s.extractTokenFromContext(ctx)
+	if err != nil {
+		log.WithError(err).Error("could not extract token form context")
+		return nil, err
+	}
+
+	log.Debug("starting to authenticate incoming request")
+	user, err := s.manager.Authenticate(token)
+	if err != nil {
+		log.WithError(err).Error("could not authenticate incoming request")
+		return nil, err
+	}
+	log = log.WithField("name", user.Name).WithField("role", user.Role)
+
+	log.Debug("starting to authorize incoming request")
+	if err := s.manager.AuthorizeAdminMethod(user); err != nil {
+		log.WithError(err).Error("could not authorize incoming request")
+		return nil, err
+	}
+
+	log.Debug("starting to process incoming request")
+	if err := s.manager.Reload(); err != nil {
+		log.WithError(err).Error("could not process incoming request")
+		return nil, err
+	}
+
+	return s.reloadStatus(), nil
+}
+
+func (s *Server) GetStatus(ctx context.Context, req *StatusRequest) (*StatusResponse, error) {
+	log := s.log.WithField("method", "getStatus")
+	log.Debug("starting to handle incoming request")
+
+	log.Debug("starting to extract token from context")
+	token, err := s.extractTokenFromContext(ctx)
+	if err != nil {
+		log.WithError(err).Error("could not extract token form context")
+		return nil, err
+	}
+
+	log.Debug("starting to authenticate incoming request")
+	user, err := s.manager.Authenticate(token)
+	if err != nil {
+		log.WithError(err).Error("could not authenticate incoming request")
+		return nil, err
+	}
+	log = log.WithField("name", user.Name).WithField("role", user.Role)
+
+	log.Debug("starting to authorize incoming request")
+	if err := s.manager.AuthorizeAdminMethod(user); err != nil {
+		log.WithError(err).Error("could not authorize incoming request")
+		return nil, err
+	}
+
+	return &StatusResponse{
+		Revision:      s.simulator.Revision(),
+		Watchers:      s.simulator.WatcherCount(),
+		DroppedEvents: s.simulator.DroppedEvents(),
+		Reload:        s.reloadStatus(),
+	}, nil
+}
+
+func (s *Server) Snapshot(ctx context.Context, req *SnapshotRequest) (*snapshot.Snapshot, error) {
+	log := s.log.WithField("method", "snapshot")
+	log.Debug("starting to handle incoming request")
+
+	log.Debug("starting to extract token from context")
+	token, err := s.extractTokenFromContext(ctx)
+	if err != nil {
+		log.WithError(err).Error("could not extract token form context")
+		return nil, err
+	}
+
+	log.Debug("starting to authenticate incoming request")
+	user, err := s.manager.Authenticate(token)
+	if err != nil {
+		log.WithError(err).Error("could not authenticate incoming request")
+		return nil, err
+	}
+	log = log.WithField("name", user.Name).WithField("role", user.Role)
+
+	log.Debug("starting to authorize incoming request")
+	if err := s.manager.AuthorizeAdminMethod(user); err != nil {
+		log.WithError(err).Error("could not authorize incoming request")
+		return nil, err
+	}
+
+	log.Debug("starting to process incoming request")
+	snap, err := snapshot.Take(s.simulator, s.manager.UserStorage())
+	if err != nil {
+		log.WithError(err).Error("could not process incoming request")
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+func (s *Server) Restore(ctx context.Context, req *RestoreRequest) (*RestoreResponse, error) {
+	log := s.log.WithField("method", "restore")
+	log.Debug("starting to handle incoming request")
+
+	log.Debug("starting to extract token from context")
+	token, err := s.extractTokenFromContext(ctx)
+	if err != nil {
+		log.WithError(err).Error("could not extract token form context")
+		return nil, err
+	}
+
+	log.Debug("starting to authenticate incoming request")
+	user, err := s.manager.Authenticate(token)
+	if err != nil {
+		log.WithError(err).Error("could not authenticate incoming request")
+		return nil, err
+	}
+	log = log.WithField("name", user.Name).WithField("role", user.Role)
+
+	log.Debug("starting to authorize incoming request")
+	if err := s.manager.AuthorizeAdminMethod(user); err != nil {
+		log.WithError(err).Error("could not authorize incoming request")
+		return nil, err
+	}
+
+	if req.Snapshot == nil {
+		err := status.Error(codes.InvalidArgument, "invalid request: snapshot can not be null")
+		log.WithError(err).Error("could not process incoming request")
+		return nil, err
+	}
+
+	log.Debug("starting to process incoming request")
+	if err := req.Snapshot.Restore(s.simulator, s.manager.UserStorage()); err != nil {
+		log.WithError(err).Error("could not process incoming request")
+		return nil, err
+	}
+
+	return &RestoreResponse{Revision: s.simulator.Revision()}, nil
 }
 
 ///////////////////////////////////////////////////////
@@ -320,9 +713,6 @@ func (s *Server) Watch(key *api.Key, stream api.MessageAPI_WatchServer) error {
 ///////////////////////////////////////////////////////
 
 func (s *Server) SetUserStatus(ctx context.Context, report *api.Report) (*empty.Empty, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	log := s.log.WithField("asked-name", report.Name).WithField("status", report.Status).WithField("method", api.Method_setUserStatus)
 	log.Debug("starting to handle incoming request")
 
@@ -360,9 +750,6 @@ func (s *Server) SetUserStatus(ctx context.Context, report *api.Report) (*empty.
 ///////////////////////////////////////////////////////
 
 func (s *Server) GetActors(empty *empty.Empty, stream api.DirectorAPI_GetActorsServer) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	log := s.log.WithField("method", api.Method_getActors)
 	log.Debug("starting to handle incoming request")
 
@@ -407,9 +794,6 @@ func (s *Server) GetActors(empty *empty.Empty, stream api.DirectorAPI_GetActorsS
 }
 
 func (s *Server) PutResult(ctx context.Context, result *api.Result) (*empty.Empty, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	log := s.log.WithField("method", api.Method_putResult)
 	log.Debug("starting to handle incoming request")
 
@@ -444,9 +828,6 @@ func (s *Server) PutResult(ctx context.Context, result *api.Result) (*empty.Empt
 ///////////////////////////////////////////////////////
 
 func (s *Server) ImReady(ctx context.Context, emp *empty.Empty) (*empty.Empty, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	log := s.log.WithField("method", api.Method_imReady)
 	log.Debug("starting to handle incoming request")
 
@@ -481,9 +862,6 @@ func (s *Server) ImReady(ctx context.Context, emp *empty.Empty) (*empty.Empty, e
 }
 
 func (s *Server) Ping(ctx context.Context, emp *empty.Empty) (*empty.Empty, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	log := s.log.WithField("method", api.Method_ping)
 	log.Debug("starting to handle incoming request")
 
@@ -494,6 +872,188 @@ func (s *Server) Ping(ctx context.Context, emp *empty.Empty) (*empty.Empty, erro
 //////////////////////////////////////////// Helper ///
 ///////////////////////////////////////////////////////
 
+// watch registers a watcher for key and hands its events to send until the
+// client goes away or send fails. If snapshot is set, the messages matching
+// key at registration time are sent first as put events, followed by a synced
+// event which carries the revision of the snapshot. If since is set, the
+// changes after that revision are replayed from the change log first. No lock
+// is held while sending.
+func (s *Server) watch(ctx context.Context, user *api.User, key *api.Key, snapshot bool, since int64, log *logrus.Entry, send func(*simulator.Event) error) error {
+	// Deny rules which cover only a part of the key are applied to every event.
+	denied, err := s.manager.DenyFilter(user, api.Method_watch)
+	if err != nil {
+		log.WithError(err).Error("could not authorize incoming request")
+		return err
+	}
+	session := newWatchSession(user, key, denied)
+	s.addSession(session)
+	defer s.removeSession(session)
+	send = s.skipDenied(send, session)
+
+	// The simulator logs the events the watcher dropped when it is removed.
+	ch := s.simulator.NewChannel(user.Character)
+
+	switch {
+	case snapshot:
+		snapshotDenied, err := s.manager.DenyFilter(user, api.Method_getAll)
+		if err != nil {
+			log.WithError(err).Error("could not authorize the snapshot of incoming request")
+			return err
+		}
+
+		events, revision, err := s.simulator.WatchWithSnapshot(key, ch)
+		if err != nil {
+			log.WithError(err).Error("could not process incoming request")
+			return err
+		}
+		defer s.simulator.Unwatch(ch)
+
+		log.Debug("starting to send snapshot of processed request")
+		for _, event := range events {
+			if snapshotDenied != nil && snapshotDenied(event.Message.Key) {
+				continue
+			}
+			if err := send(event); err != nil {
+				log.WithError(err).Error("could not send snapshot of processed request, closing the connection...")
+				return err
+			}
+		}
+		if err := send(simulator.NewEvent(simulator.OperationSynced, revision, nil)); err != nil {
+			log.WithError(err).Error("could not send snapshot of processed request, closing the connection...")
+			return err
+		}
+	case since > 0:
+		events, err := s.simulator.WatchSince(key, since, ch)
+		if err != nil {
+			log.WithError(err).Error("could not process incoming request")
+			return err
+		}
+		defer s.simulator.Unwatch(ch)
+
+		log.WithField("since-revision", since).Debug("starting to replay changes of processed request")
+		for _, event := range events {
+			if err := send(event); err != nil {
+				log.WithError(err).Error("could not replay changes of processed request, closing the connection...")
+				return err
+			}
+		}
+	default:
+		revision, err := s.simulator.Watch(key, ch)
+		if err != nil {
+			log.WithError(err).Error("could not process incoming request")
+			return err
+		}
+		defer s.simulator.Unwatch(ch)
+
+		// MessageAPI can not carry the revision of every event, so at least
+		// the revision the watch starts after is sent as a header.
+		if err := grpc.SendHeader(ctx, metadata.Pairs(revisionHeader, strconv.FormatInt(revision, 10))); err != nil {
+			log.WithError(err).Warn("could not send revision header")
+		}
+	}
+
+	log.Debug("starting to send answer of processed request")
+	for {
+		select {
+		case <-ctx.Done():
+			log.Debug("client closed the connection, removing the watcher...")
+			return status.FromContextError(ctx.Err()).Err()
+		case <-session.revoked:
+			log.Warn("permission of the watcher is revoked by a reload of the config, closing the connection...")
+			return status.Error(codes.PermissionDenied, "permission to watch the key is revoked")
+		case <-ch.Overflowed():
+			log.WithField("dropped", ch.Dropped()).Warn("watcher is too slow, closing the connection...")
+			return status.Error(codes.ResourceExhausted, "watcher is too slow: could not keep up with the events")
+		case event := <-ch.Ch:
+			if err := send(event); err != nil {
+				log.WithError(err).Error("could not send answer of processed request, closing the connection...")
+				return err
+			}
+		}
+	}
+}
+
+// skipDenied wraps send so that events of the keys which are denied to the
+// session are not sent. Events without a message, such as synced, are always
+// sent.
+func (s *Server) skipDenied(send func(*simulator.Event) error, session *watchSession) func(*simulator.Event) error {
+	return func(event *simulator.Event) error {
+		if event.Message != nil && session.isDenied(event.Message.Key) {
+			return nil
+		}
+		return send(event)
+	}
+}
+
+func (s *Server) addSession(session *watchSession) {
+	s.sessionsMux.Lock()
+	defer s.sessionsMux.Unlock()
+
+	s.sessions[session] = struct{}{}
+}
+
+func (s *Server) removeSession(session *watchSession) {
+	s.sessionsMux.Lock()
+	defer s.sessionsMux.Unlock()
+
+	delete(s.sessions, session)
+}
+
+// reauthorizeWatches authorizes every running watch again after the config is
+// reloaded. Watches of removed users or of keys which are not allowed anymore
+// are revoked, the others get the new deny rules.
+func (s *Server) reauthorizeWatches() {
+	s.sessionsMux.Lock()
+	defer s.sessionsMux.Unlock()
+
+	revoked := 0
+	for session := range s.sessions {
+		user, err := s.manager.GetUserWithName(session.user.Name)
+		if err == nil {
+			err = s.manager.AuthorizeWatchMethod(user, session.key)
+		}
+		var denied func(*api.Key) bool
+		if err == nil {
+			denied, err = s.manager.DenyFilter(user, api.Method_watch)
+		}
+
+		if err != nil {
+			session.revoke()
+			revoked++
+			continue
+		}
+		session.setDenied(denied)
+	}
+
+	s.log.WithField("watchers", len(s.sessions)).WithField("revoked", revoked).Info("watchers are authorized again after reloading the config")
+}
+
+func (s *Server) reloadStatus() *ReloadStatus {
+	st := s.manager.ReloadStatus()
+
+	res := &ReloadStatus{
+		Error:    st.Error,
+		Reloads:  st.Reloads,
+		Failures: st.Failures,
+	}
+	if !st.Time.IsZero() {
+		res.Time = st.Time.Format(time.RFC3339)
+	}
+	return res
+}
+
+func (s *Server) newMeta(owner *api.User) *api.Meta {
+	return &api.Meta{
+		Owner: &api.User{
+			Name:      owner.Name,
+			Character: owner.Character,
+			Role:      owner.Role,
+			Readiness: owner.Readiness,
+			Status:    owner.Status,
+		},
+	}
+}
+
 func (s *Server) extractTokenFromContext(ctx context.Context) (string, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
@@ -507,3 +1067,72 @@ func (s *Server) extractTokenFromContext(ctx context.Context) (string, error) {
 
 	return tokens[0], nil
 }
+
+func (s *Server) extractConditionFromContext(ctx context.Context) (*simulator.Condition, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+
+	revisions, owners, absents := md.Get(ifRevisionHeader), md.Get(ifOwnerHeader), md.Get(ifAbsentHeader)
+	if len(revisions) == 0 && len(owners) == 0 && len(absents) == 0 {
+		return nil, nil
+	}
+	if len(revisions) > 1 || len(owners) > 1 || len(absents) > 1 {
+		return nil, status.Errorf(codes.InvalidArgument, "every condition can be set only once in metadata of incoming context")
+	}
+
+	cond := &simulator.Condition{}
+	if len(revisions) == 1 {
+		revision, err := strconv.ParseInt(revisions[0], 10, 64)
+		if err != nil || revision <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %v: %v is not a positive integer", ifRevisionHeader, revisions[0])
+		}
+		cond.Revision = revision
+	}
+	if len(owners) == 1 {
+		cond.Owner = owners[0]
+	}
+	if len(absents) == 1 {
+		absent, err := strconv.ParseBool(absents[0])
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %v: %v is not a boolean", ifAbsentHeader, absents[0])
+		}
+		cond.Absent = absent
+	}
+
+	if cond.Absent && (cond.Revision != 0 || cond.Owner != "") {
+		return nil, status.Errorf(codes.InvalidArgument, "%v can not be used together with %v or %v", ifAbsentHeader, ifRevisionHeader, ifOwnerHeader)
+	}
+
+	return cond, nil
+}
+
+func (s *Server) extractTTLFromContext(ctx context.Context) (time.Duration, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return 0, nil
+	}
+
+	ttls := md.Get(ttlHeader)
+	if len(ttls) == 0 {
+		return 0, nil
+	}
+	if len(ttls) > 1 {
+		return 0, status.Errorf(codes.InvalidArgument, "%v can be set only once in metadata of incoming context", ttlHeader)
+	}
+
+	return s.parseTTL(ttls[0])
+}
+
+func (s *Server) parseTTL(str string) (time.Duration, error) {
+	if str == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(str)
+	if err != nil || ttl <= 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid %v: %v is not a positive duration", ttlHeader, str)
+	}
+	return ttl, nil
+}
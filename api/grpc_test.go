@@ -0,0 +1,508 @@
+package api
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Gimulator/Gimulator/cmd"
+	"github.com/Gimulator/Gimulator/config"
+	"github.com/Gimulator/Gimulator/manager"
+	"github.com/Gimulator/Gimulator/simulator"
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testRules = `
+director:
+- key: {}
+  methods: [get, getAll, put, delete, deleteAll, watch, getHistory]
+actors:
+  red:
+  - key:
+      namespace: "board"
+    methods: [get, getAll, put, delete, deleteAll, watch, getHistory]
+`
+
+// testDenyRules hide the secrets of the board from actors.
+const testDenyRules = testRules + `  - key:
+      name: "secret-*"
+      namespace: "board"
+    methods: [get, getAll, put, delete, deleteAll, watch, getHistory]
+    deny: true
+`
+
+const testCredentials = `
+- name: director
+  token: director-token
+  character: director
+- name: actor1
+  role: red
+  token: actor1-token
+  character: actor
+`
+
+// writeTestConfig writes the config files to cmd.ConfigDir, where the manager
+// reloads them from.
+func writeTestConfig(t *testing.T, rules, credentials string) {
+	t.Helper()
+
+	paths := config.Paths(cmd.ConfigDir)
+	if err := os.WriteFile(paths[0], []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(paths[1], []byte(credentials), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestServer returns a server with a memory storage, whose config is rules
+// and credentials in a temporary cmd.ConfigDir.
+func newTestServer(t *testing.T, rules, credentials string) (*Server, *simulator.Simulator) {
+	t.Helper()
+
+	dir := cmd.ConfigDir
+	t.Cleanup(func() { cmd.ConfigDir = dir })
+	cmd.ConfigDir = t.TempDir()
+	writeTestConfig(t, rules, credentials)
+
+	conf, err := config.NewConfig(cmd.ConfigDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strg, err := storage.NewMemoryWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim, err := simulator.NewSimulator(strg, simulator.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	man, err := manager.NewManager(strg, strg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(man, sim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, sim
+}
+
+func withToken(ctx context.Context, token string) context.Context {
+	return metadata.NewIncomingContext(ctx, metadata.Pairs("token", token))
+}
+
+// testTransport keeps the headers which are set for a call.
+type testTransport struct {
+	mux    sync.Mutex
+	header metadata.MD
+}
+
+func (t *testTransport) Method() string {
+	return ""
+}
+
+func (t *testTransport) SetHeader(md metadata.MD) error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.header = metadata.Join(t.header, md)
+	return nil
+}
+
+func (t *testTransport) SendHeader(md metadata.MD) error {
+	return t.SetHeader(md)
+}
+
+func (t *testTransport) SetTrailer(md metadata.MD) error {
+	return nil
+}
+
+func (t *testTransport) Header() metadata.MD {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	return t.header.Copy()
+}
+
+// testStream is the server side of a stream, which hands what is sent to sent.
+type testStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	transport *testTransport
+	sent      chan interface{}
+}
+
+func newTestStream(ctx context.Context) *testStream {
+	transport := &testTransport{}
+	return &testStream{
+		ctx:       grpc.NewContextWithServerTransportStream(ctx, transport),
+		transport: transport,
+		sent:      make(chan interface{}, 100),
+	}
+}
+
+func (t *testStream) Context() context.Context {
+	return t.ctx
+}
+
+func (t *testStream) send(m interface{}) error {
+	select {
+	case t.sent <- m:
+		return nil
+	case <-t.ctx.Done():
+		return t.ctx.Err()
+	}
+}
+
+// next returns the next value sent to the stream.
+func (t *testStream) next(tb testing.TB) interface{} {
+	tb.Helper()
+
+	select {
+	case m := <-t.sent:
+		return m
+	case <-time.After(5 * time.Second):
+		tb.Fatal("nothing is sent to the stream")
+		return nil
+	}
+}
+
+type messageStream struct{ *testStream }
+
+func (m messageStream) Send(mes *api.Message) error { return m.send(mes) }
+
+type eventStream struct{ *testStream }
+
+func (e eventStream) Send(event *Event) error { return e.send(event) }
+
+type historyStream struct{ *testStream }
+
+func (h historyStream) Send(version *Version) error { return h.send(version) }
+
+// newWatchContext returns the context of a stream with the token, which is
+// canceled at the end of the test at the latest.
+func newWatchContext(t *testing.T, token string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(withToken(context.Background(), token))
+	t.Cleanup(cancel)
+	return ctx, cancel
+}
+
+// serveWatch runs serve until it returns, and waits until the watcher it
+// registers is added to sim.
+func serveWatch(t *testing.T, sim *simulator.Simulator, serve func() error) <-chan error {
+	t.Helper()
+
+	want := sim.WatcherCount() + 1
+	done := make(chan error, 1)
+	go func() { done <- serve() }()
+
+	waitForWatchers(t, sim, want)
+	return done
+}
+
+// startWatch runs Watch of key with the token until the returned context is
+// canceled, and waits until its watcher is registered.
+func startWatch(t *testing.T, s *Server, sim *simulator.Simulator, token string, key *api.Key) (messageStream, context.CancelFunc, <-chan error) {
+	t.Helper()
+
+	ctx, cancel := newWatchContext(t, token)
+	stream := messageStream{newTestStream(ctx)}
+	done := serveWatch(t, sim, func() error { return s.Watch(key, stream) })
+	return stream, cancel, done
+}
+
+func waitForWatchers(t *testing.T, sim *simulator.Simulator, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for sim.WatcherCount() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d watchers, want %d", sim.WatcherCount(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitForEnd(t *testing.T, done <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream does not end")
+		return nil
+	}
+}
+
+func TestWatchEndsWhenClientGoesAway(t *testing.T) {
+	s, sim := newTestServer(t, testRules, testCredentials)
+
+	_, cancel, done := startWatch(t, s, sim, "actor1-token", &api.Key{Namespace: "board"})
+	cancel()
+
+	if err := waitForEnd(t, done); status.Code(err) != codes.Canceled {
+		t.Errorf("got error %v, want Canceled", err)
+	}
+	if n := sim.WatcherCount(); n != 0 {
+		t.Errorf("got %d watchers after the client went away, want 0", n)
+	}
+	if n := len(s.sessions); n != 0 {
+		t.Errorf("got %d watch sessions after the client went away, want 0", n)
+	}
+}
+
+func newTestMessage(name, content string) *api.Message {
+	return &api.Message{
+		Key:     &api.Key{Type: "cell", Name: name, Namespace: "board"},
+		Meta:    &api.Meta{Owner: &api.User{Name: "director"}},
+		Content: content,
+	}
+}
+
+func TestWatchEventsWithSnapshot(t *testing.T) {
+	s, sim := newTestServer(t, testRules, testCredentials)
+	for _, name := range []string{"cell-1", "cell-2"} {
+		if err := sim.Put(newTestMessage(name, "x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, _ := newWatchContext(t, "actor1-token")
+	stream := eventStream{newTestStream(ctx)}
+	req := &WatchRequest{Key: &api.Key{Namespace: "board"}, Snapshot: true}
+	serveWatch(t, sim, func() error { return s.WatchEvents(req, stream) })
+	if err := sim.Put(newTestMessage("cell-3", "o")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot comes first, in any order, with the revision of every
+	// message.
+	want := map[string]int64{"cell-1": 1, "cell-2": 2}
+	for n := len(want); n > 0; n-- {
+		event := stream.next(t).(*Event)
+		if event.Operation != string(simulator.OperationPut) || event.Message == nil {
+			t.Fatalf("got event %+v, want a put of the snapshot", event)
+		}
+		if revision, ok := want[event.Message.Key.Name]; !ok || event.Revision != revision {
+			t.Errorf("got %v with revision %d in the snapshot, want %v", event.Message.Key.Name, event.Revision, want)
+		}
+		delete(want, event.Message.Key.Name)
+	}
+
+	if event := stream.next(t).(*Event); event.Operation != string(simulator.OperationSynced) || event.Revision != 2 {
+		t.Errorf("got event %+v after the snapshot, want synced at revision 2", event)
+	}
+	if event := stream.next(t).(*Event); event.Operation != string(simulator.OperationPut) || event.Revision != 3 || event.Message.Key.Name != "cell-3" {
+		t.Errorf("got event %+v after synced, want the put of cell-3 at revision 3", event)
+	}
+}
+
+// revisions returns the revisions of the revision header.
+func revisions(t *testing.T, md metadata.MD) []int64 {
+	t.Helper()
+
+	res := make([]int64, 0)
+	for _, value := range md.Get(revisionHeader) {
+		revision, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, revision)
+	}
+	return res
+}
+
+func TestReadsHaveRevisions(t *testing.T) {
+	s, sim := newTestServer(t, testRules, testCredentials)
+	for _, name := range []string{"cell-1", "cell-2", "cell-1"} {
+		if err := sim.Put(newTestMessage(name, "x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, _ := newWatchContext(t, "actor1-token")
+	stream := messageStream{newTestStream(ctx)}
+	if err := s.GetAll(&api.Key{Namespace: "board"}, stream); err != nil {
+		t.Fatal(err)
+	}
+	got := revisions(t, stream.transport.Header())
+	if len(got) != 2 {
+		t.Fatalf("got revisions %v for 2 messages", got)
+	}
+	want := map[string]int64{"cell-1": 3, "cell-2": 2}
+	for _, revision := range got {
+		mes := stream.next(t).(*api.Message)
+		if revision != want[mes.Key.Name] {
+			t.Errorf("got revision %d for %v, want %d", revision, mes.Key.Name, want[mes.Key.Name])
+		}
+	}
+
+	// The header is sent before the first event.
+	watch, _, _ := startWatch(t, s, sim, "actor1-token", &api.Key{Namespace: "board"})
+	if err := sim.Put(newTestMessage("cell-3", "o")); err != nil {
+		t.Fatal(err)
+	}
+	watch.next(t)
+	if got := revisions(t, watch.transport.Header()); len(got) != 1 || got[0] != 3 {
+		t.Errorf("got revisions %v for a watch, want the current revision 3", got)
+	}
+}
+
+// names returns the names of the keys of the messages which are sent to the
+// stream so far.
+func names(t *testing.T, stream *testStream) map[string]int {
+	t.Helper()
+
+	res := make(map[string]int)
+	for len(stream.sent) > 0 {
+		var mes *api.Message
+		switch m := (<-stream.sent).(type) {
+		case *api.Message:
+			mes = m
+		case *Event:
+			mes = m.Message
+		case *Version:
+			mes = m.Message
+		}
+		if mes != nil {
+			res[mes.Key.Name]++
+		}
+	}
+	return res
+}
+
+func TestDeniedKeysAreHidden(t *testing.T) {
+	s, sim := newTestServer(t, testDenyRules, testCredentials)
+	for _, name := range []string{"cell-1", "secret-1"} {
+		if err := sim.Put(newTestMessage(name, "x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := &api.Key{Namespace: "board"}
+
+	ctx, _ := newWatchContext(t, "actor1-token")
+	all := messageStream{newTestStream(ctx)}
+	if err := s.GetAll(key, all); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, all.testStream); len(got) != 1 || got["cell-1"] != 1 {
+		t.Errorf("got %v from GetAll, want only cell-1", got)
+	}
+	if got := revisions(t, all.transport.Header()); len(got) != 1 || got[0] != 1 {
+		t.Errorf("got revisions %v from GetAll, want only the one of cell-1", got)
+	}
+
+	history := historyStream{newTestStream(ctx)}
+	if err := s.GetHistory(&HistoryRequest{Key: key}, history); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, history.testStream); len(got) != 1 || got["cell-1"] != 1 {
+		t.Errorf("got %v from GetHistory, want only cell-1", got)
+	}
+
+	watch, _, _ := startWatch(t, s, sim, "actor1-token", key)
+	events := eventStream{newTestStream(ctx)}
+	serveWatch(t, sim, func() error {
+		return s.WatchEvents(&WatchRequest{Key: key, Snapshot: true}, events)
+	})
+	for _, name := range []string{"secret-2", "cell-2"} {
+		if err := sim.Put(newTestMessage(name, "x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The put of cell-2 comes after the one of secret-2, so once it is sent
+	// secret-2 would have been sent too.
+	if mes := watch.next(t).(*api.Message); mes.Key.Name != "cell-2" {
+		t.Errorf("got %v from Watch, want only cell-2", mes.Key.Name)
+	}
+	want := []string{"cell-1", "", "cell-2"}
+	for _, name := range want {
+		event := events.next(t).(*Event)
+		if got := event.Message.GetKey().GetName(); got != name {
+			t.Errorf("got event %+v from WatchEvents, want the events of %v", event, want)
+		}
+	}
+
+	if _, err := s.DeleteAll(withToken(context.Background(), "actor1-token"), key); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := sim.GetAll(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || !strings.HasPrefix(messages[0].Key.Name, "secret-") || !strings.HasPrefix(messages[1].Key.Name, "secret-") {
+		t.Errorf("got %v after DeleteAll, want only the secrets", messages)
+	}
+}
+
+func TestReloadRevokesWatches(t *testing.T) {
+	tests := []struct {
+		name        string
+		rules       string
+		credentials string
+	}{
+		{
+			name: "rule is removed",
+			rules: `
+director:
+- key: {}
+  methods: [get, getAll, put, delete, deleteAll, watch, getHistory]
+actors:
+  red:
+  - key:
+      namespace: "board"
+    methods: [get, getAll, put]
+`,
+			credentials: testCredentials,
+		},
+		{
+			name: "user is removed",
+			rules: `
+director:
+- key: {}
+  methods: [get, getAll, put, delete, deleteAll, watch, getHistory]
+actors: {}
+`,
+			credentials: `
+- name: director
+  token: director-token
+  character: director
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, sim := newTestServer(t, testRules, testCredentials)
+			key := &api.Key{Namespace: "board"}
+			_, _, actor := startWatch(t, s, sim, "actor1-token", key)
+			_, _, director := startWatch(t, s, sim, "director-token", key)
+
+			writeTestConfig(t, test.rules, test.credentials)
+			if err := s.manager.Reload(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := waitForEnd(t, actor); status.Code(err) != codes.PermissionDenied {
+				t.Errorf("got error %v for the watch of the actor, want PermissionDenied", err)
+			}
+			select {
+			case err := <-director:
+				t.Errorf("the watch of the director ended with %v", err)
+			default:
+			}
+			waitForWatchers(t, sim, 1)
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"github.com/Gimulator/protobuf/go/api"
+	"google.golang.org/grpc"
+)
+
+// HistoryAPI streams the past versions of messages, which MessageAPI
+// overwrites. Like EventAPI, its messages are encoded with jsonCodec.
+
+// HistoryRequest asks for the versions of the messages matching Key whose
+// revision is greater than Since, oldest first. A positive Limit sends only
+// the first Limit of them, so the history can be read in pages by passing the
+// last revision as Since.
+type HistoryRequest struct {
+	Key   *api.Key `json:"key"`
+	Limit int      `json:"limit,omitempty"`
+	Since int64    `json:"since,omitempty"`
+}
+
+// Version is a put, delete or expiry of a message. Time is formatted as RFC
+// 3339 and the owner of the message is the one who put it; for deletes and
+// expiries, Message is the version which is removed.
+type Version struct {
+	Operation string       `json:"operation"`
+	Revision  int64        `json:"revision"`
+	Time      string       `json:"time"`
+	Message   *api.Message `json:"message"`
+}
+
+type HistoryAPIServer interface {
+	GetHistory(*HistoryRequest, HistoryAPI_GetHistoryServer) error
+}
+
+type HistoryAPI_GetHistoryServer interface {
+	Send(*Version) error
+	grpc.ServerStream
+}
+
+type historyAPIGetHistoryServer struct {
+	grpc.ServerStream
+}
+
+func (x *historyAPIGetHistoryServer) Send(m *Version) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func RegisterHistoryAPIServer(s *grpc.Server, srv HistoryAPIServer) {
+	s.RegisterService(&historyAPIServiceDesc, srv)
+}
+
+func historyAPIGetHistoryHandler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(HistoryRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(HistoryAPIServer).GetHistory(m, &historyAPIGetHistoryServer{stream})
+}
+
+var historyAPIServiceDesc = grpc.ServiceDesc{
+	ServiceName: "api.HistoryAPI",
+	HandlerType: (*HistoryAPIServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GetHistory",
+			Handler:       historyAPIGetHistoryHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/historyapi.go",
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// writeMethods are the methods which change the state of Gimulator. All of
+// them are unary.
+var writeMethods = map[string]bool{
+	"Put":           true,
+	"Delete":        true,
+	"DeleteAll":     true,
+	"Batch":         true,
+	"SetUserStatus": true,
+	"PutResult":     true,
+	"ImReady":       true,
+	"Reload":        true,
+	"Restore":       true,
+}
+
+// ReadOnlyInterceptor rejects the methods which change the state of Gimulator
+// with FailedPrecondition, e.g. while a recorded match is replayed. Use it with
+// grpc.UnaryInterceptor.
+func ReadOnlyInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if writeMethods[path.Base(info.FullMethod)] {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("invalid action: %v can not be called, Gimulator is read-only", info.FullMethod))
+	}
+	return handler(ctx, req)
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"context"
+
+	"github.com/Gimulator/protobuf/go/api"
+	"google.golang.org/grpc"
+)
+
+// TransactionAPI applies several writes atomically. Like EventAPI, its
+// messages are encoded with jsonCodec.
+
+type BatchRequest struct {
+	Operations []*BatchOperation `json:"operations"`
+}
+
+// BatchOperation is either a put of Content with Key, or a delete of Key. A
+// put may carry a time-to-live such as "30s".
+type BatchOperation struct {
+	Operation string   `json:"operation"`
+	Key       *api.Key `json:"key"`
+	Content   string   `json:"content,omitempty"`
+	TTL       string   `json:"ttl,omitempty"`
+}
+
+type BatchResponse struct {
+	Revision int64 `json:"revision"`
+}
+
+type TransactionAPIServer interface {
+	Batch(context.Context, *BatchRequest) (*BatchResponse, error)
+}
+
+func RegisterTransactionAPIServer(s *grpc.Server, srv TransactionAPIServer) {
+	s.RegisterService(&transactionAPIServiceDesc, srv)
+}
+
+func transactionAPIBatchHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransactionAPIServer).Batch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.TransactionAPI/Batch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransactionAPIServer).Batch(ctx, req.(*BatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var transactionAPIServiceDesc = grpc.ServiceDesc{
+	ServiceName: "api.TransactionAPI",
+	HandlerType: (*TransactionAPIServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Batch",
+			Handler:    transactionAPIBatchHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "api/transactionapi.go",
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"sync"
+
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+// watchSession is a running watch, kept so it can be authorized again when
+// the config is reloaded.
+type watchSession struct {
+	user *api.User
+	key  *api.Key
+
+	mux    sync.Mutex
+	denied func(*api.Key) bool
+
+	revoked chan struct{}
+	once    sync.Once
+}
+
+func newWatchSession(user *api.User, key *api.Key, denied func(*api.Key) bool) *watchSession {
+	return &watchSession{
+		user:    user,
+		key:     key,
+		denied:  denied,
+		revoked: make(chan struct{}),
+	}
+}
+
+// isDenied reports whether the events of key must not be sent to the watcher.
+func (w *watchSession) isDenied(key *api.Key) bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	return w.denied != nil && w.denied(key)
+}
+
+func (w *watchSession) setDenied(denied func(*api.Key) bool) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	w.denied = denied
+}
+
+// revoke makes the watch end with PermissionDenied.
+func (w *watchSession) revoke() {
+	w.once.Do(func() {
+		close(w.revoked)
+	})
+}
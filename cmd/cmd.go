@@ -3,12 +3,23 @@ package cmd
 import (
 	"flag"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	EpilogueType = ""
 	LogLevel     = ""
+	Storage      = ""
+
+	EpiloguePolicy  = ""
+	EpilogueRetries = ""
+	EpilogueBackoff = ""
+
+	SqlitePath        = ""
+	SqliteJournalMode = ""
+	SqliteSynchronous = ""
 
 	RabbitHost     = ""
 	RabbitUsername = ""
@@ -17,20 +28,88 @@ var (
 	ConfigDir      = ""
 	Host           = ""
 	Id             = ""
+
+	WebhookURL     = ""
+	WebhookHeaders = ""
+	WebhookSecret  = ""
+
+	WebhookTimeout time.Duration = 0
+
+	FilePath         = ""
+	FileSnapshotPath = ""
+
+	ChangeLogSize   = 0
+	WatchBufferSize = 0
+	WatchPolicy     = ""
+
+	ConfigReloadInterval time.Duration = 0
+
+	Record = ""
+
+	// Command is the subcommand Gimulator is run with, e.g. "replay" for
+	// "gimulator replay <file>", and empty otherwise.
+	Command     = ""
+	ReplayFile  = ""
+	ReplaySpeed = 1.0
+	ReplayStep  = false
+
+	// SnapshotFile is the file of the snapshot and restore subcommands, which
+	// call the Gimulator at Host with Token.
+	SnapshotFile = ""
+	Token        = ""
+)
+
+// commands are the subcommands of Gimulator.
+var commands = map[string]bool{
+	"replay":   true,
+	"snapshot": true,
+	"restore":  true,
+}
+
+const (
+	defaultChangeLogSize  = 4096
+	defaultWebhookTimeout = 10 * time.Second
 )
 
 func ParseFlags() {
-	flag.StringVar(&EpilogueType, "epilogue-type", "", "The epilogue component which Gimulator will write the result to it. Choices are: console, rabbitmq. Note: If you choose rabbitmq, you need to set the corresponding flags too.")
+	args := os.Args[1:]
+	if len(args) > 0 && commands[args[0]] {
+		Command = args[0]
+		args = args[1:]
+	}
+
+	flag.StringVar(&EpilogueType, "epilogue-type", "", "The epilogue components which Gimulator will write the result to, separated by commas, e.g. \"console,file\". Choices are: console, rabbitmq, webhook, file. Note: If you choose rabbitmq, webhook or file, you need to set the corresponding flags too.")
+	flag.StringVar(&EpiloguePolicy, "epilogue-policy", "", "when the result counts as delivered. Choices are: all (default), every epilogue has to receive it, and best-effort, at least one epilogue has to receive it")
+	flag.StringVar(&EpilogueRetries, "epilogue-retries", "", "how many times a failed write into an epilogue is retried, per epilogue, e.g. \"rabbitmq=10,file=0\", default is 3")
+	flag.StringVar(&EpilogueBackoff, "epilogue-backoff", "", "how long Gimulator waits before the first retry of an epilogue, per epilogue, e.g. \"rabbitmq=1s\", doubled for every next retry up to a minute, default is 5s")
+	flag.StringVar(&Storage, "storage", "", "The storage which Gimulator keeps messages, users and rules in. Choices are: sqlite (default), memory. Note: memory needs neither sqlite nor cgo, but nothing survives a restart.")
+	flag.StringVar(&SqlitePath, "sqlite-path", "", "the path of the sqlite database, default is data.db. If the file exists, Gimulator resumes from it: its messages are kept and its users and rules are replaced with the ones of the config")
+	flag.StringVar(&SqliteJournalMode, "sqlite-journal-mode", "", "the journal mode of the sqlite database. Choices are: delete (default), truncate, persist, memory, wal, off")
+	flag.StringVar(&SqliteSynchronous, "sqlite-synchronous", "", "how often the sqlite database waits for its writes to reach the disk. Choices are: off, normal, full (default), extra. normal is safe with wal")
 	flag.StringVar(&LogLevel, "log-level", "", "Logging severity. Choose from TRACE, DEBUG, INFO, WARN, ERROR, FATAL and PANIC")
 
 	flag.StringVar(&RabbitHost, "rabbit-url", "", "the host of rabbitMQ, Gimulator will use this address to connect to rabbitMQ for sending the result of the room")
 	flag.StringVar(&RabbitUsername, "rabbit-username", "", "the username of rabbitMQ, Gimulator will use this username to connect to rabbitMQ for sending the result of the room")
 	flag.StringVar(&RabbitPassword, "rabbit-password", "", "the password of rabbitMQ, Gimulator will use this password to connect to rabbitMQ for sending the result of the room")
 	flag.StringVar(&RabbitQueue, "rabbit-result-queue", "", "the queue of rabbitMQ where Gimulator will use to send the result of room")
+	flag.StringVar(&WebhookURL, "webhook-url", "", "the http or https url which Gimulator posts the result of the room to as JSON")
+	flag.StringVar(&WebhookHeaders, "webhook-headers", "", "the headers of the webhook request, e.g. \"Authorization=Bearer abc,X-Room=room-1\"")
+	flag.StringVar(&WebhookSecret, "webhook-secret", "", "the secret which the body of the webhook request is signed with, the HMAC-SHA256 is sent in the X-Gimulator-Signature header as sha256=<hex>")
+	flag.DurationVar(&WebhookTimeout, "webhook-timeout", 0, "how long Gimulator waits for the webhook to respond, default is 10s")
+	flag.StringVar(&FilePath, "file-path", "", "the path of the file which Gimulator writes the result of the room to as JSON")
+	flag.StringVar(&FileSnapshotPath, "file-snapshot-path", "", "the path of the file which Gimulator writes the final state of the room to, as YAML if it ends in .yaml or .yml and as JSON otherwise, empty disables it")
 	flag.StringVar(&ConfigDir, "config-dir", "", "the direction of the Gimulator's configuration, this directory should contain two rules.yaml and credentials.yaml files")
 	flag.StringVar(&Host, "host", "", "the host of Gimulator, where Gimulator listens on")
 	flag.StringVar(&Id, "id", "", "the id of Gimulator, which distinguishes each gimulator instance from others")
-	flag.Parse()
+	flag.IntVar(&WatchBufferSize, "watch-buffer-size", 0, "the number of events Gimulator buffers for every watcher before applying its watch policy, default is 128")
+	flag.StringVar(&WatchPolicy, "watch-policy", "", "what to do with a watcher whose buffer is full, per character, e.g. \"actor=coalesce,director=disconnect\". Choices are: drop-newest (default), drop-oldest, coalesce, disconnect")
+	flag.IntVar(&ChangeLogSize, "change-log-size", 0, "the number of last changes Gimulator keeps, so that watchers can resume from a revision they have already seen")
+	flag.DurationVar(&ConfigReloadInterval, "config-reload-interval", 0, "how often Gimulator checks rules.yaml and credentials.yaml for changes to reload them, e.g. 5s, zero disables it. Sending SIGHUP always reloads them")
+	flag.StringVar(&Record, "record", "", "the path of a match log which Gimulator appends every change of the match to, one JSON object per line, empty disables recording")
+	flag.Float64Var(&ReplaySpeed, "replay-speed", 1, "replay only: how much faster than the original pacing the match log is replayed, e.g. 4, zero replays it without waiting")
+	flag.BoolVar(&ReplayStep, "replay-step", false, "replay only: replay the match log step by step, one entry for every line read from the standard input")
+	flag.StringVar(&Token, "token", "", "snapshot and restore only: the token of a master or operator of the Gimulator at host")
+	flag.CommandLine.Parse(args)
 
 	if EpilogueType == "" {
 		if EpilogueType = os.Getenv("GIMULATOR_EPILOGUE_TYPE"); EpilogueType == "" {
@@ -38,6 +117,34 @@ func ParseFlags() {
 		}
 	}
 
+	if EpiloguePolicy == "" {
+		EpiloguePolicy = os.Getenv("GIMULATOR_EPILOGUE_POLICY")
+	}
+	if EpilogueRetries == "" {
+		EpilogueRetries = os.Getenv("GIMULATOR_EPILOGUE_RETRIES")
+	}
+	if EpilogueBackoff == "" {
+		EpilogueBackoff = os.Getenv("GIMULATOR_EPILOGUE_BACKOFF")
+	}
+
+	if Storage == "" {
+		if Storage = os.Getenv("GIMULATOR_STORAGE"); Storage == "" {
+			Storage = "sqlite"
+		}
+	}
+
+	if SqlitePath == "" {
+		if SqlitePath = os.Getenv("GIMULATOR_SQLITE_PATH"); SqlitePath == "" {
+			SqlitePath = "data.db"
+		}
+	}
+	if SqliteJournalMode == "" {
+		SqliteJournalMode = os.Getenv("GIMULATOR_SQLITE_JOURNAL_MODE")
+	}
+	if SqliteSynchronous == "" {
+		SqliteSynchronous = os.Getenv("GIMULATOR_SQLITE_SYNCHRONOUS")
+	}
+
 	if LogLevel == "" {
 		LogLevel = os.Getenv("GIMULATOR_LOG_LEVEL")
 	}
@@ -56,6 +163,28 @@ func ParseFlags() {
 		RabbitQueue = os.Getenv("GIMULATOR_RABBIT_RESULT_QUEUE")
 	}
 
+	if WebhookURL == "" {
+		WebhookURL = os.Getenv("GIMULATOR_WEBHOOK_URL")
+	}
+	if WebhookHeaders == "" {
+		WebhookHeaders = os.Getenv("GIMULATOR_WEBHOOK_HEADERS")
+	}
+	if WebhookSecret == "" {
+		WebhookSecret = os.Getenv("GIMULATOR_WEBHOOK_SECRET")
+	}
+	if WebhookTimeout == 0 {
+		if WebhookTimeout, _ = time.ParseDuration(os.Getenv("GIMULATOR_WEBHOOK_TIMEOUT")); WebhookTimeout == 0 {
+			WebhookTimeout = defaultWebhookTimeout
+		}
+	}
+
+	if FilePath == "" {
+		FilePath = os.Getenv("GIMULATOR_FILE_PATH")
+	}
+	if FileSnapshotPath == "" {
+		FileSnapshotPath = os.Getenv("GIMULATOR_FILE_SNAPSHOT_PATH")
+	}
+
 	if ConfigDir == "" {
 		ConfigDir = os.Getenv("GIMULATOR_CONFIG_DIR")
 	}
@@ -65,10 +194,72 @@ func ParseFlags() {
 	if Id == "" {
 		Id = os.Getenv("GIMULATOR_ID")
 	}
+	if ChangeLogSize == 0 {
+		ChangeLogSize, _ = strconv.Atoi(os.Getenv("GIMULATOR_CHANGE_LOG_SIZE"))
+	}
+	if WatchBufferSize == 0 {
+		WatchBufferSize, _ = strconv.Atoi(os.Getenv("GIMULATOR_WATCH_BUFFER_SIZE"))
+	}
+	if WatchPolicy == "" {
+		WatchPolicy = os.Getenv("GIMULATOR_WATCH_POLICY")
+	}
+	if ConfigReloadInterval == 0 {
+		ConfigReloadInterval, _ = time.ParseDuration(os.Getenv("GIMULATOR_CONFIG_RELOAD_INTERVAL"))
+	}
+	if Record == "" {
+		Record = os.Getenv("GIMULATOR_RECORD")
+	}
+	if ChangeLogSize == 0 {
+		ChangeLogSize = defaultChangeLogSize
+	}
 
-	if ((EpilogueType == "rabbitmq") && (RabbitHost == "" || RabbitUsername == "" || RabbitPassword == "" || RabbitQueue == "")) || ConfigDir == "" || Host == "" || Id == "" {
+	if Command == "snapshot" || Command == "restore" {
+		SnapshotFile = flag.Arg(0)
+		if Token == "" {
+			Token = os.Getenv("GIMULATOR_TOKEN")
+		}
+		if SnapshotFile == "" || Host == "" || Token == "" {
+			println("Usage: gimulator " + Command + " --host <host> --token <token> <file>")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if Command == "replay" {
+		ReplayFile = flag.Arg(0)
+		if ReplayFile == "" || ReplaySpeed < 0 || ConfigDir == "" || Host == "" {
+			println("Usage: gimulator replay [flags] <match log>")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if (HasEpilogue("rabbitmq") && (RabbitHost == "" || RabbitUsername == "" || RabbitPassword == "" || RabbitQueue == "")) || (HasEpilogue("webhook") && WebhookURL == "") || (HasEpilogue("file") && FilePath == "") || (Storage != "sqlite" && Storage != "memory") || ConfigDir == "" || Host == "" || Id == "" {
 		println("Please set the needed flags.")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 }
+
+// EpilogueTypes returns the epilogues of EpilogueType.
+func EpilogueTypes() []string {
+	var types []string
+	for _, typ := range strings.Split(EpilogueType, ",") {
+		if typ = strings.TrimSpace(typ); typ != "" {
+			types = append(types, typ)
+		}
+	}
+	return types
+}
+
+// HasEpilogue reports whether typ is one of the epilogues of EpilogueType.
+func HasEpilogue(typ string) bool {
+	for _, t := range EpilogueTypes() {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Gimulator/Gimulator/cmd"
+	"github.com/Gimulator/Gimulator/epilogues"
+	"github.com/Gimulator/Gimulator/simulator"
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// newEpilogue sets up every epilogue of --epilogue-type and fans the result out
+// to them with the policy, retries and backoffs of the flags.
+func newEpilogue(sim *simulator.Simulator, strg storage.Storage) (epilogues.Epilogue, error) {
+	log := logrus.WithField("component", "main")
+
+	policy, err := epilogues.ParsePolicy(cmd.EpiloguePolicy)
+	if err != nil {
+		return nil, err
+	}
+	retries, err := epilogues.ParseRetries(cmd.EpilogueRetries)
+	if err != nil {
+		return nil, err
+	}
+	backoffs, err := epilogues.ParseBackoffs(cmd.EpilogueBackoff)
+	if err != nil {
+		return nil, err
+	}
+
+	types := cmd.EpilogueTypes()
+	for typ := range retries {
+		if !cmd.HasEpilogue(typ) {
+			return nil, fmt.Errorf("invalid epilogue retries, %q is not an epilogue of %q", typ, cmd.EpilogueType)
+		}
+	}
+	for typ := range backoffs {
+		if !cmd.HasEpilogue(typ) {
+			return nil, fmt.Errorf("invalid epilogue backoff, %q is not an epilogue of %q", typ, cmd.EpilogueType)
+		}
+	}
+
+	targets := make([]*epilogues.Target, 0, len(types))
+	for _, typ := range types {
+		log.WithField("epilogue-type", typ).Info("Starting to setup epilogue")
+		epilogue, err := newTargetEpilogue(typ, sim, strg)
+		if err != nil {
+			return nil, fmt.Errorf("could not setup %v: %v", typ, err)
+		}
+		log.WithField("epilogue-type", typ).Info("Epilogue is initialized")
+
+		target := epilogues.NewTarget(typ, epilogue)
+		if n, ok := retries[typ]; ok {
+			target.Retries = n
+		}
+		if d, ok := backoffs[typ]; ok {
+			target.Backoff = d
+		}
+		targets = append(targets, target)
+	}
+
+	return epilogues.NewComposite(policy, targets...)
+}
+
+func newTargetEpilogue(typ string, sim *simulator.Simulator, strg storage.Storage) (epilogues.Epilogue, error) {
+	switch typ {
+	case "console":
+		return epilogues.NewConsole()
+	case "rabbitmq":
+		return epilogues.NewRabbitMQ(cmd.RabbitHost, cmd.RabbitUsername, cmd.RabbitPassword, cmd.RabbitQueue)
+	case "webhook":
+		headers, err := epilogues.ParseHeaders(cmd.WebhookHeaders)
+		if err != nil {
+			return nil, err
+		}
+		return epilogues.NewWebhook(cmd.WebhookURL, headers, cmd.WebhookSecret, cmd.WebhookTimeout)
+	case "file":
+		return epilogues.NewFile(cmd.FilePath, cmd.FileSnapshotPath, sim, strg)
+	default:
+		return nil, fmt.Errorf("unknown epilogue type %q, choices are: console, rabbitmq, webhook, file", typ)
+	}
+}
@@ -3,14 +3,17 @@ package main
 import (
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
 	"path"
 	"runtime"
+	"syscall"
 
 	"github.com/Gimulator/Gimulator/api"
 	"github.com/Gimulator/Gimulator/cmd"
 	"github.com/Gimulator/Gimulator/config"
-	"github.com/Gimulator/Gimulator/epilogues"
 	"github.com/Gimulator/Gimulator/manager"
+	"github.com/Gimulator/Gimulator/record"
 	"github.com/Gimulator/Gimulator/simulator"
 	"github.com/Gimulator/Gimulator/storage"
 	proto "github.com/Gimulator/protobuf/go/api"
@@ -65,6 +68,18 @@ func init() {
 }
 
 func main() {
+	switch cmd.Command {
+	case "replay":
+		replay()
+		return
+	case "snapshot":
+		saveSnapshot()
+		return
+	case "restore":
+		restoreSnapshot()
+		return
+	}
+
 	log := logrus.WithField("component", "main")
 
 	log.WithField("config-dir", cmd.ConfigDir).Info("starting to setup configs")
@@ -74,47 +89,92 @@ func main() {
 		panic(err)
 	}
 
-	log.Info("Starting to setup sqlite")
-	// Using In-Memory Database with Shared Cache (Instad of private cache)
-	sqlite, err := storage.NewSqlite("file:data.db?cache=private&mode=rwc&_timeout=500", config)
+	var strg storage.Storage
+
+	log.WithField("storage", cmd.Storage).Info("Starting to setup storage")
+	switch cmd.Storage {
+	case "sqlite":
+		dsn, err := storage.SqliteDSN(cmd.SqlitePath, cmd.SqliteJournalMode, cmd.SqliteSynchronous)
+		if err != nil {
+			log.WithError(err).Fatal("Could not setup sqlite")
+			panic(err)
+		}
+
+		log.WithField("sqlite-path", cmd.SqlitePath).WithField("sqlite-journal-mode", cmd.SqliteJournalMode).Info("Starting to setup sqlite")
+		strg, err = storage.NewSqlite(dsn, config)
+		if err != nil {
+			log.WithError(err).Fatal("Could not setup sqlite")
+			panic(err)
+		}
+	case "memory":
+		strg, err = storage.NewMemoryWithConfig(config)
+		if err != nil {
+			log.WithError(err).Fatal("Could not setup memory")
+			panic(err)
+		}
+	}
+
+	log.WithField("watch-policy", cmd.WatchPolicy).Info("Starting to setup watch policies")
+	policies, err := simulator.ParsePolicies(cmd.WatchPolicy)
+	if err != nil {
+		log.WithError(err).Fatal("Could not setup watch policies")
+		panic(err)
+	}
+
+	var recorder *record.Writer
+	if cmd.Record != "" {
+		log.WithField("record", cmd.Record).Info("Starting to setup recorder")
+		recorder, err = record.NewWriter(cmd.Record)
+		if err != nil {
+			log.WithError(err).Fatal("Could not setup recorder")
+			panic(err)
+		}
+	}
+
+	seeded, err := strg.SeededRevision()
 	if err != nil {
-		log.WithError(err).Fatal("Could not setup sqlite")
+		log.WithError(err).Fatal("Could not setup storage")
 		panic(err)
 	}
 
+	simConfig := simulator.Config{
+		ChangeLogSize:   cmd.ChangeLogSize,
+		WatchBufferSize: cmd.WatchBufferSize,
+		WatchPolicies:   policies,
+		Seeded:          seeded,
+	}
+	if recorder != nil {
+		simConfig.Recorder = recorder
+	}
+
 	log.Info("Starting to setup simulator")
-	simulator, err := simulator.NewSimulator(sqlite)
+	simulator, err := simulator.NewSimulator(strg, simConfig)
 	if err != nil {
 		log.WithError(err).Fatal("Could not setup simulator")
 		panic(err)
 	}
 
-	var epilogue epilogues.Epilogue
-
-	log.WithField("epilogue-type", cmd.EpilogueType).Info("Starting to setup epilogue")
-	switch cmd.EpilogueType {
-	case "console":
-		epilogue, err = epilogues.NewConsole()
-		log.Info("Epilogue console is initialized")
-		if err != nil {
-			log.WithError(err).Fatal("Could not setup console")
-			panic(err)
-		}
-	case "rabbitmq":
-		epilogue, err = epilogues.NewRabbitMQ(cmd.RabbitHost, cmd.RabbitUsername, cmd.RabbitPassword, cmd.RabbitQueue)
-		log.Info("Epilogue RabbitMQ is initialized")
-		if err != nil {
-			log.WithError(err).Fatal("Could not setup rabbit")
-			panic(err)
-		}
+	log.WithField("epilogue-type", cmd.EpilogueType).WithField("epilogue-policy", cmd.EpiloguePolicy).Info("Starting to setup epilogues")
+	epilogue, err := newEpilogue(simulator, strg)
+	if err != nil {
+		log.WithError(err).Fatal("Could not setup epilogues")
+		panic(err)
 	}
 
 	log.Info("Starting to setup manager")
-	manager, err := manager.NewManager(sqlite, sqlite, epilogue)
+	manager, err := manager.NewManager(strg, strg, epilogue)
 	if err != nil {
 		log.WithError(err).Fatal("Could not setup manager")
 		panic(err)
 	}
+	if recorder != nil {
+		manager.Recorder = recorder
+	}
+
+	log.WithField("config-reload-interval", cmd.ConfigReloadInterval).Info("Starting to watch configs")
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go manager.WatchConfig(cmd.ConfigReloadInterval, sighup)
 
 	log.Info("Starting to setup server")
 	server, err := api.NewServer(manager, simulator)
@@ -132,12 +192,20 @@ func main() {
 
 	log.Info("Starting to serve")
 	s := grpc.NewServer()
-	proto.RegisterMessageAPIServer(s, server)
-	proto.RegisterOperatorAPIServer(s, server)
-	proto.RegisterDirectorAPIServer(s, server)
-	proto.RegisterUserAPIServer(s, server)
+	registerServices(s, server)
 	if err := s.Serve(listener); err != nil {
 		log.WithError(err).Fatal("Could not serve")
 		panic(err)
 	}
 }
+
+func registerServices(s *grpc.Server, server *api.Server) {
+	proto.RegisterMessageAPIServer(s, server)
+	proto.RegisterOperatorAPIServer(s, server)
+	proto.RegisterDirectorAPIServer(s, server)
+	proto.RegisterUserAPIServer(s, server)
+	api.RegisterEventAPIServer(s, server)
+	api.RegisterTransactionAPIServer(s, server)
+	api.RegisterHistoryAPIServer(s, server)
+	api.RegisterAdminAPIServer(s, server)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+
+	"github.com/Gimulator/Gimulator/api"
+	"github.com/Gimulator/Gimulator/cmd"
+	"github.com/Gimulator/Gimulator/config"
+	"github.com/Gimulator/Gimulator/manager"
+	"github.com/Gimulator/Gimulator/record"
+	"github.com/Gimulator/Gimulator/simulator"
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// replay replays the match log of cmd.ReplayFile into a memory storage, while
+// clients watch it with the usual services, which are read-only. The final
+// state is served until Gimulator is stopped.
+func replay() {
+	log := logrus.WithField("component", "replay")
+
+	log.WithField("replay-file", cmd.ReplayFile).Info("Starting to read match log")
+	entries, err := record.ReadFile(cmd.ReplayFile)
+	if err != nil {
+		log.WithError(err).Fatal("Could not read match log")
+		panic(err)
+	}
+
+	log.WithField("config-dir", cmd.ConfigDir).Info("starting to setup configs")
+	config, err := config.NewConfig(cmd.ConfigDir)
+	if err != nil {
+		log.WithField("config-dir", cmd.ConfigDir).WithError(err).Fatal("Could not setup configs")
+		panic(err)
+	}
+
+	log.Info("Starting to setup memory")
+	strg, err := storage.NewMemoryWithConfig(config)
+	if err != nil {
+		log.WithError(err).Fatal("Could not setup memory")
+		panic(err)
+	}
+
+	log.WithField("watch-policy", cmd.WatchPolicy).Info("Starting to setup watch policies")
+	policies, err := simulator.ParsePolicies(cmd.WatchPolicy)
+	if err != nil {
+		log.WithError(err).Fatal("Could not setup watch policies")
+		panic(err)
+	}
+
+	log.Info("Starting to setup simulator")
+	sim, err := simulator.NewSimulator(strg, simulator.Config{
+		ChangeLogSize:   cmd.ChangeLogSize,
+		WatchBufferSize: cmd.WatchBufferSize,
+		WatchPolicies:   policies,
+	})
+	if err != nil {
+		log.WithError(err).Fatal("Could not setup simulator")
+		panic(err)
+	}
+
+	log.Info("Starting to setup manager")
+	manager, err := manager.NewManager(strg, strg, nil)
+	if err != nil {
+		log.WithError(err).Fatal("Could not setup manager")
+		panic(err)
+	}
+
+	log.Info("Starting to setup server")
+	server, err := api.NewServer(manager, sim)
+	if err != nil {
+		log.WithError(err).Fatal("Could not setup server")
+		panic(err)
+	}
+
+	log.WithField("host", cmd.Host).Info("Starting to setup listener")
+	listener, err := net.Listen("tcp", cmd.Host)
+	if err != nil {
+		log.WithError(err).Fatal("Could not setup listener")
+		panic(err)
+	}
+
+	var step io.Reader
+	if cmd.ReplayStep {
+		step = os.Stdin
+		log.Info("Press enter to replay the next entry")
+	}
+	player := record.NewPlayer(sim, strg, cmd.ReplaySpeed, step)
+
+	go func() {
+		log.WithField("entries", len(entries)).WithField("replay-speed", cmd.ReplaySpeed).Info("Starting to replay match log")
+		if _, err := player.Play(context.Background(), entries); err != nil {
+			log.WithError(err).Error("Could not replay match log")
+			return
+		}
+		log.Info("Replay is finished, the final state is served until Gimulator is stopped")
+	}()
+
+	log.Info("Starting to serve")
+	s := grpc.NewServer(grpc.UnaryInterceptor(api.ReadOnlyInterceptor))
+	registerServices(s, server)
+	if err := s.Serve(listener); err != nil {
+		log.WithError(err).Fatal("Could not serve")
+		panic(err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/Gimulator/Gimulator/api"
+	"github.com/Gimulator/Gimulator/cmd"
+	"github.com/Gimulator/Gimulator/snapshot"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// snapshotTimeout bounds the calls of the snapshot and restore subcommands.
+const snapshotTimeout = time.Minute
+
+// saveSnapshot writes the state of the Gimulator at cmd.Host to
+// cmd.SnapshotFile.
+func saveSnapshot() {
+	log := logrus.WithField("component", "snapshot").WithField("host", cmd.Host).WithField("snapshot-file", cmd.SnapshotFile)
+
+	client, ctx, cancel := newAdminAPIClient(log)
+	defer cancel()
+
+	log.Info("Starting to take snapshot")
+	snap, err := client.Snapshot(ctx, &api.SnapshotRequest{})
+	if err != nil {
+		log.WithError(err).Fatal("Could not take snapshot")
+	}
+
+	log.WithField("revision", snap.Revision).WithField("messages", len(snap.Messages)).Info("Starting to write snapshot")
+	if err := snap.WriteFile(cmd.SnapshotFile); err != nil {
+		log.WithError(err).Fatal("Could not write snapshot")
+	}
+}
+
+// restoreSnapshot restores cmd.SnapshotFile into the fresh Gimulator at
+// cmd.Host.
+func restoreSnapshot() {
+	log := logrus.WithField("component", "snapshot").WithField("host", cmd.Host).WithField("snapshot-file", cmd.SnapshotFile)
+
+	log.Info("Starting to read snapshot")
+	snap, err := snapshot.ReadFile(cmd.SnapshotFile)
+	if err != nil {
+		log.WithError(err).Fatal("Could not read snapshot")
+	}
+
+	client, ctx, cancel := newAdminAPIClient(log)
+	defer cancel()
+
+	log.WithField("revision", snap.Revision).WithField("messages", len(snap.Messages)).Info("Starting to restore snapshot")
+	if _, err := client.Restore(ctx, &api.RestoreRequest{Snapshot: snap}); err != nil {
+		log.WithError(err).Fatal("Could not restore snapshot")
+	}
+}
+
+func newAdminAPIClient(log *logrus.Entry) (api.AdminAPIClient, context.Context, context.CancelFunc) {
+	conn, err := grpc.Dial(cmd.Host, grpc.WithInsecure())
+	if err != nil {
+		log.WithError(err).Fatal("Could not connect to Gimulator")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	ctx = metadata.AppendToOutgoingContext(ctx, "token", cmd.Token)
+	return api.NewAdminAPIClient(conn), ctx, func() {
+		cancel()
+		conn.Close()
+	}
+}
@@ -1,22 +1,60 @@
 package config
 
 import (
+	"errors"
+	"io/fs"
 	"os"
 	"path/filepath"
 
+	"github.com/Gimulator/Gimulator/pattern"
 	"github.com/Gimulator/protobuf/go/api"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 var (
 	gimulatorConfigDir           string = "/etc/gimulator"
 	gimulatorRulesFileName       string = "rules.yaml"
 	gimulatorCredentialsFileName string = "credentials.yaml"
+
+	gimulatorInitialStateFileName string = "initial-state.yaml"
 )
 
+// Rule allows the methods on the keys which match its key, or denies them if
+// Deny is set. A deny rule overrides every allow rule.
 type Rule struct {
 	Key     api.Key  `yaml:"key"`
-	Methods []string `yaml:"methods"`
+	Methods []Method `yaml:"methods"`
+	Deny    bool     `yaml:"deny,omitempty"`
+}
+
+// Method is a method of a rule, written either as its name, such as "get", or
+// as its number.
+type Method api.Method
+
+// Methods of the rules which are not in api.Method, since they belong to the
+// services of Gimulator rather than the ones of the protobuf package. They are
+// numbered from 100, so they never collide with api.Method.
+const (
+	MethodGetHistory api.Method = 100
+)
+
+// methodNames are the names of every method a rule can have, by number.
+var methodNames = func() map[int32]string {
+	names := map[int32]string{
+		int32(MethodGetHistory): "getHistory",
+	}
+	for n, name := range api.Method_name {
+		names[n] = name
+	}
+	return names
+}()
+
+// MethodName returns the name of the method, such as "get" or "getHistory".
+func MethodName(method api.Method) string {
+	if name, ok := methodNames[int32(method)]; ok {
+		return name
+	}
+	return method.String()
 }
 
 type Character struct {
@@ -33,89 +71,176 @@ type Credential struct {
 	Role      string `yaml:"role"`
 }
 
+// InitialMessage is a message of initial-state.yaml, which is put on behalf of
+// Owner before Gimulator starts to serve.
+type InitialMessage struct {
+	Key     api.Key `yaml:"key"`
+	Content string  `yaml:"content"`
+	Owner   string  `yaml:"owner"`
+}
+
 type Config struct {
-	Character   Character
-	Credentials []Credential
+	Character    Character
+	Credentials  []Credential
+	InitialState []InitialMessage
 }
 
+// NewConfig loads and validates rules.yaml, credentials.yaml and the optional
+// initial-state.yaml of dir, or of the default directory if dir is empty.
+// Errors are reported as "file:line: message".
 func NewConfig(dir string) (*Config, error) {
-	character, err := newCharacter(dir)
+	if dir == "" {
+		dir = gimulatorConfigDir
+	}
+
+	character, rules, err := newCharacter(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, credentials, err := newCredentials(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	creds, err := newCredentials(dir)
+	if err := validate(character, rules, creds, credentials); err != nil {
+		return nil, err
+	}
+
+	initialState, err := newInitialState(dir, creds, credentials)
 	if err != nil {
 		return nil, err
 	}
 
+	addDefaultRules(&character)
+
 	return &Config{
-		Character:   character,
-		Credentials: creds,
+		Character:    character,
+		Credentials:  creds,
+		InitialState: initialState,
 	}, nil
 }
 
-func newCharacter(dir string) (Character, error) {
+// Paths returns the paths of the files NewConfig reads from dir.
+func Paths(dir string) []string {
 	if dir == "" {
 		dir = gimulatorConfigDir
 	}
-	path := filepath.Join(dir, gimulatorRulesFileName)
+	return []string{
+		filepath.Join(dir, gimulatorRulesFileName),
+		filepath.Join(dir, gimulatorCredentialsFileName),
+	}
+}
 
-	file, err := os.Open(path)
+func newCharacter(dir string) (Character, *document, error) {
+	character := Character{}
+	doc, err := decode(filepath.Join(dir, gimulatorRulesFileName), &character)
 	if err != nil {
-		return Character{}, err
+		return Character{}, nil, err
 	}
 
-	character := Character{}
-	if err := yaml.NewDecoder(file).Decode(&character); err != nil {
-		return Character{}, err
+	if err := compilePatterns(character, doc); err != nil {
+		return Character{}, nil, err
 	}
 
+	return character, doc, nil
+}
+
+func addDefaultRules(character *Character) {
 	character.Director = append(character.Director, Rule{
 		Key: api.Key{},
-		Methods: []string{
-			api.Method_name[int32(api.Method_getActors)],
-			api.Method_name[int32(api.Method_putResult)],
-			api.Method_name[int32(api.Method_ping)],
+		Methods: []Method{
+			Method(api.Method_getActors),
+			Method(api.Method_putResult),
+			Method(api.Method_ping),
 		},
 	})
 
 	character.Operator = append(character.Operator, Rule{
 		Key: api.Key{},
-		Methods: []string{
-			api.Method_name[int32(api.Method_setUserStatus)],
-			api.Method_name[int32(api.Method_ping)],
+		Methods: []Method{
+			Method(api.Method_setUserStatus),
+			Method(api.Method_ping),
 		},
 	})
 
 	for i := range character.Actors {
 		character.Actors[i] = append(character.Actors[i], Rule{
 			Key: api.Key{},
-			Methods: []string{
-				api.Method_name[int32(api.Method_imReady)],
-				api.Method_name[int32(api.Method_ping)],
+			Methods: []Method{
+				Method(api.Method_imReady),
+				Method(api.Method_ping),
 			},
 		})
 	}
+}
+
+// compilePatterns compiles the patterns of the rules once, so invalid ones
+// are reported now and valid ones are not parsed again on every request.
+func compilePatterns(character Character, doc *document) error {
+	check := func(group string, rules []Rule, node *yaml.Node) error {
+		for i := range rules {
+			err := pattern.CheckPlaceholders(&rules[i].Key)
+			if err == nil {
+				err = pattern.PinKey(&rules[i].Key)
+			}
+			if err != nil {
+				var rule *yaml.Node
+				if node != nil && i < len(node.Content) {
+					rule = node.Content[i]
+				}
+				return doc.errorf(rule, "invalid rule of %v: %v", group, err)
+			}
+		}
+		return nil
+	}
 
-	return character, nil
+	root := doc.root()
+	if err := check("director", character.Director, lookup(root, "director")); err != nil {
+		return err
+	}
+	if err := check("master", character.Master, lookup(root, "master")); err != nil {
+		return err
+	}
+	if err := check("operator", character.Operator, lookup(root, "operator")); err != nil {
+		return err
+	}
+
+	actors := lookup(root, "actors")
+	for role, rules := range character.Actors {
+		if err := check("role "+role, rules, lookup(actors, role)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func newCredentials(dir string) ([]Credential, error) {
-	if dir == "" {
-		dir = gimulatorConfigDir
+func newCredentials(dir string) ([]Credential, *document, error) {
+	credentials := []Credential{}
+	doc, err := decode(filepath.Join(dir, gimulatorCredentialsFileName), &credentials)
+	if err != nil {
+		return nil, nil, err
 	}
-	path := filepath.Join(dir, gimulatorCredentialsFileName)
 
-	file, err := os.Open(path)
+	return credentials, doc, nil
+}
+
+// newInitialState loads initial-state.yaml of dir, if there is any.
+func newInitialState(dir string, creds []Credential, credentials *document) ([]InitialMessage, error) {
+	path := filepath.Join(dir, gimulatorInitialStateFileName)
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	messages := []InitialMessage{}
+	doc, err := decode(path, &messages)
 	if err != nil {
 		return nil, err
 	}
 
-	credentials := []Credential{}
-	if err := yaml.NewDecoder(file).Decode(&credentials); err != nil {
+	if err := validateInitialState(messages, doc, creds, credentials); err != nil {
 		return nil, err
 	}
 
-	return credentials, nil
+	return messages, nil
 }
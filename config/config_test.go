@@ -0,0 +1,232 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+const testRules = `
+director:
+- key:
+    type: "board"
+  methods: [get, 1, watch, getHistory]
+actors:
+  red:
+  - key:
+      namespace: "$name"
+    methods: [put]
+`
+
+const testCredentials = `
+- name: director
+  token: director-token
+  character: director
+- name: actor1
+  role: red
+  token: actor1-token
+  character: actor
+`
+
+func writeTestConfig(t *testing.T, rules, credentials string) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, gimulatorRulesFileName), []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, gimulatorCredentialsFileName), []byte(credentials), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestNewConfig(t *testing.T) {
+	conf, err := NewConfig(writeTestConfig(t, testRules, testCredentials))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	methods := conf.Character.Director[0].Methods
+	want := []Method{Method(api.Method_get), Method(api.Method_getAll), Method(api.Method_watch), Method(MethodGetHistory)}
+	if len(methods) != len(want) {
+		t.Fatalf("got methods %v, want %v", methods, want)
+	}
+	for i := range want {
+		if methods[i] != want[i] {
+			t.Errorf("got methods %v, want %v", methods, want)
+		}
+	}
+
+	if conf.Credentials[0].Role != "director" {
+		t.Errorf("got role %q for the director, want director", conf.Credentials[0].Role)
+	}
+}
+
+func TestNewConfigExample(t *testing.T) {
+	if _, err := NewConfig(filepath.Join("..", "example")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewConfigErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		rules       string
+		credentials string
+		want        string
+	}{
+		{
+			name:  "unknown method",
+			rules: strings.Replace(testRules, "watch", "wacth", 1),
+			want:  "rules.yaml:5: unknown method \"wacth\"",
+		},
+		{
+			name:  "unknown field",
+			rules: strings.Replace(testRules, "methods: [put]", "method: [put]", 1),
+			want:  "rules.yaml:10: field method not found",
+		},
+		{
+			name:  "unknown placeholder",
+			rules: strings.Replace(testRules, "$name", "$team", 1),
+			want:  "rules.yaml:8: invalid rule of role red",
+		},
+		{
+			name:        "unknown character",
+			credentials: strings.Replace(testCredentials, "character: actor", "character: actress", 1),
+			want:        "credentials.yaml:8: unknown character \"actress\"",
+		},
+		{
+			name:        "duplicate name",
+			credentials: strings.Replace(testCredentials, "name: actor1", "name: director", 1),
+			want:        "credentials.yaml:5: name \"director\" is already used at line 2",
+		},
+		{
+			name:        "duplicate token",
+			credentials: strings.Replace(testCredentials, "actor1-token", "director-token", 1),
+			want:        "credentials.yaml:7: token of \"actor1\" is already used by \"director\"",
+		},
+		{
+			name:        "empty token",
+			credentials: strings.Replace(testCredentials, "actor1-token", "\"\"", 1),
+			want:        "credentials.yaml:7: token of \"actor1\" can not be empty",
+		},
+		{
+			name:        "role without rules",
+			credentials: strings.Replace(testCredentials, "role: red", "role: blue", 1),
+			want:        "credentials.yaml:6: role \"blue\" of \"actor1\" has no rules",
+		},
+		{
+			name:  "role without credentials",
+			rules: testRules + "  blue: []\n",
+			want:  "rules.yaml:11: role \"blue\" has no credentials",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules, credentials := test.rules, test.credentials
+			if rules == "" {
+				rules = testRules
+			}
+			if credentials == "" {
+				credentials = testCredentials
+			}
+
+			_, err := NewConfig(writeTestConfig(t, rules, credentials))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+const testInitialState = `
+- key:
+    type: cell
+    name: cell-1
+    namespace: board
+  content: x
+  owner: director
+- key:
+    type: cell
+    name: cell-2
+    namespace: board
+  owner: actor1
+`
+
+func writeTestInitialState(t *testing.T, dir, initialState string) {
+	if err := os.WriteFile(filepath.Join(dir, gimulatorInitialStateFileName), []byte(initialState), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewConfigInitialState(t *testing.T) {
+	dir := writeTestConfig(t, testRules, testCredentials)
+	conf, err := NewConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.InitialState) != 0 {
+		t.Errorf("got %d initial messages without initial-state.yaml, want 0", len(conf.InitialState))
+	}
+
+	writeTestInitialState(t, dir, testInitialState)
+	conf, err = NewConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.InitialState) != 2 {
+		t.Fatalf("got %d initial messages, want 2", len(conf.InitialState))
+	}
+	if mes := &conf.InitialState[0]; mes.Key.Name != "cell-1" || mes.Content != "x" || mes.Owner != "director" {
+		t.Errorf("got initial message %+v", mes)
+	}
+}
+
+func TestNewConfigInitialStateErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		initialState string
+		want         string
+	}{
+		{
+			name:         "unknown owner",
+			initialState: strings.Replace(testInitialState, "owner: actor1", "owner: actor9", 1),
+			want:         "initial-state.yaml:12: owner \"actor9\" of a message has no credentials in",
+		},
+		{
+			name:         "duplicate key",
+			initialState: strings.Replace(testInitialState, "cell-2", "cell-1", 1),
+			want:         "initial-state.yaml:9: message with key=",
+		},
+		{
+			name:         "incomplete key",
+			initialState: strings.Replace(testInitialState, "    namespace: board\n  owner: actor1", "  owner: actor1", 1),
+			want:         "initial-state.yaml:9: key of a message has to have a type, a name and a namespace",
+		},
+		{
+			name:         "pattern",
+			initialState: strings.Replace(testInitialState, "cell-2", "cell-*", 1),
+			want:         "initial-state.yaml:9: key of a message can not have patterns",
+		},
+		{
+			name:         "unknown field",
+			initialState: strings.Replace(testInitialState, "content: x", "contents: x", 1),
+			want:         "initial-state.yaml:6: field contents not found",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeTestConfig(t, testRules, testCredentials)
+			writeTestInitialState(t, dir, test.initialState)
+
+			_, err := NewConfig(dir)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Gimulator/Gimulator/pattern"
+	"github.com/Gimulator/protobuf/go/api"
+	"gopkg.in/yaml.v3"
+)
+
+// lineRegex matches the errors of yaml, such as "line 3: field x not found".
+var lineRegex = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// document is a decoded config file. Its nodes are kept so errors which are
+// found after decoding can be reported with their line.
+type document struct {
+	path string
+	node yaml.Node
+}
+
+// decode strictly decodes the yaml file of path into out.
+func decode(path string, out interface{}) (*document, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &document{path: path}
+	if err := yaml.Unmarshal(data, &doc.node); err != nil {
+		return nil, doc.wrap(err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(out); err != nil && !errors.Is(err, io.EOF) {
+		return nil, doc.wrap(err)
+	}
+
+	return doc, nil
+}
+
+// root returns the top level node of the document, or nil if it is empty.
+func (d *document) root() *yaml.Node {
+	if len(d.node.Content) == 0 {
+		return nil
+	}
+	return d.node.Content[0]
+}
+
+func (d *document) errorf(node *yaml.Node, format string, args ...interface{}) error {
+	if node == nil || node.Line == 0 {
+		return fmt.Errorf("%v: %v", d.path, fmt.Sprintf(format, args...))
+	}
+	return fmt.Errorf("%v:%d: %v", d.path, node.Line, fmt.Sprintf(format, args...))
+}
+
+// wrap rewrites the errors of yaml, which look like "line 3: message", to
+// "file:3: message".
+func (d *document) wrap(err error) error {
+	var messages []string
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	} else {
+		messages = []string{err.Error()}
+	}
+
+	for i, msg := range messages {
+		if match := lineRegex.FindStringSubmatch(msg); match != nil {
+			messages[i] = fmt.Sprintf("%v:%v: %v", d.path, match[1], match[2])
+		} else {
+			messages[i] = fmt.Sprintf("%v: %v", d.path, strings.TrimPrefix(msg, "yaml: "))
+		}
+	}
+	return errors.New(strings.Join(messages, "\n"))
+}
+
+// lookup returns the value of key in the mapping node, or nil.
+func lookup(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// at is lookup which falls back to the node itself, for reporting lines.
+func at(node *yaml.Node, key string) *yaml.Node {
+	if value := lookup(node, key); value != nil {
+		return value
+	}
+	return node
+}
+
+func (m *Method) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		if n, err := strconv.ParseInt(value.Value, 10, 32); err == nil {
+			if _, ok := methodNames[int32(n)]; ok {
+				*m = Method(n)
+				return nil
+			}
+		} else {
+			for n, name := range methodNames {
+				if name == value.Value {
+					*m = Method(n)
+					return nil
+				}
+			}
+		}
+	}
+
+	return fmt.Errorf("line %d: unknown method %q, choices are: %v", value.Line, value.Value, choices(methodNames))
+}
+
+// choices lists the names of an enum in the order of their numbers.
+func choices(names map[int32]string) string {
+	numbers := make([]int, 0, len(names))
+	for n := range names {
+		numbers = append(numbers, int(n))
+	}
+	sort.Ints(numbers)
+
+	list := make([]string, 0, len(numbers))
+	for _, n := range numbers {
+		list = append(list, fmt.Sprintf("%v (%d)", names[int32(n)], n))
+	}
+	return strings.Join(list, ", ")
+}
+
+// validate checks the credentials against each other and against the rules:
+// names and tokens have to be unique and not empty, characters have to be
+// known, every actor has to have a role with rules and every role has to have
+// an actor. The role of the other characters is their character, and it is
+// filled in if it is empty.
+func validate(character Character, rules *document, creds []Credential, credentials *document) error {
+	items := credentials.root()
+	item := func(i int) *yaml.Node {
+		if items == nil || i >= len(items.Content) {
+			return nil
+		}
+		return items.Content[i]
+	}
+
+	names := make(map[string]int)
+	tokens := make(map[string]string)
+	roles := make(map[string]bool)
+	for i := range creds {
+		cred, node := &creds[i], item(i)
+
+		if cred.Name == "" {
+			return credentials.errorf(node, "name of a credential can not be empty")
+		}
+		if line, ok := names[cred.Name]; ok {
+			return credentials.errorf(at(node, "name"), "name %q is already used at line %d", cred.Name, line)
+		}
+		names[cred.Name] = at(node, "name").Line
+
+		if cred.Token == "" {
+			return credentials.errorf(at(node, "token"), "token of %q can not be empty", cred.Name)
+		}
+		if name, ok := tokens[cred.Token]; ok {
+			return credentials.errorf(at(node, "token"), "token of %q is already used by %q", cred.Name, name)
+		}
+		tokens[cred.Token] = cred.Name
+
+		c, ok := api.Character_value[cred.Character]
+		if !ok {
+			return credentials.errorf(at(node, "character"), "unknown character %q of %q, choices are: %v", cred.Character, cred.Name, choices(api.Character_name))
+		}
+
+		if api.Character(c) == api.Character_actor {
+			if _, ok := character.Actors[cred.Role]; !ok {
+				return credentials.errorf(at(node, "role"), "role %q of %q has no rules in %v", cred.Role, cred.Name, rules.path)
+			}
+			roles[cred.Role] = true
+			continue
+		}
+
+		switch cred.Role {
+		case "":
+			cred.Role = cred.Character
+		case cred.Character:
+		default:
+			return credentials.errorf(at(node, "role"), "role of %q has to be %q or empty, since it is a %v", cred.Name, cred.Character, cred.Character)
+		}
+	}
+
+	actors := lookup(rules.root(), "actors")
+	if actors == nil {
+		return nil
+	}
+	for i := 0; i < len(actors.Content); i += 2 {
+		if role := actors.Content[i]; !roles[role.Value] {
+			return rules.errorf(role, "role %q has no credentials in %v", role.Value, credentials.path)
+		}
+	}
+
+	return nil
+}
+
+// validateInitialState checks that the keys of the messages are complete,
+// have no patterns and are unique, and that their owners have credentials.
+func validateInitialState(messages []InitialMessage, doc *document, creds []Credential, credentials *document) error {
+	items := doc.root()
+	item := func(i int) *yaml.Node {
+		if items == nil || i >= len(items.Content) {
+			return nil
+		}
+		return items.Content[i]
+	}
+
+	owners := make(map[string]bool)
+	for _, cred := range creds {
+		owners[cred.Name] = true
+	}
+
+	keys := make(map[[3]string]int)
+	for i := range messages {
+		mes, node := &messages[i], item(i)
+		key := &mes.Key
+
+		if key.Type == "" || key.Name == "" || key.Namespace == "" {
+			return doc.errorf(at(node, "key"), "key of a message has to have a type, a name and a namespace")
+		}
+		if pattern.HasPattern(key) {
+			return doc.errorf(at(node, "key"), "key of a message can not have patterns")
+		}
+		id := [3]string{key.Type, key.Name, key.Namespace}
+		if line, ok := keys[id]; ok {
+			return doc.errorf(at(node, "key"), "message with key=%v is already at line %d", key, line)
+		}
+		keys[id] = at(node, "key").Line
+
+		if !owners[mes.Owner] {
+			return doc.errorf(at(node, "owner"), "owner %q of a message has no credentials in %v", mes.Owner, credentials.path)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+package epilogues
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Gimulator/protobuf/go/api"
+	"github.com/sirupsen/logrus"
+)
+
+// Policy decides when a composite epilogue has delivered the result.
+type Policy string
+
+const (
+	// PolicyAll needs every target to receive the result.
+	PolicyAll Policy = "all"
+	// PolicyBestEffort needs at least one target to receive the result; the
+	// failures of the others are only logged.
+	PolicyBestEffort Policy = "best-effort"
+)
+
+const (
+	DefaultRetries = 3
+	DefaultBackoff = 5 * time.Second
+
+	maxBackoff = time.Minute
+)
+
+func ParsePolicy(str string) (Policy, error) {
+	switch p := Policy(str); p {
+	case PolicyAll, PolicyBestEffort:
+		return p, nil
+	case "":
+		return PolicyAll, nil
+	default:
+		return "", fmt.Errorf("invalid epilogue policy %q, choices are: %v, %v", str, PolicyAll, PolicyBestEffort)
+	}
+}
+
+// Target is an epilogue of a composite epilogue. A failed write is tried
+// again up to Retries times, waiting Backoff before the first retry and twice
+// as long before every next one, unless its error is permanent.
+type Target struct {
+	Name     string
+	Epilogue Epilogue
+	Retries  int
+	Backoff  time.Duration
+}
+
+// NewTarget returns a target with the default retries and backoff of the
+// epilogue.
+func NewTarget(name string, epilogue Epilogue) *Target {
+	target := &Target{
+		Name:     name,
+		Epilogue: epilogue,
+		Retries:  DefaultRetries,
+		Backoff:  DefaultBackoff,
+	}
+	if _, ok := epilogue.(*Webhook); ok {
+		// The webhook posts only once, so the composite is what retries it.
+		target.Backoff = DefaultWebhookBackoff
+	}
+	return target
+}
+
+// Composite writes the result to all of its targets, one after the other.
+type Composite struct {
+	targets []*Target
+	policy  Policy
+	log     *logrus.Entry
+}
+
+func NewComposite(policy Policy, targets ...*Target) (*Composite, error) {
+	if policy != PolicyAll && policy != PolicyBestEffort {
+		return nil, fmt.Errorf("invalid epilogue policy %q, choices are: %v, %v", policy, PolicyAll, PolicyBestEffort)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("invalid composite epilogue, it has no targets")
+	}
+
+	names := make(map[string]bool)
+	for _, target := range targets {
+		if names[target.Name] {
+			return nil, fmt.Errorf("invalid composite epilogue, %q is given twice", target.Name)
+		}
+		names[target.Name] = true
+
+		if target.Retries < 0 || target.Backoff < 0 {
+			return nil, fmt.Errorf("invalid composite epilogue, the retries and backoff of %q should not be negative", target.Name)
+		}
+	}
+
+	return &Composite{
+		targets: targets,
+		policy:  policy,
+		log:     logrus.WithField("component", "composite").WithField("policy", policy),
+	}, nil
+}
+
+func (c *Composite) Test() error {
+	var failed []string
+	for _, target := range c.targets {
+		if err := target.Epilogue.Test(); err != nil {
+			c.log.WithField("target", target.Name).WithError(err).Error("could not test target")
+			failed = append(failed, fmt.Sprintf("%v: %v", target.Name, err))
+		}
+	}
+	return c.result(failed)
+}
+
+// Write writes the result to every target, even if an earlier one fails. The
+// error names the targets which failed.
+func (c *Composite) Write(result *api.Result) error {
+	c.log.Info("starting to send result")
+
+	var failed []string
+	for _, target := range c.targets {
+		if err := c.write(target, result); err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", target.Name, err))
+		}
+	}
+	return c.result(failed)
+}
+
+func (c *Composite) write(target *Target, result *api.Result) error {
+	log := c.log.WithField("target", target.Name)
+
+	backoff := target.Backoff
+	for attempt := 0; ; attempt++ {
+		log := log.WithField("attempt", attempt+1)
+
+		log.Info("starting to write result into target")
+		err := target.Epilogue.Write(result)
+		if err == nil {
+			return nil
+		}
+		if attempt >= target.Retries || isPermanent(err) {
+			log.WithError(err).Error("could not write result into target, giving up")
+			return err
+		}
+
+		log.WithError(err).WithField("backoff", backoff).Warn("could not write result into target, retrying")
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// permanentError is an error of an epilogue which retrying would not fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as an error which retrying would not fix, so a composite
+// epilogue gives up on it right away.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+// result returns the error of the failed targets under the policy.
+func (c *Composite) result(failed []string) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	if c.policy == PolicyBestEffort && len(failed) < len(c.targets) {
+		c.log.WithField("failed", failed).Warn("some targets failed, ignoring them")
+		return nil
+	}
+	return fmt.Errorf("could not write result into %v of %v epilogues: %v", len(failed), len(c.targets), strings.Join(failed, "; "))
+}
+
+// ParseRetries parses the retries of targets written as "name=retries,...".
+func ParseRetries(str string) (map[string]int, error) {
+	retries := make(map[string]int)
+	err := parseTargetSettings(str, "retries", func(name, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%q is not a non-negative number", value)
+		}
+		retries[name] = n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return retries, nil
+}
+
+// ParseBackoffs parses the backoffs of targets written as "name=duration,...",
+// e.g. "webhook=2s".
+func ParseBackoffs(str string) (map[string]time.Duration, error) {
+	backoffs := make(map[string]time.Duration)
+	err := parseTargetSettings(str, "backoff", func(name, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("%q is not a non-negative duration", value)
+		}
+		backoffs[name] = d
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return backoffs, nil
+}
+
+func parseTargetSettings(str, setting string, set func(name, value string) error) error {
+	if str == "" {
+		return nil
+	}
+
+	for _, pair := range strings.Split(str, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid epilogue %v %q, it should look like epilogue=%v", setting, pair, setting)
+		}
+		if err := set(parts[0], parts[1]); err != nil {
+			return fmt.Errorf("invalid epilogue %v %q, %v", setting, pair, err)
+		}
+	}
+	return nil
+}
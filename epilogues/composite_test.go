@@ -0,0 +1,207 @@
+package epilogues
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+// fakeEpilogue fails its first failures writes.
+type fakeEpilogue struct {
+	failures int
+	writes   int
+	results  []*api.Result
+}
+
+func (f *fakeEpilogue) Test() error {
+	if f.failures > 0 {
+		return errors.New("not reachable")
+	}
+	return nil
+}
+
+func (f *fakeEpilogue) Write(result *api.Result) error {
+	f.writes++
+	if f.writes <= f.failures {
+		return errors.New("not reachable")
+	}
+	f.results = append(f.results, result)
+	return nil
+}
+
+func TestCompositeWrite(t *testing.T) {
+	console, file := &fakeEpilogue{}, &fakeEpilogue{failures: 2}
+	c, err := NewComposite(PolicyAll,
+		&Target{Name: "console", Epilogue: console},
+		&Target{Name: "file", Epilogue: file, Retries: 2, Backoff: time.Millisecond},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := &api.Result{Id: "room-1"}
+	if err := c.Write(result); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if len(console.results) != 1 || console.results[0] != result {
+		t.Errorf("console got %v, want the result", console.results)
+	}
+	if file.writes != 3 || len(file.results) != 1 {
+		t.Errorf("file was written %v times and got %v results, want 3 writes and 1 result", file.writes, len(file.results))
+	}
+}
+
+func TestCompositeWriteFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		failing []int // failures of console, file and webhook
+		wantErr []string
+	}{
+		{name: "all, one fails", policy: PolicyAll, failing: []int{0, 5, 0}, wantErr: []string{"1 of 3", "file: not reachable"}},
+		{name: "all, two fail", policy: PolicyAll, failing: []int{5, 0, 5}, wantErr: []string{"2 of 3", "console: not reachable", "webhook: not reachable"}},
+		{name: "best-effort, two fail", policy: PolicyBestEffort, failing: []int{5, 5, 0}},
+		{name: "best-effort, all fail", policy: PolicyBestEffort, failing: []int{5, 5, 5}, wantErr: []string{"3 of 3", "console", "file", "webhook"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var targets []*Target
+			var fakes []*fakeEpilogue
+			for i, name := range []string{"console", "file", "webhook"} {
+				fake := &fakeEpilogue{failures: tt.failing[i]}
+				fakes = append(fakes, fake)
+				targets = append(targets, &Target{Name: name, Epilogue: fake, Retries: 1, Backoff: time.Millisecond})
+			}
+			c, err := NewComposite(tt.policy, targets...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = c.Write(&api.Result{Id: "room-1"})
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("Write: %v, want no error", err)
+				}
+			} else if err == nil {
+				t.Errorf("Write succeeded, want an error")
+			} else {
+				for _, want := range tt.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error %q does not contain %q", err, want)
+					}
+				}
+			}
+
+			for i, fake := range fakes {
+				want := 1
+				if tt.failing[i] > 0 {
+					want = 2
+				}
+				if fake.writes != want {
+					t.Errorf("%v was written %v times, want %v", targets[i].Name, fake.writes, want)
+				}
+			}
+		})
+	}
+}
+
+// rejectingEpilogue fails every write with a permanent error.
+type rejectingEpilogue struct {
+	writes int
+}
+
+func (r *rejectingEpilogue) Test() error { return nil }
+
+func (r *rejectingEpilogue) Write(result *api.Result) error {
+	r.writes++
+	return Permanent(errors.New("rejected"))
+}
+
+func TestCompositeDoesNotRetryPermanentErrors(t *testing.T) {
+	rejecting := &rejectingEpilogue{}
+	c, err := NewComposite(PolicyAll, &Target{Name: "webhook", Epilogue: rejecting, Retries: 3, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Write(&api.Result{Id: "room-1"}); err == nil || !strings.Contains(err.Error(), "webhook: rejected") {
+		t.Errorf("Write = %v, want an error naming the webhook", err)
+	}
+	if rejecting.writes != 1 {
+		t.Errorf("webhook was written %v times, want 1", rejecting.writes)
+	}
+}
+
+func TestCompositeTest(t *testing.T) {
+	c, err := NewComposite(PolicyAll,
+		&Target{Name: "console", Epilogue: &fakeEpilogue{}},
+		&Target{Name: "rabbitmq", Epilogue: &fakeEpilogue{failures: 1}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Test(); err == nil || !strings.Contains(err.Error(), "rabbitmq") {
+		t.Errorf("Test = %v, want an error naming rabbitmq", err)
+	}
+}
+
+func TestNewCompositeErrors(t *testing.T) {
+	fake := &fakeEpilogue{}
+	tests := []struct {
+		name    string
+		policy  Policy
+		targets []*Target
+	}{
+		{name: "invalid policy", policy: "some", targets: []*Target{{Name: "console", Epilogue: fake}}},
+		{name: "no targets", policy: PolicyAll},
+		{name: "duplicate", policy: PolicyAll, targets: []*Target{{Name: "console", Epilogue: fake}, {Name: "console", Epilogue: fake}}},
+		{name: "negative retries", policy: PolicyAll, targets: []*Target{{Name: "console", Epilogue: fake, Retries: -1}}},
+		{name: "negative backoff", policy: PolicyAll, targets: []*Target{{Name: "console", Epilogue: fake, Backoff: -time.Second}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewComposite(tt.policy, tt.targets...); err == nil {
+				t.Error("NewComposite succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestParseTargetSettings(t *testing.T) {
+	retries, err := ParseRetries("webhook=5, file=0")
+	if err != nil {
+		t.Fatalf("ParseRetries: %v", err)
+	}
+	if len(retries) != 2 || retries["webhook"] != 5 || retries["file"] != 0 {
+		t.Errorf("retries = %v", retries)
+	}
+
+	backoffs, err := ParseBackoffs("rabbitmq=2s")
+	if err != nil {
+		t.Fatalf("ParseBackoffs: %v", err)
+	}
+	if len(backoffs) != 1 || backoffs["rabbitmq"] != 2*time.Second {
+		t.Errorf("backoffs = %v", backoffs)
+	}
+
+	for _, str := range []string{"webhook", "=5", "webhook=-1", "webhook=many"} {
+		if _, err := ParseRetries(str); err == nil {
+			t.Errorf("ParseRetries(%q) succeeded, want an error", str)
+		}
+	}
+	for _, str := range []string{"webhook=2", "webhook=-2s"} {
+		if _, err := ParseBackoffs(str); err == nil {
+			t.Errorf("ParseBackoffs(%q) succeeded, want an error", str)
+		}
+	}
+
+	if policy, err := ParsePolicy(""); err != nil || policy != PolicyAll {
+		t.Errorf("ParsePolicy(\"\") = %v, %v, want %v", policy, err, PolicyAll)
+	}
+	if _, err := ParsePolicy("some"); err == nil {
+		t.Error("ParsePolicy(\"some\") succeeded, want an error")
+	}
+}
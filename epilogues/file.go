@@ -0,0 +1,120 @@
+package epilogues
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/Gimulator/Gimulator/simulator"
+	"github.com/Gimulator/Gimulator/snapshot"
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+	"github.com/sirupsen/logrus"
+)
+
+// File writes the result as JSON to a file, and the final state to another
+// one if it has a snapshot path. Every file is written to a temporary file
+// first and then renamed, so a reader never sees half of it. The snapshot is
+// written before the result, so once the result is there, the snapshot is too.
+type File struct {
+	path         string
+	snapshotPath string
+	sim          *simulator.Simulator
+	users        storage.UserStorage
+	log          *logrus.Entry
+}
+
+// NewFile returns a file epilogue which writes the result to path. If
+// snapshotPath is not empty, the final state of sim and users is written to
+// it as well, in the format of the snapshot package.
+func NewFile(path, snapshotPath string, sim *simulator.Simulator, users storage.UserStorage) (*File, error) {
+	if path == "" {
+		return nil, errors.New("invalid file epilogue, the path of the result is empty")
+	}
+	if snapshotPath != "" && (sim == nil || users == nil) {
+		return nil, errors.New("invalid file epilogue, a snapshot needs a simulator and a user storage")
+	}
+
+	return &File{
+		path:         path,
+		snapshotPath: snapshotPath,
+		sim:          sim,
+		users:        users,
+		log:          logrus.WithField("component", "file").WithField("path", path),
+	}, nil
+}
+
+func (f *File) Test() error {
+	return nil
+}
+
+func (f *File) Write(result *api.Result) error {
+	f.log.Info("starting to write result")
+
+	if f.snapshotPath != "" {
+		log := f.log.WithField("snapshot-path", f.snapshotPath)
+
+		log.Info("starting to take snapshot")
+		snap, err := snapshot.Take(f.sim, f.users)
+		if err != nil {
+			log.WithError(err).Error("could not take snapshot")
+			return err
+		}
+
+		data, err := snap.Marshal(f.snapshotPath)
+		if err != nil {
+			log.WithError(err).Error("could not marshal snapshot")
+			return err
+		}
+
+		log.Info("starting to write snapshot")
+		if err := writeFileAtomic(f.snapshotPath, data); err != nil {
+			log.WithError(err).Error("could not write snapshot")
+			return err
+		}
+	}
+
+	f.log.Info("starting to marshal result")
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		f.log.WithError(err).Error("could not marshal result")
+		return err
+	}
+
+	if err := writeFileAtomic(f.path, data); err != nil {
+		f.log.WithError(err).Error("could not write result")
+		return err
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// to path, so path holds either its old content or all of data.
+func writeFileAtomic(path string, data []byte) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(0o644); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
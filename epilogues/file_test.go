@@ -0,0 +1,151 @@
+package epilogues
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Gimulator/Gimulator/config"
+	"github.com/Gimulator/Gimulator/simulator"
+	"github.com/Gimulator/Gimulator/snapshot"
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+func readResult(t *testing.T, path string) *api.Result {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &api.Result{}
+	if err := json.Unmarshal(data, result); err != nil {
+		t.Fatalf("could not unmarshal %q: %v", data, err)
+	}
+	return result
+}
+
+// checkNoTempFiles fails unless dir holds want files, so no temporary file is
+// left behind.
+func checkNoTempFiles(t *testing.T, dir string, want int) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != want {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("files in %v = %v, want %v files", dir, names, want)
+	}
+}
+
+func TestFileWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "result.json")
+
+	f, err := NewFile(path, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Write(&api.Result{Id: "room-1", Msg: "first"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := readResult(t, path); got.Id != "room-1" || got.Msg != "first" {
+		t.Errorf("result = %+v", got)
+	}
+
+	if err := f.Write(&api.Result{Id: "room-1", Msg: "second"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := readResult(t, path); got.Msg != "second" {
+		t.Errorf("result = %+v, want the second one", got)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o644 {
+		t.Errorf("mode = %v, want 0644", info.Mode().Perm())
+	}
+	checkNoTempFiles(t, dir, 1)
+}
+
+func TestFileWriteSnapshot(t *testing.T) {
+	conf := &config.Config{
+		Credentials: []config.Credential{
+			{Name: "director", Token: "director-token", Character: "director", Role: "director"},
+			{Name: "actor1", Token: "actor1-token", Character: "actor", Role: "red"},
+		},
+	}
+	strg, err := storage.NewMemoryWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim, err := simulator.NewSimulator(strg, simulator.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sim.Put(&api.Message{
+		Key:     &api.Key{Type: "cell", Name: "cell-1", Namespace: "board"},
+		Meta:    &api.Meta{Owner: &api.User{Name: "actor1"}},
+		Content: "x",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"state.json", "state.yaml"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "result.json")
+			snapshotPath := filepath.Join(dir, name)
+
+			f, err := NewFile(path, snapshotPath, sim, strg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Write(&api.Result{Id: "room-1"}); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+
+			if got := readResult(t, path); got.Id != "room-1" {
+				t.Errorf("result = %+v", got)
+			}
+			snap, err := snapshot.ReadFile(snapshotPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snap.Revision != 1 || len(snap.Messages) != 1 || snap.Messages[0].Content != "x" {
+				t.Errorf("snapshot = %+v", snap)
+			}
+			if len(snap.Users) != 2 {
+				t.Errorf("snapshot has %v users, want 2", len(snap.Users))
+			}
+			checkNoTempFiles(t, dir, 2)
+		})
+	}
+}
+
+func TestFileWriteErrors(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFile(filepath.Join(dir, "missing", "result.json"), "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Write(&api.Result{Id: "room-1"}); err == nil {
+		t.Error("Write succeeded into a missing directory, want an error")
+	}
+	checkNoTempFiles(t, dir, 0)
+
+	if _, err := NewFile("", "", nil, nil); err == nil {
+		t.Error("NewFile succeeded without a path, want an error")
+	}
+	if _, err := NewFile("result.json", "state.json", nil, nil); err == nil {
+		t.Error("NewFile succeeded with a snapshot path but no simulator, want an error")
+	}
+}
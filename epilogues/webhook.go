@@ -0,0 +1,149 @@
+package epilogues
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Gimulator/protobuf/go/api"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of the body, as "sha256=<hex>",
+	// if the webhook has a secret.
+	SignatureHeader = "X-Gimulator-Signature"
+
+	// DefaultWebhookBackoff is the backoff of a webhook in a composite
+	// epilogue, unless another one is given.
+	DefaultWebhookBackoff = time.Second
+)
+
+// Webhook POSTs the result as JSON to a URL, once. A composite epilogue retries
+// it, but not after a response with a 4xx status other than 408 and 429, which
+// is a permanent error, since sending the same body again would not help.
+type Webhook struct {
+	url     string
+	headers map[string]string
+	secret  []byte
+	client  *http.Client
+	log     *logrus.Entry
+}
+
+// NewWebhook returns a webhook which sends the result to rawURL with the
+// headers. If secret is not empty, the body is signed with it. Every request
+// is given up after timeout.
+func NewWebhook(rawURL string, headers map[string]string, secret string, timeout time.Duration) (*Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url %q, it should be an http or https url", rawURL)
+	}
+	if timeout < 0 {
+		return nil, fmt.Errorf("invalid webhook timeout %v, it should not be negative", timeout)
+	}
+
+	return &Webhook{
+		url:     rawURL,
+		headers: headers,
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: timeout},
+		log:     logrus.WithField("component", "webhook").WithField("url", u.Redacted()),
+	}, nil
+}
+
+// ParseHeaders parses headers written as "name=value,name=value".
+func ParseHeaders(str string) (map[string]string, error) {
+	headers := make(map[string]string)
+	if str == "" {
+		return headers, nil
+	}
+
+	for _, pair := range strings.Split(str, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid webhook header %q, it should look like name=value", pair)
+		}
+		headers[http.CanonicalHeaderKey(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+	}
+
+	return headers, nil
+}
+
+func (w *Webhook) Test() error {
+	return nil
+}
+
+func (w *Webhook) Write(result *api.Result) error {
+	w.log.Info("starting to send result")
+
+	w.log.Info("starting to marshal result")
+	body, err := json.Marshal(result)
+	if err != nil {
+		w.log.WithError(err).Error("could not marshal result")
+		return Permanent(err)
+	}
+
+	w.log.Info("starting to post result")
+	if err := w.post(body); err != nil {
+		w.log.WithError(err).Error("could not post result")
+		return err
+	}
+	return nil
+}
+
+// post sends the body once. A failure which is not worth retrying is
+// permanent.
+func (w *Webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	for name, value := range w.headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(w.secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	err = fmt.Errorf("webhook responded with %v", resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return err
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return Permanent(err)
+	default:
+		return err
+	}
+}
+
+// Sign returns the signature of the body with the secret, as it is sent in
+// SignatureHeader, so the receiver can check it.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,234 @@
+package epilogues
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+func newTestWebhook(t *testing.T, url string, headers map[string]string, secret string) *Webhook {
+	t.Helper()
+	w, err := NewWebhook(url, headers, secret, time.Second)
+	if err != nil {
+		t.Fatalf("could not create webhook: %v", err)
+	}
+	return w
+}
+
+// retried wraps the webhook in a composite epilogue, which retries it.
+func retried(t *testing.T, w *Webhook, retries int) *Composite {
+	t.Helper()
+	c, err := NewComposite(PolicyAll, &Target{Name: "webhook", Epilogue: w, Retries: retries, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("could not create composite: %v", err)
+	}
+	return c
+}
+
+func TestWebhookWrite(t *testing.T) {
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %v, want POST", r.Method)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{header: r.Header, body: body}
+	}))
+	defer server.Close()
+
+	w := newTestWebhook(t, server.URL, map[string]string{"Authorization": "Bearer abc"}, "secret")
+	result := &api.Result{Id: "room-1", Msg: "done"}
+	if err := w.Write(result); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	req := <-requests
+	if got := req.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if got := req.header.Get("Authorization"); got != "Bearer abc" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer abc")
+	}
+	if got, want := req.header.Get(SignatureHeader), Sign([]byte("secret"), req.body); got != want {
+		t.Errorf("%v = %q, want %q", SignatureHeader, got, want)
+	}
+
+	got := &api.Result{}
+	if err := json.Unmarshal(req.body, got); err != nil {
+		t.Fatalf("could not unmarshal body %q: %v", req.body, err)
+	}
+	if got.Id != result.Id || got.Msg != result.Msg {
+		t.Errorf("body = %+v, want %+v", got, result)
+	}
+}
+
+func TestWebhookWriteWithoutSecret(t *testing.T) {
+	var signature atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		signature.Store(r.Header.Get(SignatureHeader))
+	}))
+	defer server.Close()
+
+	w := newTestWebhook(t, server.URL, nil, "")
+	if err := w.Write(&api.Result{Id: "room-1"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := signature.Load(); got != "" {
+		t.Errorf("%v = %q, want none", SignatureHeader, got)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	c := retried(t, newTestWebhook(t, server.URL, nil, ""), 3)
+	if err := c.Write(&api.Result{Id: "room-1"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("calls = %v, want 3", got)
+	}
+}
+
+func TestWebhookTargetIsRetried(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	// The target is made the way the gimulator command makes it, only with a
+	// shorter backoff, like --epilogue-backoff=webhook=1ms would set.
+	target := NewTarget("webhook", newTestWebhook(t, server.URL, nil, ""))
+	if target.Retries != DefaultRetries || target.Backoff != DefaultWebhookBackoff {
+		t.Errorf("got %d retries after %v, want %d after %v", target.Retries, target.Backoff, DefaultRetries, DefaultWebhookBackoff)
+	}
+	target.Backoff = time.Millisecond
+
+	c, err := NewComposite(PolicyAll, target)
+	if err != nil {
+		t.Fatalf("could not create composite: %v", err)
+	}
+	if err := c.Write(&api.Result{Id: "room-1"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("calls = %v, want 3", got)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	c := retried(t, newTestWebhook(t, server.URL, nil, ""), 2)
+	if err := c.Write(&api.Result{Id: "room-1"}); err == nil {
+		t.Fatal("Write succeeded, want an error")
+	}
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("calls = %v, want 3", got)
+	}
+}
+
+func TestWebhookDoesNotRetryClientErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		rw.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	c := retried(t, newTestWebhook(t, server.URL, nil, ""), 3)
+	if err := c.Write(&api.Result{Id: "room-1"}); err == nil {
+		t.Fatal("Write succeeded, want an error")
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("calls = %v, want 1", got)
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	var calls int32
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+			}
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	w := newTestWebhook(t, server.URL, nil, "")
+	w.client.Timeout = 50 * time.Millisecond
+	if err := retried(t, w, 1).Write(&api.Result{Id: "room-1"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("calls = %v, want 2", got)
+	}
+}
+
+func TestNewWebhookErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		timeout time.Duration
+	}{
+		{name: "no scheme", url: "example.com/hook"},
+		{name: "wrong scheme", url: "ftp://example.com/hook"},
+		{name: "no host", url: "http:///hook"},
+		{name: "negative timeout", url: "http://example.com", timeout: -time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewWebhook(tt.url, nil, "", tt.timeout); err == nil {
+				t.Error("NewWebhook succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	headers, err := ParseHeaders("authorization=Bearer abc, x-room = room-1")
+	if err != nil {
+		t.Fatalf("ParseHeaders: %v", err)
+	}
+	if len(headers) != 2 || headers["Authorization"] != "Bearer abc" || headers["X-Room"] != "room-1" {
+		t.Errorf("headers = %v", headers)
+	}
+
+	if headers, err := ParseHeaders(""); err != nil || len(headers) != 0 {
+		t.Errorf("ParseHeaders(\"\") = %v, %v, want no headers", headers, err)
+	}
+	if _, err := ParseHeaders("authorization"); err == nil {
+		t.Error("ParseHeaders succeeded without a value, want an error")
+	}
+	if _, err := ParseHeaders("=abc"); err == nil {
+		t.Error("ParseHeaders succeeded without a name, want an error")
+	}
+}
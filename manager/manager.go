@@ -3,9 +3,12 @@ package manager
 import (
 	"fmt"
 	"os"
+	"sync"
 
 	"github.com/Gimulator/Gimulator/cmd"
+	"github.com/Gimulator/Gimulator/config"
 	"github.com/Gimulator/Gimulator/epilogues"
+	"github.com/Gimulator/Gimulator/pattern"
 	"github.com/Gimulator/Gimulator/storage"
 	"github.com/Gimulator/protobuf/go/api"
 	"google.golang.org/grpc/codes"
@@ -17,6 +20,21 @@ type Manager struct {
 	ruleStorage storage.RuleStorage
 
 	Epilogue epilogues.Epilogue
+	// Recorder is told about the changes of users and the result, if it is
+	// not nil.
+	Recorder Recorder
+
+	reloadMux    sync.Mutex
+	reloadStatus ReloadStatus
+	onReload     []func()
+}
+
+// Recorder is told about the changes of the status and readiness of users and
+// about the result of the match.
+type Recorder interface {
+	RecordStatus(name string, status api.Status)
+	RecordReadiness(name string, readiness bool)
+	RecordResult(result *api.Result)
 }
 
 func NewManager(credStorage storage.UserStorage, roleStorage storage.RuleStorage, epilogue epilogues.Epilogue) (*Manager, error) {
@@ -37,6 +55,9 @@ func (m *Manager) Authenticate(token string) (*api.User, error) {
 
 func (m *Manager) UpdateStatus(name string, status api.Status) error {
 	err := m.userStorage.UpdateUserStatus(name, status)
+	if err == nil && m.Recorder != nil {
+		m.Recorder.RecordStatus(name, status)
+	}
 
 	// Checking if director has failed
 	if status == api.Status_failed {
@@ -53,6 +74,7 @@ func (m *Manager) UpdateStatus(name string, status api.Status) error {
 				Msg:    "Director Failed.",
 				Status: api.Result_failed,
 			}
+			m.RecordResult(&result)
 			err3 := m.Epilogue.Write(&result)
 			if err3 != nil {
 				return err3
@@ -66,7 +88,26 @@ func (m *Manager) UpdateStatus(name string, status api.Status) error {
 }
 
 func (m *Manager) UpdateReadiness(name string, readiness bool) error {
-	return m.userStorage.UpdateUserReadiness(name, readiness)
+	if err := m.userStorage.UpdateUserReadiness(name, readiness); err != nil {
+		return err
+	}
+	if m.Recorder != nil {
+		m.Recorder.RecordReadiness(name, readiness)
+	}
+	return nil
+}
+
+// RecordResult tells the recorder about the result of the match, if there is
+// a recorder.
+func (m *Manager) RecordResult(result *api.Result) {
+	if m.Recorder != nil {
+		m.Recorder.RecordResult(result)
+	}
+}
+
+// UserStorage returns the storage of the users.
+func (m *Manager) UserStorage() storage.UserStorage {
+	return m.userStorage
 }
 
 func (m *Manager) GetUserWithName(id string) (*api.User, error) {
@@ -87,15 +128,12 @@ func (m *Manager) AuthorizeGetMethod(user *api.User, key *api.Key) error {
 		return err
 	}
 
-	keys, err := m.ruleStorage.GetRules(user.Character, user.Role, api.Method_get)
+	allowed, err := m.authorize(user, api.Method_get, key)
 	if err != nil {
 		return err
 	}
-
-	for _, base := range keys {
-		if m.match(base, key) {
-			return nil
-		}
+	if allowed {
+		return nil
 	}
 
 	return status.Error(codes.PermissionDenied, fmt.Sprintf("invalid action: you don't have permission to get a message with key=%v", key))
@@ -106,15 +144,12 @@ func (m *Manager) AuthorizeGetAllMethod(user *api.User, key *api.Key) error {
 		return err
 	}
 
-	keys, err := m.ruleStorage.GetRules(user.Character, user.Role, api.Method_getAll)
+	allowed, err := m.authorize(user, api.Method_getAll, key)
 	if err != nil {
 		return err
 	}
-
-	for _, base := range keys {
-		if m.match(base, key) {
-			return nil
-		}
+	if allowed {
+		return nil
 	}
 
 	return status.Error(codes.PermissionDenied, fmt.Sprintf("invalid action: you don't have permission to get all messages with key=%v", key))
@@ -129,15 +164,12 @@ func (m *Manager) AuthorizePutMethod(user *api.User, key *api.Key) error {
 		return err
 	}
 
-	keys, err := m.ruleStorage.GetRules(user.Character, user.Role, api.Method_put)
+	allowed, err := m.authorize(user, api.Method_put, key)
 	if err != nil {
 		return err
 	}
-
-	for _, base := range keys {
-		if m.match(base, key) {
-			return nil
-		}
+	if allowed {
+		return nil
 	}
 
 	return status.Error(codes.PermissionDenied, fmt.Sprintf("invalid action: you don't have permission to put a message with key=%v", key))
@@ -152,15 +184,12 @@ func (m *Manager) AuthorizeDeleteMethod(user *api.User, key *api.Key) error {
 		return err
 	}
 
-	keys, err := m.ruleStorage.GetRules(user.Character, user.Role, api.Method_delete)
+	allowed, err := m.authorize(user, api.Method_delete, key)
 	if err != nil {
 		return err
 	}
-
-	for _, base := range keys {
-		if m.match(base, key) {
-			return nil
-		}
+	if allowed {
+		return nil
 	}
 
 	return status.Error(codes.PermissionDenied, fmt.Sprintf("invalid action: you don't have permission to delete a message with key=%v", key))
@@ -171,15 +200,12 @@ func (m *Manager) AuthorizeDeleteAllMethod(user *api.User, key *api.Key) error {
 		return err
 	}
 
-	keys, err := m.ruleStorage.GetRules(user.Character, user.Role, api.Method_deleteAll)
+	allowed, err := m.authorize(user, api.Method_deleteAll, key)
 	if err != nil {
 		return err
 	}
-
-	for _, base := range keys {
-		if m.match(base, key) {
-			return nil
-		}
+	if allowed {
+		return nil
 	}
 
 	return status.Error(codes.PermissionDenied, fmt.Sprintf("invalid action: you don't have permission to delete all messages with key=%v", key))
@@ -190,27 +216,41 @@ func (m *Manager) AuthorizeWatchMethod(user *api.User, key *api.Key) error {
 		return err
 	}
 
-	keys, err := m.ruleStorage.GetRules(user.Character, user.Role, api.Method_watch)
+	allowed, err := m.authorize(user, api.Method_watch, key)
 	if err != nil {
 		return err
 	}
-
-	for _, base := range keys {
-		if m.match(base, key) {
-			return nil
-		}
+	if allowed {
+		return nil
 	}
 
 	return status.Error(codes.PermissionDenied, fmt.Sprintf("invalid action: you don't have permission to watch messages with key=%v", key))
 }
 
-func (m *Manager) AuthorizeSetUserStatusMethod(user *api.User, report *api.Report) error {
-	keys, err := m.ruleStorage.GetRules(user.Character, user.Role, api.Method_setUserStatus)
+// AuthorizeGetHistoryMethod checks the rules with the getHistory method,
+// which is not in api.Method, see config.MethodGetHistory.
+func (m *Manager) AuthorizeGetHistoryMethod(user *api.User, key *api.Key) error {
+	if err := m.checkKeyNilness(key); err != nil {
+		return err
+	}
+
+	allowed, err := m.authorize(user, config.MethodGetHistory, key)
 	if err != nil {
 		return err
 	}
+	if allowed {
+		return nil
+	}
+
+	return status.Error(codes.PermissionDenied, fmt.Sprintf("invalid action: you don't have permission to get the history of messages with key=%v", key))
+}
 
-	if len(keys) > 0 {
+func (m *Manager) AuthorizeSetUserStatusMethod(user *api.User, report *api.Report) error {
+	allowed, err := m.authorizeKeyless(user, api.Method_setUserStatus)
+	if err != nil {
+		return err
+	}
+	if allowed {
 		return nil
 	}
 
@@ -219,12 +259,11 @@ func (m *Manager) AuthorizeSetUserStatusMethod(user *api.User, report *api.Repor
 
 func (m *Manager) AuthorizeGetActorsMethod(user *api.User) error {
 	fmt.Println(user)
-	keys, err := m.ruleStorage.GetRules(user.Character, user.Role, api.Method_getActors)
+	allowed, err := m.authorizeKeyless(user, api.Method_getActors)
 	if err != nil {
 		return err
 	}
-
-	if len(keys) > 0 {
+	if allowed {
 		return nil
 	}
 
@@ -232,12 +271,11 @@ func (m *Manager) AuthorizeGetActorsMethod(user *api.User) error {
 }
 
 func (m *Manager) AuthorizePutResultMethod(user *api.User) error {
-	keys, err := m.ruleStorage.GetRules(user.Character, user.Role, api.Method_putResult)
+	allowed, err := m.authorizeKeyless(user, api.Method_putResult)
 	if err != nil {
 		return err
 	}
-
-	if len(keys) > 0 {
+	if allowed {
 		return nil
 	}
 
@@ -248,37 +286,109 @@ func (m *Manager) AuthorizeImReadyMethod(user *api.User) error {
 	return nil
 }
 
-func (m *Manager) validateMessageAPIMethods(character api.Character, role string, method api.Method, check *api.Key) error {
-	keys, err := m.ruleStorage.GetRules(character, role, method)
+// AuthorizeAdminMethod lets only the master and operators call the methods
+// of AdminAPI, which have no method in the rules.
+func (m *Manager) AuthorizeAdminMethod(user *api.User) error {
+	switch user.Character {
+	case api.Character_master, api.Character_operator:
+		return nil
+	}
+
+	return status.Error(codes.PermissionDenied, "invalid action: only master and operator can call admin methods")
+}
+
+func (m *Manager) validateMessageAPIMethods(user *api.User, method api.Method, check *api.Key) error {
+	allowed, err := m.authorize(user, method, check)
 	if err != nil {
 		return err
 	}
+	if allowed {
+		return nil
+	}
+	return status.Error(codes.PermissionDenied, "could not find any rule to match with your action")
+}
+
+// DenyFilter returns a function which reports whether a key is denied to the
+// user for the method, or nil if the user has no deny rule for it. Requests
+// whose key is a pattern are only rejected by deny rules which cover the
+// whole pattern, the ones which cover a part of it are applied with this
+// filter to every matched object instead.
+func (m *Manager) DenyFilter(user *api.User, method api.Method) (func(*api.Key) bool, error) {
+	denies, err := m.ruleStorage.GetDenyRules(user, method)
+	if err != nil {
+		return nil, err
+	}
+	if len(denies) == 0 {
+		return nil, nil
+	}
+
+	return func(key *api.Key) bool {
+		for _, base := range denies {
+			if m.match(base, key) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// authorize reports whether the user may call the method on the key. Deny
+// overrides allow: the key is denied if any deny rule matches it, no matter
+// how specific the allow rules are.
+func (m *Manager) authorize(user *api.User, method api.Method, key *api.Key) (bool, error) {
+	denies, err := m.ruleStorage.GetDenyRules(user, method)
+	if err != nil {
+		return false, err
+	}
+
+	for _, base := range denies {
+		if m.match(base, key) {
+			return false, nil
+		}
+	}
+
+	keys, err := m.ruleStorage.GetRules(user, method)
+	if err != nil {
+		return false, err
+	}
 
 	for _, base := range keys {
-		if m.match(base, check) {
-			return nil
+		if m.match(base, key) {
+			return true, nil
 		}
 	}
-	return status.Error(codes.PermissionDenied, "could not find any rule to match with your action")
+	return false, nil
 }
 
-func (m *Manager) match(base, check *api.Key) bool {
-	if base.Type != "" && base.Type != check.Type {
-		return false
+// authorizeKeyless is authorize for the methods which do not take a key: any
+// rule of the method allows it, unless there is a deny rule for it too.
+func (m *Manager) authorizeKeyless(user *api.User, method api.Method) (bool, error) {
+	denies, err := m.ruleStorage.GetDenyRules(user, method)
+	if err != nil {
+		return false, err
 	}
-	if base.Name != "" && base.Name != check.Name {
-		return false
+	if len(denies) > 0 {
+		return false, nil
 	}
-	if base.Namespace != "" && base.Namespace != check.Namespace {
-		return false
+
+	keys, err := m.ruleStorage.GetRules(user, method)
+	if err != nil {
+		return false, err
 	}
-	return true
+	return len(keys) > 0, nil
+}
+
+func (m *Manager) match(base, check *api.Key) bool {
+	return pattern.MatchKey(base, check)
 }
 
 func (m *Manager) checkKeyNilness(k *api.Key) error {
 	if k == nil {
 		return status.Error(codes.InvalidArgument, "invalid key: key can not be null")
 	}
+	if err := pattern.CompileKey(k); err != nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("invalid key: %v", err))
+	}
 	return nil
 }
 
@@ -292,5 +402,8 @@ func (m *Manager) checkKeyCompleteness(k *api.Key) error {
 	if k.Namespace == "" {
 		return status.Error(codes.InvalidArgument, "invalid key: namespace of key can not be empty")
 	}
+	if pattern.HasPattern(k) {
+		return status.Error(codes.InvalidArgument, "invalid key: key can not contain patterns")
+	}
 	return nil
 }
@@ -0,0 +1,99 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/Gimulator/Gimulator/config"
+	"github.com/Gimulator/protobuf/go/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type testRule struct {
+	key    *api.Key
+	method api.Method
+	deny   bool
+}
+
+type testRuleStorage []testRule
+
+func (t testRuleStorage) GetRules(user *api.User, method api.Method) ([]*api.Key, error) {
+	return t.get(method, false), nil
+}
+
+func (t testRuleStorage) GetDenyRules(user *api.User, method api.Method) ([]*api.Key, error) {
+	return t.get(method, true), nil
+}
+
+func (t testRuleStorage) get(method api.Method, deny bool) []*api.Key {
+	keys := make([]*api.Key, 0)
+	for _, rule := range t {
+		if rule.method == method && rule.deny == deny {
+			keys = append(keys, rule.key)
+		}
+	}
+	return keys
+}
+
+func TestDenyOverridesAllow(t *testing.T) {
+	m, _ := NewManager(nil, testRuleStorage{
+		{key: &api.Key{Namespace: "board"}, method: api.Method_get},
+		{key: &api.Key{Namespace: "board"}, method: api.Method_watch},
+		{key: &api.Key{Namespace: "board", Name: "hidden-*"}, method: api.Method_get, deny: true},
+		{key: &api.Key{Namespace: "board", Name: "hidden-*"}, method: api.Method_watch, deny: true},
+		{key: &api.Key{}, method: api.Method_getActors},
+		{key: &api.Key{}, method: api.Method_putResult},
+		{key: &api.Key{Type: "anything"}, method: api.Method_putResult, deny: true},
+	}, nil)
+	user := &api.User{Name: "actor1"}
+
+	if err := m.AuthorizeGetMethod(user, &api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}); err != nil {
+		t.Errorf("allowed key is denied: %v", err)
+	}
+	if err := m.AuthorizeGetMethod(user, &api.Key{Type: "cell", Name: "hidden-1", Namespace: "board"}); err == nil {
+		t.Error("denied key is allowed")
+	}
+
+	// A deny rule which covers a part of a watch does not reject it, it is
+	// applied to the events instead.
+	if err := m.AuthorizeWatchMethod(user, &api.Key{Namespace: "board"}); err != nil {
+		t.Errorf("watch is denied: %v", err)
+	}
+	if err := m.AuthorizeWatchMethod(user, &api.Key{Namespace: "board", Name: "hidden-*"}); err == nil {
+		t.Error("watch of denied keys is allowed")
+	}
+
+	denied, err := m.DenyFilter(user, api.Method_watch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if denied == nil || !denied(&api.Key{Type: "cell", Name: "hidden-1", Namespace: "board"}) || denied(&api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}) {
+		t.Error("deny filter does not match the deny rules")
+	}
+	if denied, _ := m.DenyFilter(user, api.Method_getAll); denied != nil {
+		t.Error("deny filter is not nil without deny rules")
+	}
+
+	if err := m.AuthorizeGetActorsMethod(user); err != nil {
+		t.Errorf("allowed method is denied: %v", err)
+	}
+	if err := m.AuthorizePutResultMethod(user); err == nil {
+		t.Error("denied method is allowed")
+	}
+}
+
+func TestAuthorizeGetHistory(t *testing.T) {
+	m, _ := NewManager(nil, testRuleStorage{
+		{key: &api.Key{Namespace: "board"}, method: api.Method_get},
+		{key: &api.Key{Namespace: "board", Type: "move"}, method: config.MethodGetHistory},
+	}, nil)
+	user := &api.User{Name: "director"}
+
+	if err := m.AuthorizeGetHistoryMethod(user, &api.Key{Namespace: "board", Type: "move"}); err != nil {
+		t.Errorf("history of allowed keys is denied: %v", err)
+	}
+	// The rules of get do not allow getHistory.
+	if err := m.AuthorizeGetHistoryMethod(user, &api.Key{Namespace: "board", Type: "cell"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("got error %v for history of keys without a rule, want PermissionDenied", err)
+	}
+}
@@ -0,0 +1,127 @@
+package manager
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Gimulator/Gimulator/cmd"
+	"github.com/Gimulator/Gimulator/config"
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ReloadStatus is the outcome of the reloads of the config so far.
+type ReloadStatus struct {
+	// Time is when the last reload happened, zero if there was none.
+	Time time.Time
+	// Error is why the last reload failed, empty if it succeeded.
+	Error string
+
+	Reloads  uint64
+	Failures uint64
+}
+
+// Reload loads the config of cmd.ConfigDir again and swaps the users and rules
+// of the storage with it. If the new config is invalid, the previous one is
+// kept. After a successful reload the functions registered with OnReload are
+// called, so for example watchers whose permission is revoked are stopped.
+func (m *Manager) Reload() error {
+	m.reloadMux.Lock()
+	defer m.reloadMux.Unlock()
+
+	log := logrus.WithField("component", "manager").WithField("config-dir", cmd.ConfigDir)
+	log.Info("starting to reload config")
+
+	err := m.reload()
+	m.reloadStatus.Time = time.Now()
+	if err != nil {
+		m.reloadStatus.Error = err.Error()
+		m.reloadStatus.Failures++
+		log.WithError(err).Error("could not reload config, keeping the previous one")
+		return err
+	}
+	m.reloadStatus.Error = ""
+	m.reloadStatus.Reloads++
+
+	for _, f := range m.onReload {
+		f()
+	}
+
+	log.Info("config is reloaded")
+	return nil
+}
+
+func (m *Manager) reload() error {
+	strg, ok := m.ruleStorage.(storage.ConfigStorage)
+	if !ok {
+		return status.Error(codes.Unimplemented, "the storage does not support reloading the config")
+	}
+
+	conf, err := config.NewConfig(cmd.ConfigDir)
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("invalid config: %v", err))
+	}
+
+	return strg.Reload(conf)
+}
+
+func (m *Manager) ReloadStatus() ReloadStatus {
+	m.reloadMux.Lock()
+	defer m.reloadMux.Unlock()
+
+	return m.reloadStatus
+}
+
+// OnReload registers f to be called after every successful reload.
+func (m *Manager) OnReload(f func()) {
+	m.reloadMux.Lock()
+	defer m.reloadMux.Unlock()
+
+	m.onReload = append(m.onReload, f)
+}
+
+// WatchConfig reloads the config whenever a signal is received on signals or,
+// if interval is positive, whenever one of its files is changed, checking
+// every interval. It never returns.
+func (m *Manager) WatchConfig(interval time.Duration, signals <-chan os.Signal) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	last := m.configVersion()
+	for {
+		select {
+		case <-signals:
+		case <-tick:
+			if version := m.configVersion(); version != last {
+				last = version
+			} else {
+				continue
+			}
+		}
+
+		// Errors are logged and kept in the reload status.
+		_ = m.Reload()
+	}
+}
+
+// configVersion tells the versions of the config files apart by their size
+// and modification time.
+func (m *Manager) configVersion() string {
+	version := ""
+	for _, path := range config.Paths(cmd.ConfigDir) {
+		info, err := os.Stat(path)
+		if err != nil {
+			version += fmt.Sprintf("%v:missing;", path)
+			continue
+		}
+		version += fmt.Sprintf("%v:%v:%v;", path, info.Size(), info.ModTime().UnixNano())
+	}
+	return version
+}
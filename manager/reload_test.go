@@ -0,0 +1,61 @@
+package manager
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Gimulator/Gimulator/cmd"
+	"github.com/Gimulator/Gimulator/config"
+)
+
+type testConfigStorage struct {
+	testRuleStorage
+	reloads []*config.Config
+}
+
+func (t *testConfigStorage) Reload(conf *config.Config) error {
+	t.reloads = append(t.reloads, conf)
+	return nil
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	defer func(dir string) { cmd.ConfigDir = dir }(cmd.ConfigDir)
+	cmd.ConfigDir = dir
+
+	write := func(rules, credentials string) {
+		paths := config.Paths(dir)
+		if err := os.WriteFile(paths[0], []byte(rules), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(paths[1], []byte(credentials), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	strg := &testConfigStorage{}
+	m, _ := NewManager(nil, strg, nil)
+	called := 0
+	m.OnReload(func() { called++ })
+
+	write("director: []\n", "- {name: director, token: t, character: director}\n")
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(strg.reloads) != 1 || called != 1 {
+		t.Errorf("got %d reloads and %d calls, want 1 and 1", len(strg.reloads), called)
+	}
+
+	write("director: []\n", "- {name: director, token: t, character: directr}\n")
+	if err := m.Reload(); err == nil {
+		t.Error("invalid config is reloaded")
+	}
+	if len(strg.reloads) != 1 || called != 1 {
+		t.Errorf("got %d reloads and %d calls after an invalid config, want 1 and 1", len(strg.reloads), called)
+	}
+
+	st := m.ReloadStatus()
+	if st.Reloads != 1 || st.Failures != 1 || st.Error == "" {
+		t.Errorf("got reload status %+v", st)
+	}
+}
@@ -0,0 +1,67 @@
+package pattern
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cacheSize is the number of patterns of requests which are kept compiled.
+const cacheSize = 1024
+
+// cache keeps the last size patterns it is given; the least recently used one
+// is dropped to make room for a new one.
+type cache struct {
+	mux   sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	str     string
+	pattern *Pattern
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *cache) get(str string) (*Pattern, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	elem, ok := c.items[str]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).pattern, true
+}
+
+func (c *cache) add(str string, p *Pattern) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if elem, ok := c.items[str]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.items[str] = c.order.PushFront(&cacheEntry{str: str, pattern: p})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).str)
+	}
+}
+
+func (c *cache) len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.order.Len()
+}
@@ -0,0 +1,178 @@
+// Package pattern matches the fields of keys. A field of a key is either
+// empty, which matches anything, an exact value, a glob such as "cell-*" or
+// "team-?", or a regular expression prefixed with "re:", such as
+// "re:cell-[0-9]+", which has to match the whole value. In a glob, a
+// backslash makes the next character literal.
+package pattern
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+const regexPrefix = "re:"
+
+// pinned holds the patterns of the rules, which are pinned when the config is
+// loaded and never parsed again. recent holds the last patterns of requests,
+// which anyone can send, so it is bounded.
+var (
+	pinned sync.Map
+	recent = newCache(cacheSize)
+)
+
+type Pattern struct {
+	re *regexp.Regexp
+}
+
+// IsPattern reports whether str is a glob or a regular expression rather than
+// an exact value.
+func IsPattern(str string) bool {
+	return strings.HasPrefix(str, regexPrefix) || strings.ContainsAny(str, "*?")
+}
+
+// Compile compiles str, or returns it from the caches if it is pinned or
+// compiled recently.
+func Compile(str string) (*Pattern, error) {
+	if p, ok := pinned.Load(str); ok {
+		return p.(*Pattern), nil
+	}
+	if p, ok := recent.get(str); ok {
+		return p, nil
+	}
+
+	p, err := compile(str)
+	if err != nil {
+		return nil, err
+	}
+	recent.add(str, p)
+	return p, nil
+}
+
+func compile(str string) (*Pattern, error) {
+	var expr string
+	if strings.HasPrefix(str, regexPrefix) {
+		expr = "^(?:" + strings.TrimPrefix(str, regexPrefix) + ")$"
+	} else {
+		expr = globToRegex(str)
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", str, err)
+	}
+
+	return &Pattern{re: re}, nil
+}
+
+func (p *Pattern) Match(str string) bool {
+	return p.re.MatchString(str)
+}
+
+// CompileKey compiles the fields of the key which are patterns.
+func CompileKey(key *api.Key) error {
+	for _, field := range []string{key.Type, key.Name, key.Namespace} {
+		if !IsPattern(field) {
+			continue
+		}
+		if _, err := Compile(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PinKey compiles the fields of the key which are patterns and keeps them for
+// good. It is meant for the keys of rules, whose number is bounded by the
+// config, not for the keys of requests.
+func PinKey(key *api.Key) error {
+	for _, field := range []string{key.Type, key.Name, key.Namespace} {
+		if !IsPattern(field) {
+			continue
+		}
+		if _, ok := pinned.Load(field); ok {
+			continue
+		}
+		p, err := compile(field)
+		if err != nil {
+			return err
+		}
+		pinned.Store(field, p)
+	}
+	return nil
+}
+
+// HasPattern reports whether any field of the key is a pattern.
+func HasPattern(key *api.Key) bool {
+	return IsPattern(key.Type) || IsPattern(key.Name) || IsPattern(key.Namespace)
+}
+
+// Strip returns a copy of the key whose pattern fields are emptied, which is
+// what storages, which only know exact values and wildcards, can look up.
+func Strip(key *api.Key) *api.Key {
+	strip := func(field string) string {
+		if IsPattern(field) {
+			return ""
+		}
+		return field
+	}
+
+	return &api.Key{
+		Type:      strip(key.Type),
+		Name:      strip(key.Name),
+		Namespace: strip(key.Namespace),
+	}
+}
+
+// MatchKey reports whether every field of check matches the same field of
+// base. If a field of check is a pattern itself, base has to be empty or the
+// very same pattern, since whether one pattern covers another one can not be
+// told in general.
+func MatchKey(base, check *api.Key) bool {
+	return match(base.Type, check.Type) && match(base.Name, check.Name) && match(base.Namespace, check.Namespace)
+}
+
+func match(base, check string) bool {
+	if base == "" || base == check {
+		return true
+	}
+
+	if IsPattern(check) || !IsPattern(base) {
+		return false
+	}
+
+	p, err := Compile(base)
+	if err != nil {
+		return false
+	}
+	return p.Match(check)
+}
+
+func globToRegex(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	escaped := false
+	for _, r := range glob {
+		if escaped {
+			b.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+			continue
+		}
+
+		switch r {
+		case '\\':
+			escaped = true
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
@@ -0,0 +1,127 @@
+package pattern
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+func TestMatchKey(t *testing.T) {
+	tests := []struct {
+		base  *api.Key
+		check *api.Key
+		want  bool
+	}{
+		{&api.Key{}, &api.Key{Type: "t", Name: "n", Namespace: "ns"}, true},
+		{&api.Key{Name: "cell-*"}, &api.Key{Name: "cell-12"}, true},
+		{&api.Key{Name: "cell-*"}, &api.Key{Name: "row-12"}, false},
+		{&api.Key{Namespace: "team-?"}, &api.Key{Namespace: "team-a"}, true},
+		{&api.Key{Namespace: "team-?"}, &api.Key{Namespace: "team-ab"}, false},
+		{&api.Key{Name: "re:cell-[0-9]+"}, &api.Key{Name: "cell-42"}, true},
+		{&api.Key{Name: "re:cell-[0-9]+"}, &api.Key{Name: "cell-42x"}, false},
+		{&api.Key{Name: "re:cell-[0-9]+"}, &api.Key{Name: "xcell-42"}, false},
+		{&api.Key{Name: "a.b"}, &api.Key{Name: "axb"}, false},
+		{&api.Key{Name: "cell-?"}, &api.Key{Name: "cell-*"}, false},
+		{&api.Key{Name: "cell-*"}, &api.Key{Name: "cell-*"}, true},
+		{&api.Key{Name: "name"}, &api.Key{Name: ""}, false},
+	}
+
+	for _, test := range tests {
+		if got := MatchKey(test.base, test.check); got != test.want {
+			t.Errorf("MatchKey(%v, %v) = %v, want %v", test.base, test.check, got, test.want)
+		}
+	}
+}
+
+func TestCompileKey(t *testing.T) {
+	if err := CompileKey(&api.Key{Name: "re:cell-[0-9"}); err == nil {
+		t.Error("invalid regular expression is compiled without an error")
+	}
+	if err := CompileKey(&api.Key{Name: "cell-*", Type: "re:a|b"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCacheIsBounded(t *testing.T) {
+	rule := &api.Key{Namespace: "re:team-[0-9]+"}
+	if err := PinKey(rule); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2*cacheSize; i++ {
+		if _, err := Compile(fmt.Sprintf("cell-%d-*", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := recent.len(); n > cacheSize {
+		t.Errorf("got %d patterns of requests in the cache, want at most %d", n, cacheSize)
+	}
+	if _, ok := pinned.Load(rule.Namespace); !ok {
+		t.Error("pattern of the rule is not kept")
+	}
+	if _, ok := recent.get("cell-0-*"); ok {
+		t.Error("least recently used pattern is kept")
+	}
+	if !MatchKey(rule, &api.Key{Namespace: "team-12"}) {
+		t.Error("pinned pattern does not match")
+	}
+}
+
+func TestStrip(t *testing.T) {
+	got := Strip(&api.Key{Type: "cell", Name: "cell-*", Namespace: "re:team-.*"})
+	if got.Type != "cell" || got.Name != "" || got.Namespace != "" {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	user := &api.User{Name: "actor1", Role: "red", Character: api.Character_actor}
+
+	got := Expand(&api.Key{Type: "move-$role", Name: "cell-*", Namespace: "$name"}, user)
+	if got.Type != "move-red" || got.Name != "cell-*" || got.Namespace != "actor1" {
+		t.Errorf("got %v", got)
+	}
+
+	rule := Expand(&api.Key{Namespace: "re:$name(-.*)?"}, &api.User{Name: "a.b"})
+	if !MatchKey(rule, &api.Key{Namespace: "a.b-x"}) || MatchKey(rule, &api.Key{Namespace: "axb"}) {
+		t.Error("name of the user is not quoted in a regular expression")
+	}
+
+	rule = Expand(&api.Key{Namespace: "team-*-$name"}, &api.User{Name: "*"})
+	if MatchKey(rule, &api.Key{Namespace: "team-a-someone"}) {
+		t.Error("name of the user is not quoted in a glob")
+	}
+}
+
+func TestExpandExactField(t *testing.T) {
+	rule := Expand(&api.Key{Namespace: "$name"}, &api.User{Name: `a\b`})
+	if !MatchKey(rule, &api.Key{Namespace: `a\b`}) || MatchKey(rule, &api.Key{Namespace: "ab"}) {
+		t.Errorf("got rule %v for a name with a backslash, want the exact name", rule)
+	}
+
+	// Keys of objects can not be patterns, so it is enough that these do not
+	// widen the rule.
+	for _, name := range []string{"a*b", "a?", "re:.*"} {
+		rule := Expand(&api.Key{Namespace: "$name"}, &api.User{Name: name})
+		for _, ns := range []string{"aXb", "ab", "x", "re:x"} {
+			if MatchKey(rule, &api.Key{Namespace: ns}) {
+				t.Errorf("rule of %q matches %q", name, ns)
+			}
+		}
+	}
+
+	rule = Expand(&api.Key{Namespace: "team-*-$name"}, &api.User{Name: `a\b`})
+	if !MatchKey(rule, &api.Key{Namespace: `team-x-a\b`}) {
+		t.Error("a backslash in the name of the user is not quoted in a glob")
+	}
+}
+
+func TestCheckPlaceholders(t *testing.T) {
+	if err := CheckPlaceholders(&api.Key{Type: "$role", Name: "$name", Namespace: "$character"}); err != nil {
+		t.Error(err)
+	}
+	if err := CheckPlaceholders(&api.Key{Namespace: "$team"}); err == nil {
+		t.Error("unknown placeholder is accepted")
+	}
+}
@@ -0,0 +1,83 @@
+package pattern
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+// Placeholders which a field of a rule may contain; they are replaced with the
+// fields of the user whose request is being authorized.
+const (
+	NamePlaceholder      = "$name"
+	RolePlaceholder      = "$role"
+	CharacterPlaceholder = "$character"
+)
+
+var (
+	placeholderRegex = regexp.MustCompile(`\$[A-Za-z_]+`)
+	globEscaper      = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`)
+)
+
+// HasPlaceholder reports whether any field of the key has a placeholder.
+func HasPlaceholder(key *api.Key) bool {
+	return strings.Contains(key.Type, "$") || strings.Contains(key.Name, "$") || strings.Contains(key.Namespace, "$")
+}
+
+// CheckPlaceholders returns an error if a field of the key contains an unknown
+// placeholder.
+func CheckPlaceholders(key *api.Key) error {
+	for _, field := range []string{key.Type, key.Name, key.Namespace} {
+		for _, p := range placeholderRegex.FindAllString(field, -1) {
+			switch p {
+			case NamePlaceholder, RolePlaceholder, CharacterPlaceholder:
+			default:
+				return fmt.Errorf("unknown placeholder %q in %q, choices are: %v, %v, %v", p, field, NamePlaceholder, RolePlaceholder, CharacterPlaceholder)
+			}
+		}
+	}
+	return nil
+}
+
+// Expand returns a copy of the key whose placeholders are replaced with the
+// fields of the user. Values are quoted in regular expressions and globs, and
+// an exact field stays exact even if the values look like a pattern, so a user
+// can never widen a rule with its own name.
+func Expand(key *api.Key, user *api.User) *api.Key {
+	if !HasPlaceholder(key) {
+		return key
+	}
+
+	expand := func(field string) string {
+		replace := func(quote func(string) string) string {
+			return strings.NewReplacer(
+				CharacterPlaceholder, quote(api.Character_name[int32(user.Character)]),
+				NamePlaceholder, quote(user.Name),
+				RolePlaceholder, quote(user.Role),
+			).Replace(field)
+		}
+
+		switch {
+		case strings.HasPrefix(field, regexPrefix):
+			return replace(regexp.QuoteMeta)
+		case IsPattern(field):
+			return replace(globEscaper.Replace)
+		}
+
+		// The value would be taken for a pattern, so it is turned into a
+		// regular expression which only matches itself.
+		value := replace(func(str string) string { return str })
+		if IsPattern(value) {
+			return regexPrefix + regexp.QuoteMeta(value)
+		}
+		return value
+	}
+
+	return &api.Key{
+		Type:      expand(key.Type),
+		Name:      expand(key.Name),
+		Namespace: expand(key.Namespace),
+	}
+}
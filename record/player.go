@@ -0,0 +1,122 @@
+package record
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"time"
+
+	"github.com/Gimulator/Gimulator/simulator"
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+	"github.com/sirupsen/logrus"
+)
+
+// Player replays a match log into a simulator, so its watchers see the match
+// again as it happened.
+type Player struct {
+	sim   *simulator.Simulator
+	users storage.UserStorage
+
+	speed float64
+	step  *bufio.Scanner
+	// sleep is replaced in tests, so they do not depend on the clock.
+	sleep func(ctx context.Context, d time.Duration) error
+
+	log *logrus.Entry
+}
+
+// NewPlayer returns a player which puts the messages of the log with sim and
+// updates the users of the log in users, which are not recorded again.
+//
+// With speed 1 the entries are played with their original pacing, with speed 4
+// four times faster, and with speed 0 without waiting at all. If step is not
+// nil, a line is read from it before every entry instead; once step ends, the
+// rest is played with speed.
+func NewPlayer(sim *simulator.Simulator, users storage.UserStorage, speed float64, step io.Reader) *Player {
+	p := &Player{
+		sim:   sim,
+		users: users,
+		speed: speed,
+		sleep: sleep,
+		log:   logrus.WithField("component", "player"),
+	}
+	if step != nil {
+		p.step = bufio.NewScanner(step)
+	}
+	return p
+}
+
+// Play plays the entries in order until they end or ctx is done, and returns
+// the result of the match, or nil if the log has none. An entry which can not
+// be played, e.g. of a user who is not in the config, is logged and skipped.
+func (p *Player) Play(ctx context.Context, entries []*Entry) (*api.Result, error) {
+	var result *api.Result
+	for i, entry := range entries {
+		if err := p.wait(ctx, entries, i); err != nil {
+			return result, err
+		}
+
+		log := p.log.WithField("type", entry.Type).WithField("entry", i+1)
+		log.Debug("starting to play entry")
+		if entry.Type == TypeResult {
+			result = entry.Result
+		}
+		if err := p.play(entry); err != nil {
+			log.WithError(err).Warn("could not play entry")
+		}
+	}
+	return result, nil
+}
+
+// wait waits until the i-th entry is due.
+func (p *Player) wait(ctx context.Context, entries []*Entry, i int) error {
+	if p.step != nil {
+		if p.step.Scan() {
+			return ctx.Err()
+		}
+		p.step = nil
+	}
+
+	if i == 0 || p.speed <= 0 {
+		return ctx.Err()
+	}
+
+	delay := time.Duration(float64(entries[i].Time.Sub(entries[i-1].Time)) / p.speed)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	return p.sleep(ctx, delay)
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// play applies a single entry. Revisions are given by the simulator, so they
+// follow the order of the log but may differ from the recorded ones, and
+// expired messages are deleted.
+func (p *Player) play(entry *Entry) error {
+	switch entry.Type {
+	case TypePut:
+		return p.sim.Put(entry.Message)
+	case TypeDelete, TypeExpired:
+		return p.sim.Delete(entry.Message.Key)
+	case TypeStatus:
+		return p.users.UpdateUserStatus(entry.User, api.Status(api.Status_value[entry.Status]))
+	case TypeReadiness:
+		return p.users.UpdateUserReadiness(entry.User, *entry.Readiness)
+	case TypeResult:
+		p.log.WithField("id", entry.Result.Id).WithField("status", entry.Result.Status).WithField("msg", entry.Result.Msg).Info("the match of the log is finished")
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package record
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Gimulator/Gimulator/config"
+	"github.com/Gimulator/Gimulator/simulator"
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testLog = `{"time":"2021-01-01T00:00:00Z","type":"readiness","user":"actor1","readiness":true}
+{"time":"2021-01-01T00:00:00.1Z","type":"put","revision":1,"message":{"key":{"type":"cell","name":"cell-1","namespace":"board"},"meta":{"owner":{"name":"actor1"}},"content":"x"}}
+
+{"time":"2021-01-01T00:00:00.2Z","type":"put","revision":2,"message":{"key":{"type":"cell","name":"cell-2","namespace":"board"},"meta":{"owner":{"name":"actor1"}},"content":"o"}}
+{"time":"2021-01-01T00:00:00.3Z","type":"delete","revision":3,"message":{"key":{"type":"cell","name":"cell-1","namespace":"board"},"meta":{"owner":{"name":"actor1"}},"content":"x"}}
+{"time":"2021-01-01T00:00:00.3Z","type":"status","user":"ghost","status":"running"}
+{"time":"2021-01-01T00:00:00.4Z","type":"result","result":{"id":"match-1","msg":"done"}}
+`
+
+func writeLog(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "match.ndjson")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestPlayer(t *testing.T, speed float64, step io.Reader) (*Player, *simulator.Simulator, *storage.Memory) {
+	t.Helper()
+	strg, err := storage.NewMemoryWithConfig(&config.Config{
+		Credentials: []config.Credential{{Name: "actor1", Token: "actor1-token", Character: "actor", Role: "red"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim, err := simulator.NewSimulator(strg, simulator.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewPlayer(sim, strg, speed, step), sim, strg
+}
+
+func TestReadFile(t *testing.T) {
+	entries, err := ReadFile(writeLog(t, testLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 {
+		t.Fatalf("got %d entries, want 6", len(entries))
+	}
+
+	tests := []struct {
+		log  string
+		want string
+	}{
+		{"{}\n", ":1: unknown entry type"},
+		{testLog + "not json\n", ":8: invalid character"},
+		{`{"type":"put","message":{"key":{"type":"cell"}}}`, ":1: put entry has no owner"},
+		{`{"type":"readiness","user":"actor1"}`, ":1: readiness entry has no user or readiness"},
+	}
+	for _, test := range tests {
+		if _, err := ReadFile(writeLog(t, test.log)); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got error %v, want one with %q", err, test.want)
+		}
+	}
+}
+
+func TestPlay(t *testing.T) {
+	entries, err := ReadFile(writeLog(t, testLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	player, sim, strg := newTestPlayer(t, 0, nil)
+
+	result, err := player.Play(context.Background(), entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil || result.Id != "match-1" {
+		t.Errorf("got result %v, want the one of the log", result)
+	}
+
+	if _, _, err := sim.Get(&api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}); status.Code(err) != codes.NotFound {
+		t.Errorf("got error %v for a deleted message, want NotFound", err)
+	}
+	mes, _, err := sim.Get(&api.Key{Type: "cell", Name: "cell-2", Namespace: "board"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mes.Content != "o" || mes.Meta.Owner.Name != "actor1" {
+		t.Errorf("got message %v, want the one of the log", mes)
+	}
+	if revision := sim.Revision(); revision != 3 {
+		t.Errorf("got revision %v, want 3", revision)
+	}
+
+	user, err := strg.GetUserWithName("actor1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Readiness {
+		t.Error("readiness of the log is not played")
+	}
+}
+
+func TestPlayPacing(t *testing.T) {
+	entries, err := ReadFile(writeLog(t, testLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	player, _, _ := newTestPlayer(t, 4, nil)
+	delays := make([]time.Duration, 0)
+	player.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+
+	// The entries are 100ms apart, which is 25ms with speed 4, except for two
+	// at the same time.
+	if _, err := player.Play(context.Background(), entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(delays) != 4 {
+		t.Fatalf("got delays %v, want 4 of them", delays)
+	}
+	for _, d := range delays {
+		if d != 25*time.Millisecond {
+			t.Errorf("got delays %v, want 25ms each", delays)
+			break
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	player, _, _ = newTestPlayer(t, 1, nil)
+	if _, err := player.Play(ctx, entries); err == nil {
+		t.Error("a canceled play is finished")
+	}
+}
+
+func TestSleep(t *testing.T) {
+	start := time.Now()
+	if err := sleep(context.Background(), 20*time.Millisecond); err != nil || time.Since(start) < 20*time.Millisecond {
+		t.Errorf("sleep returned %v after %v, want nil after 20ms", err, time.Since(start))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sleep(ctx, time.Hour); err == nil {
+		t.Error("sleep of a canceled context returned nil")
+	}
+}
+
+func TestPlayStep(t *testing.T) {
+	entries, err := ReadFile(writeLog(t, testLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w := io.Pipe()
+	player, sim, _ := newTestPlayer(t, 0, r)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := player.Play(context.Background(), entries); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// The first step plays the readiness, the second one the first put.
+	for i := 0; i < 2; i++ {
+		if _, err := w.Write([]byte("\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitRevision(t, sim, 1)
+	time.Sleep(20 * time.Millisecond)
+	if revision := sim.Revision(); revision != 1 {
+		t.Fatalf("got revision %v after two steps, want 1", revision)
+	}
+
+	// Once the steps end, the rest is played.
+	w.Close()
+	<-done
+	if revision := sim.Revision(); revision != 3 {
+		t.Errorf("got revision %v, want 3", revision)
+	}
+}
+
+func waitRevision(t *testing.T, sim *simulator.Simulator, revision int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for sim.Revision() < revision {
+		if time.Now().After(deadline) {
+			t.Fatalf("revision %v is not reached", revision)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
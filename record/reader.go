@@ -0,0 +1,72 @@
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// maxLineSize is the longest line of a match log ReadFile accepts.
+const maxLineSize = 16 << 20
+
+// ReadFile reads every entry of the match log at path. Errors are reported as
+// "path:line: message", and empty lines are skipped.
+func ReadFile(path string) ([]*Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]*Entry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		entry := &Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", path, line, err)
+		}
+		if err := entry.validate(); err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", path, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	return entries, nil
+}
+
+// validate checks the entry has the fields of its type.
+func (e *Entry) validate() error {
+	switch e.Type {
+	case TypePut, TypeDelete, TypeExpired:
+		if e.Message == nil || e.Message.Key == nil {
+			return fmt.Errorf("%v entry has no message", e.Type)
+		}
+		if e.Type == TypePut && e.Message.GetMeta().GetOwner() == nil {
+			return fmt.Errorf("put entry has no owner")
+		}
+	case TypeStatus:
+		if e.User == "" || e.Status == "" {
+			return fmt.Errorf("status entry has no user or status")
+		}
+	case TypeReadiness:
+		if e.User == "" || e.Readiness == nil {
+			return fmt.Errorf("readiness entry has no user or readiness")
+		}
+	case TypeResult:
+		if e.Result == nil {
+			return fmt.Errorf("result entry has no result")
+		}
+	default:
+		return fmt.Errorf("unknown entry type %q", e.Type)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Package record writes and reads match logs. A match log has every change of
+// a match, one JSON object per line, in the order they happened: the puts,
+// deletes and expiries of messages, the changes of the status and readiness of
+// users, and the result of the match.
+package record
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Gimulator/protobuf/go/api"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+type Type string
+
+const (
+	TypePut     Type = "put"
+	TypeDelete  Type = "delete"
+	TypeExpired Type = "expired"
+
+	TypeStatus    Type = "status"
+	TypeReadiness Type = "readiness"
+	TypeResult    Type = "result"
+)
+
+// Entry is a line of a match log. Which fields are set depends on its type:
+// put, delete and expired have Revision and Message, where Message is the
+// removed message for delete and expired; status has User and Status,
+// readiness has User and Readiness, and result has Result.
+type Entry struct {
+	Time time.Time `json:"time"`
+	Type Type      `json:"type"`
+
+	Revision int64        `json:"revision,omitempty"`
+	Message  *api.Message `json:"message,omitempty"`
+
+	User      string `json:"user,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Readiness *bool  `json:"readiness,omitempty"`
+
+	Result *api.Result `json:"result,omitempty"`
+}
+
+// entryJSON is an entry as it is written. Message and Result are encoded with
+// protojson, the JSON mapping of protobuf, and shadow the fields of Entry.
+type entryJSON struct {
+	*entryFields
+	Message json.RawMessage `json:"message,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+}
+
+type entryFields Entry
+
+func (e *Entry) MarshalJSON() ([]byte, error) {
+	j := entryJSON{entryFields: (*entryFields)(e)}
+
+	var err error
+	if e.Message != nil {
+		if j.Message, err = protojson.Marshal(e.Message); err != nil {
+			return nil, err
+		}
+	}
+	if e.Result != nil {
+		if j.Result, err = protojson.Marshal(e.Result); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(j)
+}
+
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	j := entryJSON{entryFields: (*entryFields)(e)}
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	e.Message, e.Result = nil, nil
+	if len(j.Message) > 0 && string(j.Message) != "null" {
+		e.Message = &api.Message{}
+		if err := protojson.Unmarshal(j.Message, e.Message); err != nil {
+			return err
+		}
+	}
+	if len(j.Result) > 0 && string(j.Result) != "null" {
+		e.Result = &api.Result{}
+		if err := protojson.Unmarshal(j.Result, e.Result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
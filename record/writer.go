@@ -0,0 +1,94 @@
+package record
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Gimulator/Gimulator/simulator"
+	"github.com/Gimulator/protobuf/go/api"
+	"github.com/sirupsen/logrus"
+)
+
+// Writer appends entries to a match log. Every entry is written to the file as
+// soon as it is recorded, so the log is complete even if Gimulator exits right
+// after the result. It is safe for concurrent use, and it is both a
+// simulator.Recorder and a manager.Recorder.
+type Writer struct {
+	mux  sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+	log  *logrus.Entry
+}
+
+// NewWriter opens the match log at path for appending, and creates it if it
+// does not exist, so a restarted Gimulator continues its log.
+func NewWriter(path string) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		file: file,
+		enc:  json.NewEncoder(file),
+		log:  logrus.WithField("component", "record").WithField("path", path),
+	}, nil
+}
+
+// Write appends the entry to the log.
+func (w *Writer) Write(entry *Entry) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	return w.enc.Encode(entry)
+}
+
+// Close closes the log.
+func (w *Writer) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	return w.file.Close()
+}
+
+// record writes the entry with the current time. The change is already
+// applied when it is recorded, so a failure is only logged.
+func (w *Writer) record(entry *Entry) {
+	entry.Time = time.Now()
+	if err := w.Write(entry); err != nil {
+		w.log.WithField("type", entry.Type).WithError(err).Error("could not record entry")
+	}
+}
+
+func (w *Writer) RecordEvent(event *simulator.Event) {
+	w.record(&Entry{
+		Type:     Type(event.Operation),
+		Revision: event.Revision,
+		Message:  event.Message,
+	})
+}
+
+func (w *Writer) RecordStatus(name string, status api.Status) {
+	w.record(&Entry{
+		Type:   TypeStatus,
+		User:   name,
+		Status: status.String(),
+	})
+}
+
+func (w *Writer) RecordReadiness(name string, readiness bool) {
+	w.record(&Entry{
+		Type:      TypeReadiness,
+		User:      name,
+		Readiness: &readiness,
+	})
+}
+
+func (w *Writer) RecordResult(result *api.Result) {
+	w.record(&Entry{
+		Type:   TypeResult,
+		Result: result,
+	})
+}
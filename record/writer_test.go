@@ -0,0 +1,167 @@
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Gimulator/Gimulator/config"
+	"github.com/Gimulator/Gimulator/manager"
+	"github.com/Gimulator/Gimulator/simulator"
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+func readEntries(t *testing.T, path string) []*Entry {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	entries := make([]*Entry, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := &Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			t.Fatalf("could not decode line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "match.ndjson")
+	w, err := NewWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	strg, err := storage.NewMemoryWithConfig(&config.Config{
+		Credentials: []config.Credential{{Name: "actor1", Token: "actor1-token", Character: "actor", Role: "red"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim, err := simulator.NewSimulator(strg, simulator.Config{Recorder: w})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := manager.NewManager(strg, strg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Recorder = w
+
+	mes := &api.Message{
+		Key:     &api.Key{Type: "cell", Name: "cell-1", Namespace: "board"},
+		Meta:    &api.Meta{Owner: &api.User{Name: "actor1"}},
+		Content: "x",
+	}
+	if err := m.UpdateReadiness("actor1", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Put(mes); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.DeleteAll(&api.Key{Namespace: "board"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.UpdateStatus("actor1", api.Status_running); err != nil {
+		t.Fatal(err)
+	}
+	m.RecordResult(&api.Result{Id: "match-1", Msg: "done"})
+
+	entries := readEntries(t, path)
+	got := make([]string, 0)
+	for _, entry := range entries {
+		got = append(got, string(entry.Type))
+		if entry.Time.IsZero() {
+			t.Errorf("time of %v entry is not set", entry.Type)
+		}
+	}
+	if want := "[readiness put delete status result]"; fmt.Sprint(got) != want {
+		t.Fatalf("got entries %v, want %v", got, want)
+	}
+
+	if e := entries[0]; e.User != "actor1" || e.Readiness == nil || !*e.Readiness {
+		t.Errorf("got readiness entry %+v", e)
+	}
+	if e := entries[1]; e.Revision != 1 || e.Message.Content != "x" || e.Message.Meta.Owner.Name != "actor1" {
+		t.Errorf("got put entry %+v", e)
+	}
+	if e := entries[2]; e.Revision != 2 || e.Message.Key.Name != "cell-1" {
+		t.Errorf("got delete entry %+v", e)
+	}
+	if e := entries[3]; e.User != "actor1" || e.Status != api.Status_running.String() {
+		t.Errorf("got status entry %+v", e)
+	}
+	if e := entries[4]; e.Result == nil || e.Result.Id != "match-1" {
+		t.Errorf("got result entry %+v", e)
+	}
+}
+
+func TestWriterAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "match.ndjson")
+	for i := 0; i < 2; i++ {
+		w, err := NewWriter(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.RecordReadiness(fmt.Sprintf("actor%d", i), true)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if entries := readEntries(t, path); len(entries) != 2 || entries[1].User != "actor1" {
+		t.Errorf("got entries %+v, want the ones of both writers", entries)
+	}
+}
+
+func TestEntryJSON(t *testing.T) {
+	entry := &Entry{
+		Type:     TypePut,
+		Revision: 1,
+		Message: &api.Message{
+			Key:     &api.Key{Type: "cell", Name: "cell-1", Namespace: "board"},
+			Meta:    &api.Meta{Owner: &api.User{Name: "director", Character: api.Character_director}},
+			Content: "x",
+		},
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// protojson writes enums by their names.
+	if !strings.Contains(string(data), `"character":"director"`) {
+		t.Errorf("got %s, want the character of the owner by its name", data)
+	}
+
+	got := &Entry{}
+	if err := json.Unmarshal(data, got); err != nil {
+		t.Fatal(err)
+	}
+	if owner := got.Message.GetMeta().GetOwner(); got.Revision != 1 || got.Message.Content != "x" || owner.Character != api.Character_director {
+		t.Errorf("got entry %+v, want the one which is written", got)
+	}
+
+	// Logs which are written before still have enums as numbers.
+	old := `{"time":"2022-03-06T11:07:43Z","type":"result","result":{"id":"match-1","status":1}}`
+	if err := json.Unmarshal([]byte(old), got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Message != nil || got.Result.Id != "match-1" || got.Result.Status != api.Result_failed {
+		t.Errorf("got entry %+v from an old line", got)
+	}
+}
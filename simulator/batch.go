@@ -0,0 +1,94 @@
+package simulator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Write is a single operation of a batch. Put writes Message, delete removes
+// the message stored with Key. TTL is the time-to-live of a put, see PutIf.
+type Write struct {
+	Operation Operation
+	Key       *api.Key
+	Message   *api.Message
+	TTL       time.Duration
+}
+
+// Batch applies the writes atomically and in order: either all of them reach
+// the storage or none does. The events of the batch are spread one after the
+// other, with nothing in between. It returns the revision after the batch.
+func (s *Simulator) Batch(writes []*Write) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	// pending holds what the batch itself has written so far, so a delete
+	// sees a put of the same key earlier in the batch and vice versa.
+	pending := make(map[keyID]*api.Message)
+
+	revision := s.revision
+	changes := make([]*storage.Change, 0, len(writes))
+	events := make([]*Event, 0, len(writes))
+	deadlines := make([]time.Time, 0, len(writes))
+	for _, w := range writes {
+		switch w.Operation {
+		case OperationPut:
+			revision++
+			pending[newKeyID(w.Message.Key)] = w.Message
+			change := newChange(OperationPut, w.Message.Key, w.Message, revision)
+			change.ExpiresAt = deadlineOf(w.TTL)
+			changes = append(changes, change)
+			events = append(events, NewEvent(OperationPut, revision, w.Message))
+			deadlines = append(deadlines, change.ExpiresAt)
+		case OperationDelete:
+			mes, ok := pending[newKeyID(w.Key)]
+			if !ok {
+				stored, err := s.storage.Get(w.Key)
+				if err != nil && status.Code(err) != codes.NotFound {
+					return 0, err
+				}
+				mes = stored
+			}
+			pending[newKeyID(w.Key)] = nil
+
+			if mes == nil {
+				continue
+			}
+			revision++
+			changes = append(changes, newChange(OperationDelete, w.Key, mes, revision))
+			events = append(events, NewEvent(OperationDelete, revision, mes))
+			deadlines = append(deadlines, time.Time{})
+		default:
+			return 0, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid operation: %v can not be used in a batch", w.Operation))
+		}
+	}
+
+	if err := s.storage.Apply(changes); err != nil {
+		return 0, err
+	}
+
+	for i, event := range events {
+		s.commit(event.Operation, event.Message)
+		s.scheduleExpiry(event.Message.Key, deadlines[i])
+	}
+
+	return s.revision, nil
+}
+
+type keyID struct {
+	typ       string
+	name      string
+	namespace string
+}
+
+func newKeyID(key *api.Key) keyID {
+	return keyID{
+		typ:       key.Type,
+		name:      key.Name,
+		namespace: key.Namespace,
+	}
+}
@@ -0,0 +1,99 @@
+package simulator
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+type failingApplyStorage struct {
+	*storage.Memory
+}
+
+func (failingApplyStorage) Apply([]*storage.Change) error {
+	return errors.New("apply failed")
+}
+
+func TestBatch(t *testing.T) {
+	sim, err := NewSimulator(storage.NewMemory(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Put(newTestMessage("cell", "old")); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := NewChannel()
+	if _, err := sim.Watch(&api.Key{Type: "cell"}, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := newTestMessage("cell", "a"), newTestMessage("cell", "b")
+	revision, err := sim.Batch([]*Write{
+		{Operation: OperationPut, Message: a},
+		{Operation: OperationDelete, Key: &api.Key{Type: "cell", Name: "old", Namespace: "test"}},
+		{Operation: OperationPut, Message: b},
+		{Operation: OperationDelete, Key: a.Key},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != 5 {
+		t.Errorf("got revision %d after the batch, want 5", revision)
+	}
+
+	want := []struct {
+		op   Operation
+		name string
+	}{
+		{OperationPut, "a"}, {OperationDelete, "old"}, {OperationPut, "b"}, {OperationDelete, "a"},
+	}
+	if len(ch.Ch) != len(want) {
+		t.Fatalf("got %d events, want %d", len(ch.Ch), len(want))
+	}
+	for i, w := range want {
+		event := <-ch.Ch
+		if event.Operation != w.op || event.Message.Key.Name != w.name || event.Revision != int64(i+2) {
+			t.Errorf("got event %v %v at revision %d, want %v %v at revision %d", event.Operation, event.Message.Key.Name, event.Revision, w.op, w.name, i+2)
+		}
+	}
+
+	messages, err := sim.GetAll(&api.Key{Type: "cell"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Key.Name != "b" {
+		t.Errorf("got %v after the batch, want only b", messages)
+	}
+}
+
+func TestBatchIsAllOrNothing(t *testing.T) {
+	sim, err := NewSimulator(failingApplyStorage{storage.NewMemory()}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := NewChannel()
+	if _, err := sim.Watch(&api.Key{}, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sim.Batch([]*Write{
+		{Operation: OperationPut, Message: newTestMessage("cell", "a")},
+		{Operation: OperationPut, Message: newTestMessage("cell", "b")},
+	}); err == nil {
+		t.Fatal("batch succeeded although the storage failed")
+	}
+
+	if len(ch.Ch) != 0 {
+		t.Errorf("watcher received %d events of a failed batch", len(ch.Ch))
+	}
+	if rev := sim.Revision(); rev != 0 {
+		t.Errorf("got revision %d after a failed batch, want 0", rev)
+	}
+	if versions, err := sim.History(&api.Key{}, 0, 0); err != nil || len(versions) != 0 {
+		t.Errorf("got history %v, %v after a failed batch, want no versions", versions, err)
+	}
+}
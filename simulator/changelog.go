@@ -0,0 +1,68 @@
+package simulator
+
+// changeLog keeps the last events of the room, so a watcher can resume from a
+// revision it has already seen. Every revision produces exactly one event, so
+// the revisions in the log are consecutive. It is a ring buffer, so appending
+// never copies the log.
+type changeLog struct {
+	events []*Event
+	// start is the index of the oldest event and n is the number of events.
+	start int
+	n     int
+}
+
+func newChangeLog(size int) *changeLog {
+	if size < 0 {
+		size = 0
+	}
+	return &changeLog{
+		events: make([]*Event, size),
+	}
+}
+
+func (c *changeLog) Append(event *Event) {
+	size := len(c.events)
+	if size == 0 {
+		return
+	}
+
+	if c.n < size {
+		c.events[(c.start+c.n)%size] = event
+		c.n++
+		return
+	}
+	c.events[c.start] = event
+	c.start = (c.start + 1) % size
+}
+
+// at returns the i-th oldest event of the log.
+func (c *changeLog) at(i int) *Event {
+	return c.events[(c.start+i)%len(c.events)]
+}
+
+// Since returns the events with a revision greater than revision. It returns
+// false if some of those events are no longer in the log; current is the
+// revision of the last change of the room.
+func (c *changeLog) Since(revision, current int64) ([]*Event, bool) {
+	if revision >= current {
+		return []*Event{}, true
+	}
+
+	if c.n == 0 || c.at(0).Revision > revision+1 {
+		return nil, false
+	}
+
+	skip := int(revision + 1 - c.at(0).Revision)
+	events := make([]*Event, 0, c.n-skip)
+	for i := skip; i < c.n; i++ {
+		events = append(events, c.at(i))
+	}
+	return events, true
+}
+
+func (c *changeLog) Oldest() int64 {
+	if c.n == 0 {
+		return 0
+	}
+	return c.at(0).Revision
+}
@@ -0,0 +1,46 @@
+package simulator
+
+import "testing"
+
+func TestChangeLogWrapsAround(t *testing.T) {
+	c := newChangeLog(3)
+	for revision := int64(1); revision <= 10; revision++ {
+		c.Append(NewEvent(OperationPut, revision, nil))
+
+		oldest := revision - 2
+		if oldest < 1 {
+			oldest = 1
+		}
+		if got := c.Oldest(); got != oldest {
+			t.Fatalf("got oldest revision %d after %d appends, want %d", got, revision, oldest)
+		}
+
+		events, ok := c.Since(oldest-1, revision)
+		if !ok || len(events) != int(revision-oldest+1) {
+			t.Fatalf("got %d events, %v since %d after %d appends", len(events), ok, oldest-1, revision)
+		}
+		for i, event := range events {
+			if event.Revision != oldest+int64(i) {
+				t.Errorf("got revision %d at %d after %d appends, want %d", event.Revision, i, revision, oldest+int64(i))
+			}
+		}
+	}
+
+	if _, ok := c.Since(6, 10); ok {
+		t.Error("got the events since a compacted revision")
+	}
+	if events, ok := c.Since(9, 10); !ok || len(events) != 1 || events[0].Revision != 10 {
+		t.Errorf("got %v, %v since revision 9, want the last event", events, ok)
+	}
+}
+
+func TestChangeLogDisabled(t *testing.T) {
+	c := newChangeLog(0)
+	c.Append(NewEvent(OperationPut, 1, nil))
+	if _, ok := c.Since(0, 1); ok {
+		t.Error("a disabled change log keeps events")
+	}
+	if events, ok := c.Since(1, 1); !ok || len(events) != 0 {
+		t.Errorf("got %v, %v since the current revision, want no events", events, ok)
+	}
+}
@@ -0,0 +1,197 @@
+package simulator
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+const DefaultBufferSize = 128
+
+// Policy decides what happens when an event is spread to a watcher whose
+// buffer is full.
+type Policy string
+
+const (
+	// PolicyDropNewest drops the event which does not fit.
+	PolicyDropNewest Policy = "drop-newest"
+	// PolicyDropOldest drops the oldest buffered event to make room.
+	PolicyDropOldest Policy = "drop-oldest"
+	// PolicyCoalesce keeps only the latest event of every key, and drops the
+	// oldest keys if there is still no room.
+	PolicyCoalesce Policy = "coalesce"
+	// PolicyDisconnect gives up on the watcher, see Channel.Overflowed.
+	PolicyDisconnect Policy = "disconnect"
+)
+
+func ParsePolicy(str string) (Policy, error) {
+	switch p := Policy(str); p {
+	case PolicyDropNewest, PolicyDropOldest, PolicyCoalesce, PolicyDisconnect:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid policy %q, choices are: %v, %v, %v, %v", str, PolicyDropNewest, PolicyDropOldest, PolicyCoalesce, PolicyDisconnect)
+}
+
+// ParsePolicies parses a comma separated list of character=policy pairs,
+// like "actor=coalesce,director=disconnect".
+func ParsePolicies(str string) (map[api.Character]Policy, error) {
+	policies := make(map[api.Character]Policy)
+	if str == "" {
+		return policies, nil
+	}
+
+	for _, pair := range strings.Split(str, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid watch policy %q, it should look like character=policy", pair)
+		}
+
+		character, ok := api.Character_value[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("invalid watch policy %q, %q is not a character", pair, parts[0])
+		}
+
+		policy, err := ParsePolicy(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		policies[api.Character(character)] = policy
+	}
+
+	return policies, nil
+}
+
+type Channel struct {
+	mux      sync.Mutex
+	Ch       chan *Event
+	IsClosed bool
+
+	policy   Policy
+	dropped  uint64
+	overflow chan struct{}
+	once     sync.Once
+}
+
+func NewChannel() *Channel {
+	return NewChannelWithPolicy(DefaultBufferSize, PolicyDropNewest)
+}
+
+func NewChannelWithPolicy(size int, policy Policy) *Channel {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+
+	return &Channel{
+		Ch:       make(chan *Event, size),
+		mux:      sync.Mutex{},
+		IsClosed: false,
+		policy:   policy,
+		overflow: make(chan struct{}),
+	}
+}
+
+func (c *Channel) Close() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.IsClosed = true
+}
+
+func (c *Channel) IsClose() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.IsClosed
+}
+
+// Overflowed is closed when a channel with PolicyDisconnect runs out of room;
+// the reader should then end the watch with an error.
+func (c *Channel) Overflowed() <-chan struct{} {
+	return c.overflow
+}
+
+// Dropped returns the number of events which were dropped so far.
+func (c *Channel) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// Send hands the event to the reader without ever blocking, and returns the
+// number of events it dropped to do so. Only the spreader sends to a channel,
+// so the buffer can not be filled by anyone else in the meantime.
+func (c *Channel) Send(event *Event) int {
+	select {
+	case c.Ch <- event:
+		return 0
+	default:
+	}
+
+	dropped := 0
+	switch c.policy {
+	case PolicyDropOldest:
+		for sent := false; !sent; {
+			select {
+			case <-c.Ch:
+				dropped++
+			default:
+			}
+
+			select {
+			case c.Ch <- event:
+				sent = true
+			default:
+			}
+		}
+	case PolicyCoalesce:
+		dropped = c.coalesce(event)
+	case PolicyDisconnect:
+		c.once.Do(func() {
+			c.Close()
+			close(c.overflow)
+		})
+		dropped = 1
+	default:
+		dropped = 1
+	}
+
+	atomic.AddUint64(&c.dropped, uint64(dropped))
+	return dropped
+}
+
+func (c *Channel) coalesce(event *Event) int {
+	events := make([]*Event, 0, cap(c.Ch)+1)
+	for drained := false; !drained; {
+		select {
+		case e := <-c.Ch:
+			events = append(events, e)
+		default:
+			drained = true
+		}
+	}
+	events = append(events, event)
+
+	// Keep the last event of every key, in the order the events happened.
+	last := make(map[keyID]int)
+	for i, e := range events {
+		last[newKeyID(e.Message.Key)] = i
+	}
+	kept := make([]*Event, 0, len(last))
+	for i, e := range events {
+		if last[newKeyID(e.Message.Key)] == i {
+			kept = append(kept, e)
+		}
+	}
+
+	dropped := len(events) - len(kept)
+	if over := len(kept) - cap(c.Ch); over > 0 {
+		kept = kept[over:]
+		dropped += over
+	}
+
+	for _, e := range kept {
+		c.Ch <- e
+	}
+	return dropped
+}
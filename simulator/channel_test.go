@@ -0,0 +1,90 @@
+package simulator
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+func TestChannelPolicies(t *testing.T) {
+	// Five events of keys a, b, a, c, a into a channel of size 2.
+	names := []string{"a", "b", "a", "c", "a"}
+
+	tests := []struct {
+		policy  Policy
+		want    []int64
+		dropped uint64
+	}{
+		{PolicyDropNewest, []int64{1, 2}, 3},
+		{PolicyDropOldest, []int64{4, 5}, 3},
+		{PolicyCoalesce, []int64{4, 5}, 3},
+		{PolicyDisconnect, []int64{1, 2}, 3},
+	}
+
+	for _, test := range tests {
+		ch := NewChannelWithPolicy(2, test.policy)
+		for i, name := range names {
+			ch.Send(NewEvent(OperationPut, int64(i+1), newTestMessage("cell", name)))
+		}
+
+		got := make([]int64, 0)
+		for len(ch.Ch) > 0 {
+			got = append(got, (<-ch.Ch).Revision)
+		}
+
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%v: got revisions %v, want %v", test.policy, got, test.want)
+		}
+		if ch.Dropped() != test.dropped {
+			t.Errorf("%v: got %d dropped events, want %d", test.policy, ch.Dropped(), test.dropped)
+		}
+
+		select {
+		case <-ch.Overflowed():
+			if test.policy != PolicyDisconnect {
+				t.Errorf("%v: channel overflowed", test.policy)
+			}
+		default:
+			if test.policy == PolicyDisconnect {
+				t.Errorf("%v: channel did not overflow", test.policy)
+			}
+		}
+	}
+}
+
+func TestCoalesceKeepsLatestOfEveryKey(t *testing.T) {
+	ch := NewChannelWithPolicy(3, PolicyCoalesce)
+	for i, name := range []string{"a", "b", "c", "b", "a", "b"} {
+		ch.Send(NewEvent(OperationPut, int64(i+1), newTestMessage("cell", name)))
+	}
+
+	got := make([]string, 0)
+	for len(ch.Ch) > 0 {
+		event := <-ch.Ch
+		got = append(got, fmt.Sprintf("%v%d", event.Message.Key.Name, event.Revision))
+	}
+
+	if want := "[c3 a5 b6]"; fmt.Sprint(got) != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if ch.Dropped() != 3 {
+		t.Errorf("got %d dropped events, want 3", ch.Dropped())
+	}
+}
+
+func TestParsePolicies(t *testing.T) {
+	policies, err := ParsePolicies("actor=coalesce, director=disconnect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies[api.Character_actor] != PolicyCoalesce || policies[api.Character_director] != PolicyDisconnect {
+		t.Errorf("got %v", policies)
+	}
+
+	for _, str := range []string{"actor", "actor=slow", "player=coalesce"} {
+		if _, err := ParsePolicies(str); err == nil {
+			t.Errorf("%q is parsed without an error", str)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package simulator
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+func TestConcurrentWatchersAndWriters(t *testing.T) {
+	const (
+		watchers = 32
+		writers  = 8
+		puts     = 12 // writers * puts must fit in the buffer of a channel
+	)
+
+	sim, err := NewSimulator(storage.NewMemory(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channels := make([]*Channel, watchers)
+	for i := range channels {
+		channels[i] = NewChannel()
+		if _, err := sim.Watch(&api.Key{Type: "cell"}, channels[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := make([]int, watchers)
+	var readers sync.WaitGroup
+	for i, ch := range channels {
+		readers.Add(1)
+		go func(i int, ch *Channel) {
+			defer readers.Done()
+			for received[i] < writers*puts {
+				select {
+				case <-ch.Ch:
+					received[i]++
+				case <-time.After(5 * time.Second):
+					return
+				}
+			}
+		}(i, ch)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for p := 0; p < puts; p++ {
+				if err := sim.Put(newTestMessage("cell", fmt.Sprintf("w%d-%d", w, p))); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for p := 0; p < puts; p++ {
+				if _, err := sim.GetAll(&api.Key{Type: "cell"}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	readers.Wait()
+
+	for i, n := range received {
+		if n != writers*puts {
+			t.Errorf("watcher %d received %d messages, want %d", i, n, writers*puts)
+		}
+	}
+}
+
+func TestWatcherDoesNotBlockReadsAndWrites(t *testing.T) {
+	sim, err := NewSimulator(storage.NewMemory(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody drains this channel, just like a client that stopped reading.
+	if _, err := sim.Watch(&api.Key{}, NewChannel()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			mes := newTestMessage("cell", fmt.Sprintf("%d", i))
+			if err := sim.Put(mes); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, _, err := sim.Get(mes.Key); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reads and writes are blocked by an idle watcher")
+	}
+}
+
+func newTestMessage(typ, name string) *api.Message {
+	return &api.Message{
+		Key: &api.Key{
+			Type:      typ,
+			Name:      name,
+			Namespace: "test",
+		},
+		Meta: &api.Meta{
+			Owner: &api.User{Name: "tester"},
+		},
+		Content: name,
+	}
+}
@@ -0,0 +1,12 @@
+package simulator
+
+// Condition is what a conditional write expects from the message which is
+// currently stored with the same key. Zero fields are not checked.
+type Condition struct {
+	// Revision is the expected revision of the stored message.
+	Revision int64
+	// Owner is the expected name of the owner of the stored message.
+	Owner string
+	// Absent expects no message to be stored, it makes the write create-only.
+	Absent bool
+}
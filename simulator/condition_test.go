@@ -0,0 +1,72 @@
+package simulator
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPutIf(t *testing.T) {
+	sim, err := NewSimulator(storage.NewMemory(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mes := newTestMessage("cell", "a")
+	revision, err := sim.PutIf(mes, &Condition{Absent: true}, 0)
+	if err != nil {
+		t.Fatalf("create-only put of a new key failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		message *api.Message
+		cond    *Condition
+		want    codes.Code
+	}{
+		{"absent on existing key", mes, &Condition{Absent: true}, codes.FailedPrecondition},
+		{"stale revision", mes, &Condition{Revision: revision + 1}, codes.FailedPrecondition},
+		{"other owner", mes, &Condition{Owner: "someone-else"}, codes.FailedPrecondition},
+		{"matching owner", mes, &Condition{Owner: "tester"}, codes.OK},
+		{"matching revision", mes, &Condition{Revision: revision + 1}, codes.OK},
+		{"revision of missing key", newTestMessage("cell", "missing"), &Condition{Revision: 1}, codes.FailedPrecondition},
+	}
+
+	for _, test := range tests {
+		if _, err := sim.PutIf(test.message, test.cond, 0); status.Code(err) != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestPutIfAbsentRace(t *testing.T) {
+	sim, err := NewSimulator(storage.NewMemory(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const actors = 16
+	wins := make(chan int, actors)
+	var wg sync.WaitGroup
+	for i := 0; i < actors; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mes := newTestMessage("cell", "claimed")
+			mes.Meta.Owner = &api.User{Name: "actor"}
+			if _, err := sim.PutIf(mes, &Condition{Absent: true}, 0); err == nil {
+				wins <- i
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(wins)
+
+	if n := len(wins); n != 1 {
+		t.Errorf("%d actors claimed the same cell, want exactly one", n)
+	}
+}
@@ -0,0 +1,34 @@
+package simulator
+
+import (
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+type Operation string
+
+const (
+	OperationPut     Operation = "put"
+	OperationDelete  Operation = "delete"
+	OperationExpired Operation = "expired"
+
+	// OperationSynced marks the end of the initial snapshot of a watch;
+	// it carries no message.
+	OperationSynced Operation = "synced"
+)
+
+// Event is a change of the storage which is spread to the watchers. For
+// delete and expired events, Message is the last stored version of the
+// message. Revision is the revision of the room right after the change.
+type Event struct {
+	Operation Operation
+	Revision  int64
+	Message   *api.Message
+}
+
+func NewEvent(op Operation, revision int64, mes *api.Message) *Event {
+	return &Event{
+		Operation: op,
+		Revision:  revision,
+		Message:   mes,
+	}
+}
@@ -0,0 +1,124 @@
+package simulator
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+// expiry is a message which has to be removed at deadline, unless it is
+// written again before that; revision tells the two apart.
+type expiry struct {
+	deadline time.Time
+	key      *api.Key
+	revision int64
+}
+
+// deadlineOf returns the deadline of a message written now with ttl, or the
+// zero time if ttl is not positive.
+func deadlineOf(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+type expiryQueue []*expiry
+
+func (q expiryQueue) Len() int            { return len(q) }
+func (q expiryQueue) Less(i, j int) bool  { return q[i].deadline.Before(q[j].deadline) }
+func (q expiryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(*expiry)) }
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return e
+}
+
+// scheduler hands the due expiries to expire, in order of their deadlines. A
+// single goroutine and timer serve all the messages, and every expiry which
+// is due at once is handed over in one call, so a burst of thousands of
+// expiring keys costs one critical section of the simulator.
+type scheduler struct {
+	mux    sync.Mutex
+	queue  expiryQueue
+	wake   chan struct{}
+	stop   chan struct{}
+	expire func([]*expiry)
+}
+
+func newScheduler(expire func([]*expiry)) *scheduler {
+	s := &scheduler{
+		queue:  make(expiryQueue, 0),
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		expire: expire,
+	}
+	go s.run()
+	return s
+}
+
+func (s *scheduler) Schedule(e *expiry) {
+	s.mux.Lock()
+	heap.Push(&s.queue, e)
+	s.mux.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *scheduler) Len() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return len(s.queue)
+}
+
+func (s *scheduler) Stop() {
+	close(s.stop)
+}
+
+func (s *scheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		now := time.Now()
+		due := make([]*expiry, 0)
+		wait := time.Hour
+
+		s.mux.Lock()
+		for len(s.queue) > 0 && !s.queue[0].deadline.After(now) {
+			due = append(due, heap.Pop(&s.queue).(*expiry))
+		}
+		if len(s.queue) > 0 {
+			wait = s.queue[0].deadline.Sub(now)
+		}
+		s.mux.Unlock()
+
+		if len(due) > 0 {
+			s.expire(due)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-s.stop:
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package simulator
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+func TestExpiry(t *testing.T) {
+	sim, err := NewSimulator(storage.NewMemory(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	ch := NewChannel()
+	if _, err := sim.Watch(&api.Key{Type: "ping"}, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	short, kept := newTestMessage("ping", "short"), newTestMessage("ping", "kept")
+	if _, err := sim.PutIf(short, nil, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sim.PutIf(kept, nil, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// Writing again without a time-to-live cancels the expiry.
+	if err := sim.Put(newTestMessage("ping", "kept")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		<-ch.Ch
+	}
+
+	select {
+	case event := <-ch.Ch:
+		if event.Operation != OperationExpired || event.Message.Key.Name != "short" {
+			t.Errorf("got %v event for %v, want expired event for short", event.Operation, event.Message.Key.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message did not expire")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if len(ch.Ch) != 0 {
+		t.Errorf("got %d more events, want none", len(ch.Ch))
+	}
+	if _, _, err := sim.Get(kept.Key); err != nil {
+		t.Errorf("message which was written again expired: %v", err)
+	}
+}
+
+func TestExpiryBurst(t *testing.T) {
+	const keys = 5000
+
+	sim, err := NewSimulator(storage.NewMemory(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	for i := 0; i < keys; i++ {
+		ttl := time.Duration(i%10) * time.Millisecond
+		if _, err := sim.PutIf(newTestMessage("ping", fmt.Sprintf("%d", i)), nil, ttl+time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		messages, err := sim.GetAll(&api.Key{Type: "ping"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) == 0 {
+			if rev := sim.Revision(); rev != 2*keys {
+				t.Errorf("got revision %d, want %d", rev, 2*keys)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("not every message expired")
+}
+
+func TestExpiryAfterRestart(t *testing.T) {
+	strg := storage.NewMemory()
+	sim, err := NewSimulator(strg, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	short, long := newTestMessage("ping", "short"), newTestMessage("ping", "long")
+	if _, err := sim.PutIf(short, nil, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sim.PutIf(long, nil, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	sim.Close()
+
+	// The deadline of short passes while no simulator is running.
+	time.Sleep(150 * time.Millisecond)
+
+	sim, err = NewSimulator(strg, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, err := sim.Get(short.Key); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("message did not expire after the restart")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, _, err := sim.Get(long.Key); err != nil {
+		t.Errorf("message whose deadline is not reached expired: %v", err)
+	}
+	versions, err := sim.History(short.Key, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].Operation != string(OperationExpired) || versions[0].Revision != 3 {
+		t.Errorf("got history %v after the restart, want an expired version with revision 3", versions)
+	}
+}
@@ -0,0 +1,90 @@
+package simulator
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHistory(t *testing.T) {
+	sim, err := NewSimulator(storage.NewMemory(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := newTestMessage("cell", "a")
+	if err := sim.Put(first); err != nil {
+		t.Fatal(err)
+	}
+	second := newTestMessage("cell", "a")
+	second.Content = "changed"
+	if err := sim.Put(second); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Put(newTestMessage("cell", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Put(newTestMessage("row", "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Delete(first.Key); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := sim.History(first.Key, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for _, version := range versions {
+		got = append(got, fmt.Sprintf("%v:%v:%v", version.Revision, version.Operation, version.Message.Content))
+	}
+	if want := "[1:put:a 2:put:changed 5:delete:changed]"; fmt.Sprint(got) != want {
+		t.Errorf("got history %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		key   *api.Key
+		since int64
+		limit int
+		want  []int64
+	}{
+		{&api.Key{Type: "cell", Name: "*", Namespace: "test"}, 0, 0, []int64{1, 2, 3, 5}},
+		{&api.Key{Type: "cell", Name: "*", Namespace: "test"}, 1, 2, []int64{2, 3}},
+		{&api.Key{Type: "*", Name: "a", Namespace: "test"}, 0, 3, []int64{1, 2, 4}},
+	}
+	for _, test := range tests {
+		versions, err := sim.History(test.key, test.since, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		revisions := make([]int64, 0)
+		for _, version := range versions {
+			revisions = append(revisions, version.Revision)
+		}
+		if fmt.Sprint(revisions) != fmt.Sprint(test.want) {
+			t.Errorf("got revisions %v for key=%v, since=%v and limit=%v, want %v", revisions, test.key, test.since, test.limit, test.want)
+		}
+	}
+}
+
+// messageOnlyStorage hides every method of the storage but the ones of
+// storage.MessageStorage.
+type messageOnlyStorage struct {
+	storage.MessageStorage
+}
+
+func TestHistoryUnimplemented(t *testing.T) {
+	sim, err := NewSimulator(messageOnlyStorage{storage.NewMemory()}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sim.History(&api.Key{}, 0, 0); status.Code(err) != codes.Unimplemented {
+		t.Errorf("got error %v from a storage without history, want Unimplemented", err)
+	}
+}
@@ -1,72 +1,643 @@
 package simulator
 
 import (
+	"fmt"
 	"sync"
+	"time"
 
+	"github.com/Gimulator/Gimulator/pattern"
 	"github.com/Gimulator/Gimulator/storage"
 	"github.com/Gimulator/protobuf/go/api"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// Config holds the tunables of a Simulator.
+type Config struct {
+	// ChangeLogSize is the number of last changes kept for resuming watchers,
+	// zero disables resuming.
+	ChangeLogSize int
+	// WatchBufferSize is the number of events buffered for every watcher,
+	// zero means DefaultBufferSize.
+	WatchBufferSize int
+	// WatchPolicies is the policy for the watchers of every character, see
+	// Policy. Characters which are not listed get PolicyDropNewest.
+	WatchPolicies map[api.Character]Policy
+	// Recorder is told about every change, if it is not nil.
+	Recorder Recorder
+	// Seeded is the revision the storage was seeded with its initial state,
+	// see storage.SeedStorage, or zero. Restore replaces the initial state
+	// until anything else is written.
+	Seeded int64
+}
+
+// Recorder is told about every change of the storage, in the order of their
+// revisions. It is called with the write lock held, so it has to be quick and
+// must not call the simulator.
+type Recorder interface {
+	RecordEvent(event *Event)
+}
+
+// Simulator serializes writes to the storage and lets reads run concurrently.
+// Every write is spread to the watchers while the write lock is held, so
+// watchers observe changes in the same order as the storage does.
 type Simulator struct {
-	sync.Mutex
+	sync.RWMutex
 	spreader *spreader
 	storage  storage.MessageStorage
+	config   Config
+
+	// history is the storage if it keeps the history of messages, or nil.
+	history storage.HistoryStorage
+
+	// revision is increased by one for every change of the storage.
+	revision int64
+	changes  *changeLog
+
+	expiries *scheduler
+	log      *logrus.Entry
 }
 
-func NewSimulator(strg storage.MessageStorage) (*Simulator, error) {
-	return &Simulator{
-		Mutex:    sync.Mutex{},
+func NewSimulator(strg storage.MessageStorage, config Config) (*Simulator, error) {
+	revision, err := strg.LastRevision()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Simulator{
+		RWMutex:  sync.RWMutex{},
 		spreader: NewSpreader(),
 		storage:  strg,
-	}, nil
+		config:   config,
+		revision: revision,
+		changes:  newChangeLog(config.ChangeLogSize),
+		log:      logrus.WithField("component", "simulator"),
+	}
+	s.expiries = newScheduler(s.expire)
+	s.history, _ = strg.(storage.HistoryStorage)
+
+	if err := s.scheduleStoredExpiries(); err != nil {
+		s.expiries.Stop()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close stops the expiry of messages.
+func (s *Simulator) Close() {
+	s.expiries.Stop()
+}
+
+// Get returns the message stored with key and its revision.
+func (s *Simulator) Get(key *api.Key) (*api.Message, int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	mes, err := s.storage.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	revision, err := s.storage.GetRevision(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return mes, revision, nil
 }
 
-func (s *Simulator) Get(key *api.Key) (*api.Message, error) {
+func (s *Simulator) GetAll(key *api.Key) ([]*api.Message, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.getAll(key)
+}
+
+// GetAllWithRevisions is GetAll, but returns a put event for every message,
+// with the revision the message is stored with.
+func (s *Simulator) GetAllWithRevisions(key *api.Key) ([]*Event, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	messages, err := s.getAll(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.putEvents(messages)
+}
+
+// getAll is GetAll without locking. Storages only know exact values, so the
+// patterns of the key are matched here.
+func (s *Simulator) getAll(key *api.Key) ([]*api.Message, error) {
+	if !pattern.HasPattern(key) {
+		return s.storage.GetAll(key)
+	}
+
+	messages, err := s.storage.GetAll(pattern.Strip(key))
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*api.Message, 0)
+	for _, mes := range messages {
+		if pattern.MatchKey(key, mes.Key) {
+			res = append(res, mes)
+		}
+	}
+	return res, nil
+}
+
+// History returns the versions of the messages which match key after the
+// revision since, oldest first, and only the first limit of them if limit is
+// positive. It fails with Unimplemented if the storage keeps no history.
+func (s *Simulator) History(key *api.Key, since int64, limit int) ([]*storage.Version, error) {
+	if s.history == nil {
+		return nil, status.Error(codes.Unimplemented, "the storage does not keep the history of messages")
+	}
+
+	if !pattern.HasPattern(key) {
+		return s.history.GetHistory(key, since, limit)
+	}
+
+	// The limit is applied after matching the patterns.
+	versions, err := s.history.GetHistory(pattern.Strip(key), since, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*storage.Version, 0)
+	for _, version := range versions {
+		if limit > 0 && len(res) == limit {
+			break
+		}
+		if pattern.MatchKey(key, version.Message.Key) {
+			res = append(res, version)
+		}
+	}
+	return res, nil
+}
+
+func (s *Simulator) Revision() int64 {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.revision
+}
+
+func (s *Simulator) Put(mes *api.Message) error {
+	_, err := s.PutIf(mes, nil, 0)
+	return err
+}
+
+// PutIf puts the message only if cond holds for the message which is
+// currently stored with the same key, and returns the new revision. A nil
+// cond always holds. Since the check happens under the write lock, it works
+// the same for every storage. If ttl is positive, the message expires after
+// ttl unless it is written again before that.
+func (s *Simulator) PutIf(mes *api.Message, cond *Condition, ttl time.Duration) (int64, error) {
 	s.Lock()
 	defer s.Unlock()
 
-	return s.storage.Get(key)
+	if err := s.check(mes.Key, cond); err != nil {
+		return 0, err
+	}
+
+	change := newChange(OperationPut, mes.Key, mes, s.revision+1)
+	change.ExpiresAt = deadlineOf(ttl)
+	if err := s.storage.Apply([]*storage.Change{change}); err != nil {
+		return 0, err
+	}
+	s.commit(OperationPut, mes)
+	s.scheduleExpiry(mes.Key, change.ExpiresAt)
+
+	return s.revision, nil
 }
 
-func (s *Simulator) GetAll(key *api.Key) ([]*api.Message, error) {
+func (s *Simulator) Delete(key *api.Key) error {
 	s.Lock()
 	defer s.Unlock()
 
-	return s.storage.GetAll(key)
+	// The deleted message is fetched first so watchers know who owned it.
+	mes, err := s.storage.Get(key)
+	if status.Code(err) == codes.NotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := s.storage.Apply([]*storage.Change{newChange(OperationDelete, key, mes, s.revision+1)}); err != nil {
+		return err
+	}
+	s.commit(OperationDelete, mes)
+
+	return nil
 }
 
-func (s *Simulator) Put(mes *api.Message) error {
+func (s *Simulator) DeleteAll(key *api.Key) error {
+	return s.DeleteAllExcept(key, nil)
+}
+
+// DeleteAllExcept is like DeleteAll, but keeps the messages whose key except
+// reports true for. A nil except keeps nothing.
+func (s *Simulator) DeleteAllExcept(key *api.Key, except func(*api.Key) bool) error {
 	s.Lock()
 	defer s.Unlock()
 
-	if err := s.storage.Put(mes); err != nil {
+	messages, err := s.getAll(key)
+	if err != nil {
+		return err
+	}
+
+	if except != nil {
+		kept := messages[:0]
+		for _, mes := range messages {
+			if !except(mes.Key) {
+				kept = append(kept, mes)
+			}
+		}
+		messages = kept
+	}
+
+	// Every deleted message gets a revision of its own.
+	changes := make([]*storage.Change, 0, len(messages))
+	for i, mes := range messages {
+		changes = append(changes, newChange(OperationDelete, mes.Key, mes, s.revision+int64(i)+1))
+	}
+	if err := s.storage.Apply(changes); err != nil {
 		return err
 	}
-	s.spreader.Spread(mes)
+
+	for _, mes := range messages {
+		s.commit(OperationDelete, mes)
+	}
 
 	return nil
 }
 
-func (s *Simulator) Delete(key *api.Key) error {
+// Watch only registers the channel; the caller is responsible for draining
+// it without holding any lock of the simulator. The returned revision is the
+// one the events of the watcher come after.
+func (s *Simulator) Watch(key *api.Key, ch *Channel) (int64, error) {
 	s.Lock()
 	defer s.Unlock()
 
-	return s.storage.Delete(key)
+	if err := s.spreader.AddWatcher(key, ch); err != nil {
+		return 0, err
+	}
+	return s.revision, nil
 }
 
-func (s *Simulator) DeleteAll(key *api.Key) error {
+// WatchWithSnapshot registers the channel and returns a put event for every
+// message which currently matches the key, with the revision of the message,
+// in the same critical section, so no write can fall between the snapshot and
+// the first event of the watcher. The returned revision is the revision of the
+// snapshot.
+func (s *Simulator) WatchWithSnapshot(key *api.Key, ch *Channel) ([]*Event, int64, error) {
 	s.Lock()
 	defer s.Unlock()
 
-	return s.storage.DeleteAll(key)
+	messages, err := s.getAll(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	events, err := s.putEvents(messages)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := s.spreader.AddWatcher(key, ch); err != nil {
+		return nil, 0, err
+	}
+	return events, s.revision, nil
 }
 
-func (s *Simulator) Watch(key *api.Key, ch *Channel) error {
+// Snapshot returns a put event for every stored message, with the revision of
+// the message, and the current revision, in the same critical section.
+func (s *Simulator) Snapshot() ([]*Event, int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	messages, err := s.storage.GetAll(&api.Key{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	events, err := s.putEvents(messages)
+	if err != nil {
+		return nil, 0, err
+	}
+	return events, s.revision, nil
+}
+
+// putEvents returns a put event for every message, with the revision it is
+// stored with. It must be called with the lock held.
+func (s *Simulator) putEvents(messages []*api.Message) ([]*Event, error) {
+	events := make([]*Event, 0, len(messages))
+	for _, mes := range messages {
+		revision, err := s.storage.GetRevision(mes.Key)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, NewEvent(OperationPut, revision, mes))
+	}
+	return events, nil
+}
+
+// Expiries returns the deadlines of the stored messages which expire, or none
+// if the storage does not keep them.
+func (s *Simulator) Expiries() ([]*storage.Expiry, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	strg, ok := s.storage.(storage.ExpiryStorage)
+	if !ok {
+		return []*storage.Expiry{}, nil
+	}
+	return strg.GetExpiries()
+}
+
+// RestoredMessage is a message given to Restore, with the revision it was
+// written with and the deadline it expires at, which is zero if it does not
+// expire.
+type RestoredMessage struct {
+	Message   *api.Message
+	Revision  int64
+	ExpiresAt time.Time
+}
+
+// Restore stores the messages with their revisions and deadlines, and
+// continues from revision, which has to be at least the highest of them. It
+// fails with FailedPrecondition unless the simulator is fresh: nothing is
+// stored and nothing is written yet, or only the initial state is, which is
+// replaced then. The history gets a version of every removed and restored
+// message. Watchers are not told about the restored messages, they should
+// watch with a snapshot afterwards.
+func (s *Simulator) Restore(restored []*RestoredMessage, revision int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	messages, err := s.storage.GetAll(&api.Key{})
+	if err != nil {
+		return err
+	}
+	seeded := s.config.Seeded > 0 && s.revision == s.config.Seeded
+	if !seeded && (s.revision != 0 || len(messages) != 0) {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("could not restore, the simulator is not fresh: it has %d messages and its revision is %v", len(messages), s.revision))
+	}
+	if revision < s.revision {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("could not restore revision=%v, the initial state already has revision %v", revision, s.revision))
+	}
+
+	if err := ValidateRestore(restored, revision); err != nil {
+		return err
+	}
+
+	// The initial state is removed in the same transaction, at the revision
+	// it has.
+	changes := make([]*storage.Change, 0, len(messages)+len(restored))
+	for _, mes := range messages {
+		changes = append(changes, newChange(OperationDelete, mes.Key, mes, s.revision))
+	}
+	for _, r := range restored {
+		change := newChange(OperationPut, r.Message.Key, r.Message, r.Revision)
+		change.ExpiresAt = r.ExpiresAt
+		changes = append(changes, change)
+	}
+
+	// The revision is raised first, so a failed restore can only leave a
+	// gap in the revisions, never reuse one.
+	if err := s.storage.SetLastRevision(revision); err != nil {
+		return err
+	}
+	if err := s.storage.Apply(changes); err != nil {
+		return err
+	}
+	s.revision = revision
+
+	// Deadlines which passed since the snapshot expire right away.
+	for _, r := range restored {
+		if !r.ExpiresAt.IsZero() {
+			s.expiries.Schedule(&expiry{
+				deadline: r.ExpiresAt,
+				key:      r.Message.Key,
+				revision: r.Revision,
+			})
+		}
+	}
+
+	return nil
+}
+
+// ValidateRestore checks the messages of a restore up to revision without
+// touching the simulator, so a caller can check everything it restores
+// before it restores anything.
+func ValidateRestore(restored []*RestoredMessage, revision int64) error {
+	for _, r := range restored {
+		if r == nil || r.Message == nil || r.Message.Key == nil {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("could not restore message=%v without a key", r))
+		}
+		if r.Revision <= 0 || r.Revision > revision {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("could not restore message with key=%v, its revision=%v is not between 1 and %v", r.Message.Key, r.Revision, revision))
+		}
+	}
+	return nil
+}
+
+// WatchSince registers the channel and returns the events after revision
+// which match the key. It fails with OutOfRange if those events are not in
+// the change log anymore.
+func (s *Simulator) WatchSince(key *api.Key, revision int64, ch *Channel) ([]*Event, error) {
 	s.Lock()
 	defer s.Unlock()
 
+	if revision > s.revision {
+		return nil, status.Error(codes.OutOfRange, fmt.Sprintf("revision=%v is not reached yet, the current revision is %v", revision, s.revision))
+	}
+
+	changes, ok := s.changes.Since(revision, s.revision)
+	if !ok {
+		return nil, status.Error(codes.OutOfRange, fmt.Sprintf("revision=%v is compacted, the oldest revision in the change log is %v", revision, s.changes.Oldest()))
+	}
+
+	events := make([]*Event, 0)
+	for _, event := range changes {
+		if s.spreader.match(key, event.Message.Key) {
+			events = append(events, event)
+		}
+	}
+
 	if err := s.spreader.AddWatcher(key, ch); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Unwatch closes the channel and removes its watcher right away, instead of
+// waiting for the next Spread to notice the closed channel.
+func (s *Simulator) Unwatch(ch *Channel) {
+	ch.Close()
+	s.spreader.RemoveWatcher(ch)
+}
+
+// NewChannel returns a channel for a watcher of the character, with the
+// buffer size and policy which are configured for it.
+func (s *Simulator) NewChannel(character api.Character) *Channel {
+	policy, ok := s.config.WatchPolicies[character]
+	if !ok {
+		policy = PolicyDropNewest
+	}
+	return NewChannelWithPolicy(s.config.WatchBufferSize, policy)
+}
+
+// DroppedEvents returns the number of events which are dropped so far
+// because of slow watchers.
+func (s *Simulator) DroppedEvents() uint64 {
+	return s.spreader.Dropped()
+}
+
+// WatcherCount returns the number of watchers which are currently registered
+// in the room.
+func (s *Simulator) WatcherCount() int {
+	return s.spreader.Len()
+}
+
+// check returns FailedPrecondition if cond does not hold for the message
+// stored with key. It must be called with the write lock held.
+func (s *Simulator) check(key *api.Key, cond *Condition) error {
+	if cond == nil {
+		return nil
+	}
+
+	revision, err := s.storage.GetRevision(key)
+	if status.Code(err) == codes.NotFound {
+		if cond.Absent {
+			return nil
+		}
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("condition failed: message with key=%v does not exist", key))
+	} else if err != nil {
+		return err
+	}
+
+	if cond.Absent {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("condition failed: message with key=%v already exists", key))
+	}
+
+	if cond.Revision != 0 && cond.Revision != revision {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("condition failed: revision of message with key=%v is %v, not %v", key, revision, cond.Revision))
+	}
+
+	if cond.Owner != "" {
+		mes, err := s.storage.Get(key)
+		if err != nil {
+			return err
+		}
+		if owner := mes.GetMeta().GetOwner().GetName(); owner != cond.Owner {
+			return status.Error(codes.FailedPrecondition, fmt.Sprintf("condition failed: owner of message with key=%v is %v, not %v", key, owner, cond.Owner))
+		}
+	}
+
+	return nil
+}
+
+// expire removes the messages which are still stored with the revision they
+// were scheduled with, and spreads an expired event for each of them.
+func (s *Simulator) expire(expiries []*expiry) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, e := range expiries {
+		revision, err := s.storage.GetRevision(e.key)
+		if status.Code(err) == codes.NotFound || (err == nil && revision != e.revision) {
+			continue
+		} else if err != nil {
+			s.log.WithField("key", e.key.String()).WithError(err).Error("could not expire message")
+			continue
+		}
+
+		mes, err := s.storage.Get(e.key)
+		if err != nil {
+			s.log.WithField("key", e.key.String()).WithError(err).Error("could not expire message")
+			continue
+		}
+
+		if err := s.storage.Apply([]*storage.Change{newChange(OperationExpired, e.key, mes, s.revision+1)}); err != nil {
+			s.log.WithField("key", e.key.String()).WithError(err).Error("could not expire message")
+			continue
+		}
+		s.commit(OperationExpired, mes)
+	}
+}
+
+// scheduleExpiry schedules the expiry of the message which was just written
+// with key at deadline, if it is not zero. It must be called with the write
+// lock held, right after commit.
+func (s *Simulator) scheduleExpiry(key *api.Key, deadline time.Time) {
+	if deadline.IsZero() {
+		return
+	}
+
+	s.expiries.Schedule(&expiry{
+		deadline: deadline,
+		key:      key,
+		revision: s.revision,
+	})
+}
+
+// scheduleStoredExpiries schedules the deadlines kept by the storage, if it
+// keeps them, so messages expire after a restart too. Deadlines which passed
+// in the meantime expire right away.
+func (s *Simulator) scheduleStoredExpiries() error {
+	strg, ok := s.storage.(storage.ExpiryStorage)
+	if !ok {
+		return nil
+	}
+
+	stored, err := strg.GetExpiries()
+	if err != nil {
 		return err
 	}
+	for _, e := range stored {
+		s.expiries.Schedule(&expiry{
+			deadline: e.Deadline,
+			key:      e.Key,
+			revision: e.Revision,
+		})
+	}
 	return nil
 }
+
+// newChange returns the change which writes mes with the revision, or deletes
+// the message with key if op is not a put. mes is kept as the version of the
+// change, so the history is written together with the change.
+func newChange(op Operation, key *api.Key, mes *api.Message, revision int64) *storage.Change {
+	change := &storage.Change{
+		Key:      key,
+		Revision: revision,
+		Version: &storage.Version{
+			Operation: string(op),
+			Revision:  revision,
+			Time:      time.Now(),
+			Message:   mes,
+		},
+	}
+	if op == OperationPut {
+		change.Message = mes
+	}
+	return change
+}
+
+// commit bumps the revision after a change is stored, spreads its event and
+// tells the recorder about it. It must be called with the write lock held.
+func (s *Simulator) commit(op Operation, mes *api.Message) {
+	s.revision++
+
+	event := NewEvent(op, s.revision, mes)
+	s.changes.Append(event)
+	s.spreader.Spread(event)
+
+	if s.config.Recorder != nil {
+		s.config.Recorder.RecordEvent(event)
+	}
+}
@@ -3,93 +3,118 @@ package simulator
 import (
 	"sync"
 
+	"github.com/Gimulator/Gimulator/pattern"
 	"github.com/Gimulator/protobuf/go/api"
 	"github.com/sirupsen/logrus"
 )
 
-type Channel struct {
-	mux      sync.Mutex
-	Ch       chan *api.Message
-	IsClosed bool
-}
-
-func NewChannel() *Channel {
-	return &Channel{
-		Ch:       make(chan *api.Message, 128),
-		mux:      sync.Mutex{},
-		IsClosed: false,
-	}
-}
-
-func (c *Channel) Close() {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-
-	c.IsClosed = true
-}
-
-func (c *Channel) IsClose() bool {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-
-	return c.IsClosed
-}
-
 type watcher struct {
 	key     *api.Key
 	channel *Channel
 }
 
 type spreader struct {
+	mux      sync.Mutex
 	watchers []watcher
+	dropped  uint64
 	log      *logrus.Entry
 }
 
 func NewSpreader() *spreader {
 	return &spreader{
+		mux:      sync.Mutex{},
 		watchers: make([]watcher, 0),
 		log:      logrus.WithField("entity", "spreader"),
 	}
 }
 
 func (s *spreader) AddWatcher(key *api.Key, ch *Channel) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
 	s.watchers = append(s.watchers, watcher{
 		key:     key,
 		channel: ch,
 	})
 
+	s.log.WithField("watchers", len(s.watchers)).Debug("watcher is added")
 	return nil
 }
 
-func (s *spreader) Spread(message *api.Message) {
+func (s *spreader) RemoveWatcher(ch *Channel) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for i := 0; i < len(s.watchers); i++ {
+		if s.watchers[i].channel == ch {
+			s.removeAt(i)
+			return
+		}
+	}
+}
+
+// Dropped returns the number of events which are dropped so far because of
+// slow watchers, including the ones which are removed since.
+func (s *spreader) Dropped() uint64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.dropped
+}
+
+func (s *spreader) Len() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return len(s.watchers)
+}
+
+// Spread never blocks on a watcher, so it is safe to call while the
+// simulator holds its write lock. What happens to the events of a watcher
+// which does not keep up is decided by the policy of its channel.
+func (s *spreader) Spread(event *Event) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
 	for i := 0; i < len(s.watchers); i++ {
 		w := s.watchers[i]
 
 		if w.channel.IsClose() {
-			s.watchers[i] = s.watchers[len(s.watchers)-1]
-			s.watchers = s.watchers[:len(s.watchers)-1]
+			s.removeAt(i)
 			i--
 			continue
 		}
 
-		if s.match(w.key, message.Key) {
-			select {
-			case w.channel.Ch <- message:
-			default:
+		if s.match(w.key, event.Message.Key) {
+			dropped := w.channel.Send(event)
+			if dropped == 0 {
+				continue
+			}
+
+			s.dropped += uint64(dropped)
+			if w.channel.Dropped() == uint64(dropped) {
+				s.log.WithField("key", w.key.String()).WithField("policy", w.channel.policy).WithField("watchers", len(s.watchers)).WithField("dropped-total", s.dropped).Warn("watcher is too slow, starting to drop its events")
 			}
 		}
 	}
 }
 
-func (s *spreader) match(base, check *api.Key) bool {
-	if base.Type != "" && base.Type != check.Type {
-		return false
-	}
-	if base.Name != "" && base.Name != check.Name {
-		return false
+// removeAt removes the i-th watcher. A watcher which dropped events is logged
+// as a warning, with the number of events it dropped, so slow watchers are
+// visible without debug logs.
+func (s *spreader) removeAt(i int) {
+	w := s.watchers[i]
+	s.watchers[i] = s.watchers[len(s.watchers)-1]
+	s.watchers = s.watchers[:len(s.watchers)-1]
+
+	log := s.log.WithField("key", w.key.String()).WithField("watchers", len(s.watchers))
+	if dropped := w.channel.Dropped(); dropped > 0 {
+		log.WithField("dropped", dropped).WithField("dropped-total", s.dropped).Warn("watcher which dropped events is removed")
+		return
 	}
-	if base.Namespace != "" && base.Namespace != check.Namespace {
-		return false
-	}
-	return true
+	log.Debug("watcher is removed")
+}
+
+func (s *spreader) match(base, check *api.Key) bool {
+	return pattern.MatchKey(base, check)
 }
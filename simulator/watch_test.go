@@ -0,0 +1,334 @@
+package simulator
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnwatchRemovesWatcher(t *testing.T) {
+	sim, err := NewSimulator(storage.NewMemory(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := NewChannel(), NewChannel()
+	for _, ch := range []*Channel{first, second} {
+		if _, err := sim.Watch(&api.Key{Type: "cell"}, ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := sim.WatcherCount(); n != 2 {
+		t.Fatalf("got %d watchers, want 2", n)
+	}
+
+	sim.Unwatch(first)
+	if n := sim.WatcherCount(); n != 1 {
+		t.Fatalf("got %d watchers after unwatch, want 1", n)
+	}
+	if !first.IsClose() {
+		t.Error("channel of the removed watcher is not closed")
+	}
+
+	if err := sim.Put(newTestMessage("cell", "a")); err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Ch) != 0 {
+		t.Error("removed watcher received a message")
+	}
+	if len(second.Ch) != 1 {
+		t.Error("remaining watcher did not receive the message")
+	}
+
+	// Unwatching twice must be harmless.
+	sim.Unwatch(first)
+	if n := sim.WatcherCount(); n != 1 {
+		t.Fatalf("got %d watchers after second unwatch, want 1", n)
+	}
+}
+
+func TestDeleteEvents(t *testing.T) {
+	sim, err := NewSimulator(storage.NewMemory(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := sim.Put(newTestMessage("cell", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ch := NewChannel()
+	if _, err := sim.Watch(&api.Key{Type: "cell"}, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sim.Delete(&api.Key{Type: "cell", Name: "a", Namespace: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.DeleteAll(&api.Key{Type: "cell"}); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted := make(map[string]bool)
+	for len(ch.Ch) > 0 {
+		event := <-ch.Ch
+		if event.Operation != OperationDelete {
+			t.Errorf("got %v event, want %v", event.Operation, OperationDelete)
+		}
+		if deleted[event.Message.Key.Name] {
+			t.Errorf("got more than one delete event for %v", event.Message.Key.Name)
+		}
+		deleted[event.Message.Key.Name] = true
+	}
+
+	if len(deleted) != 3 {
+		t.Errorf("got delete events for %v, want a, b and c", deleted)
+	}
+}
+
+func TestWatchWithSnapshotHasNoGap(t *testing.T) {
+	const puts = 100
+
+	sim, err := NewSimulator(storage.NewMemory(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < puts; i++ {
+			if i == puts/4 {
+				close(started)
+			}
+			if err := sim.Put(newTestMessage("cell", fmt.Sprintf("%d", i))); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	<-started
+	ch := NewChannel()
+	snapshot, _, err := sim.WatchWithSnapshot(&api.Key{Type: "cell"}, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	seen := make(map[string]int)
+	for _, event := range snapshot {
+		seen[event.Message.Key.Name]++
+		if want := fmt.Sprintf("%d", event.Revision-1); event.Message.Key.Name != want {
+			t.Errorf("got revision %d for message %v of the snapshot, want the one it is put with", event.Revision, event.Message.Key.Name)
+		}
+	}
+	for len(ch.Ch) > 0 {
+		event := <-ch.Ch
+		seen[event.Message.Key.Name]++
+	}
+
+	for i := 0; i < puts; i++ {
+		if n := seen[fmt.Sprintf("%d", i)]; n != 1 {
+			t.Errorf("message %d is seen %d times, want exactly once", i, n)
+		}
+	}
+}
+
+func TestWatchSince(t *testing.T) {
+	sim, err := NewSimulator(storage.NewMemory(), Config{ChangeLogSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 6; i++ {
+		if err := sim.Put(newTestMessage("cell", fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rev := sim.Revision(); rev != 6 {
+		t.Fatalf("got revision %d, want 6", rev)
+	}
+
+	events, err := sim.WatchSince(&api.Key{Type: "cell"}, 3, NewChannel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 3", len(events))
+	}
+	for i, event := range events {
+		if event.Revision != int64(4+i) {
+			t.Errorf("got revision %d at %d, want %d", event.Revision, i, 4+i)
+		}
+	}
+
+	if _, err := sim.WatchSince(&api.Key{Type: "cell"}, 6, NewChannel()); err != nil {
+		t.Errorf("watching since the current revision failed: %v", err)
+	}
+
+	// Revisions 1 and 2 are not in the change log anymore.
+	if _, err := sim.WatchSince(&api.Key{Type: "cell"}, 1, NewChannel()); status.Code(err) != codes.OutOfRange {
+		t.Errorf("got %v for a compacted revision, want OutOfRange", err)
+	}
+	if _, err := sim.WatchSince(&api.Key{Type: "cell"}, 7, NewChannel()); status.Code(err) != codes.OutOfRange {
+		t.Errorf("got %v for a future revision, want OutOfRange", err)
+	}
+}
+
+func TestRevisionSurvivesRestart(t *testing.T) {
+	strg := storage.NewMemory()
+	sim, err := NewSimulator(strg, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := sim.Put(newTestMessage("cell", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sim.Delete(&api.Key{Type: "cell", Name: "a", Namespace: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.DeleteAll(&api.Key{Type: "cell"}); err != nil {
+		t.Fatal(err)
+	}
+	if rev := sim.Revision(); rev != 6 {
+		t.Fatalf("got revision %d, want 6", rev)
+	}
+
+	// The last changes are deletes, whose revisions no message keeps.
+	restarted, err := NewSimulator(strg, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev := restarted.Revision(); rev != 6 {
+		t.Errorf("got revision %d after restart, want 6", rev)
+	}
+
+	fresh := storage.NewMemory()
+	sim, err = NewSimulator(fresh, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Restore([]*RestoredMessage{{Message: newTestMessage("cell", "a"), Revision: 3}}, 10); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err = NewSimulator(fresh, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev := restarted.Revision(); rev != 10 {
+		t.Errorf("got revision %d after restoring and restarting, want 10", rev)
+	}
+}
+
+func TestPatternKeys(t *testing.T) {
+	sim, err := NewSimulator(storage.NewMemory(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := NewChannel()
+	if _, err := sim.Watch(&api.Key{Name: "cell-*"}, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"cell-1", "cell-2", "row-1"} {
+		if err := sim.Put(newTestMessage("board", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ch.Ch) != 2 {
+		t.Errorf("watcher of cell-* received %d events, want 2", len(ch.Ch))
+	}
+
+	messages, err := sim.GetAll(&api.Key{Type: "board", Name: "re:cell-[0-9]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("got %d messages for re:cell-[0-9], want 2", len(messages))
+	}
+
+	if err := sim.DeleteAll(&api.Key{Name: "cell-?"}); err != nil {
+		t.Fatal(err)
+	}
+	messages, err = sim.GetAll(&api.Key{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Key.Name != "row-1" {
+		t.Errorf("got %v after deleting cell-?, want only row-1", messages)
+	}
+}
+
+func TestDeleteAllExcept(t *testing.T) {
+	sim, err := NewSimulator(storage.NewMemory(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"cell-1", "hidden-1"} {
+		if err := sim.Put(newTestMessage("board", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	except := func(key *api.Key) bool { return key.Name == "hidden-1" }
+	if err := sim.DeleteAllExcept(&api.Key{Type: "board"}, except); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := sim.GetAll(&api.Key{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Key.Name != "hidden-1" {
+		t.Errorf("got %v, want only hidden-1", messages)
+	}
+}
+
+func TestDroppedEventsAreLogged(t *testing.T) {
+	sim, err := NewSimulator(storage.NewMemory(), Config{WatchBufferSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, hook := test.NewNullLogger()
+	sim.spreader.log = logger.WithField("entity", "spreader")
+
+	ch := sim.NewChannel(api.Character_actor)
+	if _, err := sim.Watch(&api.Key{Type: "cell"}, ch); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sim.Put(newTestMessage("cell", fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sim.Unwatch(ch)
+
+	warnings := make([]*logrus.Entry, 0)
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.WarnLevel {
+			warnings = append(warnings, entry)
+		}
+	}
+	if len(warnings) != 2 {
+		t.Fatalf("got %d warnings, want one when the watcher starts to drop and one when it is removed", len(warnings))
+	}
+	if total := warnings[0].Data["dropped-total"]; total != uint64(1) {
+		t.Errorf("got dropped-total=%v when the watcher starts to drop, want 1", total)
+	}
+	if dropped, watchers := warnings[1].Data["dropped"], warnings[1].Data["watchers"]; dropped != uint64(2) || watchers != 0 {
+		t.Errorf("got dropped=%v and watchers=%v when the watcher is removed, want 2 and 0", dropped, watchers)
+	}
+}
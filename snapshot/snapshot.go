@@ -0,0 +1,231 @@
+// Package snapshot exports the state of a match to a portable file and
+// restores it into a fresh Gimulator: every message with its revision, and the
+// status and readiness of every user. It works with any storage, since it only
+// uses the simulator and storage.UserStorage.
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Gimulator/Gimulator/simulator"
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// Snapshot is the state of a match at Revision. Its fields are plain values
+// rather than the messages of the protobuf package, so it reads the same as
+// JSON and as YAML.
+type Snapshot struct {
+	Revision int64     `json:"revision" yaml:"revision"`
+	Time     time.Time `json:"time" yaml:"time"`
+	Messages []Message `json:"messages" yaml:"messages"`
+	Users    []User    `json:"users" yaml:"users"`
+}
+
+type Message struct {
+	Type      string `json:"type" yaml:"type"`
+	Name      string `json:"name" yaml:"name"`
+	Namespace string `json:"namespace" yaml:"namespace"`
+	Content   string `json:"content" yaml:"content"`
+	Owner     string `json:"owner" yaml:"owner"`
+	Revision  int64  `json:"revision" yaml:"revision"`
+	// ExpiresAt is the deadline of a message put with a time-to-live.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" yaml:"expiresAt,omitempty"`
+}
+
+type User struct {
+	Name      string `json:"name" yaml:"name"`
+	Readiness bool   `json:"readiness" yaml:"readiness"`
+	Status    string `json:"status" yaml:"status"`
+}
+
+// Take returns the current state of sim and users.
+func Take(sim *simulator.Simulator, users storage.UserStorage) (*Snapshot, error) {
+	events, revision, err := sim.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	expiries, err := sim.Expiries()
+	if err != nil {
+		return nil, err
+	}
+	// A deadline belongs to the message only if it is still stored with the
+	// revision the deadline was set with.
+	deadlines := make(map[[3]string]*storage.Expiry)
+	for _, e := range expiries {
+		deadlines[[3]string{e.Key.Type, e.Key.Name, e.Key.Namespace}] = e
+	}
+
+	apiUsers, err := users.GetUsers(nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{
+		Revision: revision,
+		Time:     time.Now().UTC(),
+		Messages: make([]Message, 0, len(events)),
+		Users:    make([]User, 0, len(apiUsers)),
+	}
+	for _, event := range events {
+		mes := Message{
+			Type:      event.Message.Key.Type,
+			Name:      event.Message.Key.Name,
+			Namespace: event.Message.Key.Namespace,
+			Content:   event.Message.Content,
+			Owner:     event.Message.GetMeta().GetOwner().GetName(),
+			Revision:  event.Revision,
+		}
+		if e, ok := deadlines[[3]string{mes.Type, mes.Name, mes.Namespace}]; ok && e.Revision == event.Revision {
+			deadline := e.Deadline.UTC()
+			mes.ExpiresAt = &deadline
+		}
+		snap.Messages = append(snap.Messages, mes)
+	}
+	for _, user := range apiUsers {
+		snap.Users = append(snap.Users, User{
+			Name:      user.Name,
+			Readiness: user.Readiness,
+			Status:    user.Status.String(),
+		})
+	}
+	return snap, nil
+}
+
+// Restore loads the snapshot into sim and users, see simulator.Restore. The
+// whole snapshot is checked before anything is restored, and the users are
+// put back as they were if the messages can not be restored.
+func (s *Snapshot) Restore(sim *simulator.Simulator, users storage.UserStorage) error {
+	owners := make(map[string]*api.User)
+	for _, user := range s.Users {
+		apiUser, err := users.GetUserWithName(user.Name)
+		if status.Code(err) == codes.NotFound {
+			return status.Error(codes.FailedPrecondition, fmt.Sprintf("could not restore user with name=%v, it is not in the config", user.Name))
+		} else if err != nil {
+			return err
+		}
+		if _, ok := api.Status_value[user.Status]; !ok {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("could not restore user with name=%v, its status %q is unknown", user.Name, user.Status))
+		}
+		owners[user.Name] = apiUser
+	}
+
+	restored := make([]*simulator.RestoredMessage, 0, len(s.Messages))
+	for _, mes := range s.Messages {
+		owner, ok := owners[mes.Owner]
+		if !ok {
+			// The owner may be removed from the config since the message is put.
+			owner = &api.User{Name: mes.Owner}
+		}
+		r := &simulator.RestoredMessage{
+			Message: &api.Message{
+				Key: &api.Key{
+					Type:      mes.Type,
+					Name:      mes.Name,
+					Namespace: mes.Namespace,
+				},
+				Meta:    &api.Meta{Owner: owner},
+				Content: mes.Content,
+			},
+			Revision: mes.Revision,
+		}
+		if mes.ExpiresAt != nil {
+			r.ExpiresAt = *mes.ExpiresAt
+		}
+		restored = append(restored, r)
+	}
+	if err := simulator.ValidateRestore(restored, s.Revision); err != nil {
+		return err
+	}
+
+	// The users are updated first, since they can be put back, and the
+	// messages are restored in a single transaction.
+	previous := make([]*api.User, 0, len(s.Users))
+	for _, user := range s.Users {
+		previous = append(previous, owners[user.Name])
+	}
+	if err := updateUsers(users, s.Users); err != nil {
+		restoreUsers(users, previous)
+		return err
+	}
+	if err := sim.Restore(restored, s.Revision); err != nil {
+		restoreUsers(users, previous)
+		return err
+	}
+	return nil
+}
+
+func updateUsers(users storage.UserStorage, snapUsers []User) error {
+	for _, user := range snapUsers {
+		if err := users.UpdateUserReadiness(user.Name, user.Readiness); err != nil {
+			return err
+		}
+		if err := users.UpdateUserStatus(user.Name, api.Status(api.Status_value[user.Status])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreUsers puts the readiness and status of the users back after a failed
+// restore. Its errors are ignored, the error of the restore is the one which
+// is returned.
+func restoreUsers(users storage.UserStorage, previous []*api.User) {
+	for _, user := range previous {
+		users.UpdateUserReadiness(user.Name, user.Readiness)
+		users.UpdateUserStatus(user.Name, user.Status)
+	}
+}
+
+// isYAML reports whether path is a YAML file, by its extension. Everything
+// else is JSON.
+func isYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// Marshal encodes the snapshot the way WriteFile writes it to path.
+func (s *Snapshot) Marshal(path string) ([]byte, error) {
+	if isYAML(path) {
+		return yaml.Marshal(s)
+	}
+	return json.MarshalIndent(s, "", "  ")
+}
+
+// WriteFile writes the snapshot to path, as YAML if its extension is .yaml or
+// .yml and as JSON otherwise.
+func (s *Snapshot) WriteFile(path string) error {
+	data, err := s.Marshal(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// ReadFile reads a snapshot which is written by WriteFile.
+func ReadFile(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{}
+	if isYAML(path) {
+		err = yaml.Unmarshal(data, snap)
+	} else {
+		err = json.Unmarshal(data, snap)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return snap, nil
+}
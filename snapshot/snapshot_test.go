@@ -0,0 +1,368 @@
+package snapshot
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Gimulator/Gimulator/config"
+	"github.com/Gimulator/Gimulator/simulator"
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var testConfig = &config.Config{
+	Credentials: []config.Credential{
+		{Name: "director", Token: "director-token", Character: "director", Role: "director"},
+		{Name: "actor1", Token: "actor1-token", Character: "actor", Role: "red"},
+	},
+}
+
+var testStorages = []struct {
+	name string
+	new  func(t *testing.T) storage.Storage
+}{
+	{"memory", func(t *testing.T) storage.Storage {
+		m, err := storage.NewMemoryWithConfig(testConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}},
+	{"sqlite", func(t *testing.T) storage.Storage {
+		s, err := storage.NewSqlite("", testConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}},
+}
+
+func newTestSimulator(t *testing.T, strg storage.Storage) *simulator.Simulator {
+	t.Helper()
+	sim, err := simulator.NewSimulator(strg, simulator.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sim
+}
+
+func put(t *testing.T, sim *simulator.Simulator, name, content string) {
+	t.Helper()
+	err := sim.Put(&api.Message{
+		Key:     &api.Key{Type: "cell", Name: name, Namespace: "board"},
+		Meta:    &api.Meta{Owner: &api.User{Name: "actor1"}},
+		Content: content,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTakeAndRestore(t *testing.T) {
+	for _, from := range testStorages {
+		for _, to := range testStorages {
+			for _, file := range []string{"snapshot.json", "snapshot.yaml"} {
+				t.Run(from.name+"-"+to.name+"-"+file, func(t *testing.T) {
+					testTakeAndRestore(t, from.new(t), to.new(t), filepath.Join(t.TempDir(), file))
+				})
+			}
+		}
+	}
+}
+
+func testTakeAndRestore(t *testing.T, from, to storage.Storage, path string) {
+	sim := newTestSimulator(t, from)
+	put(t, sim, "cell-1", "x")
+	put(t, sim, "cell-2", "o")
+	put(t, sim, "cell-1", "xx")
+	if err := sim.Delete(&api.Key{Type: "cell", Name: "cell-2", Namespace: "board"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.UpdateUserReadiness("actor1", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.UpdateUserStatus("actor1", api.Status_running); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := Take(sim, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	snap, err = ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestSimulator(t, to)
+	if err := snap.Restore(restored, to); err != nil {
+		t.Fatal(err)
+	}
+
+	if revision := restored.Revision(); revision != 4 {
+		t.Errorf("got revision %v, want 4", revision)
+	}
+	mes, revision, err := restored.Get(&api.Key{Type: "cell", Name: "cell-1", Namespace: "board"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mes.Content != "xx" || revision != 3 || mes.Meta.Owner.Name != "actor1" || mes.Meta.Owner.Character != api.Character_actor {
+		t.Errorf("got message %v with revision %v, want the one of the snapshot", mes, revision)
+	}
+	if messages, err := restored.GetAll(&api.Key{}); err != nil || len(messages) != 1 {
+		t.Errorf("got %d messages, %v, want 1", len(messages), err)
+	}
+
+	user, err := to.GetUserWithName("actor1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Readiness || user.Status != api.Status_running {
+		t.Errorf("got user %v, want the readiness and status of the snapshot", user)
+	}
+
+	// Writes continue after the revision of the snapshot.
+	put(t, restored, "cell-3", "x")
+	if revision := restored.Revision(); revision != 5 {
+		t.Errorf("got revision %v after a put, want 5", revision)
+	}
+}
+
+func newSeededConfig() *config.Config {
+	return &config.Config{
+		Credentials: testConfig.Credentials,
+		InitialState: []config.InitialMessage{
+			{Key: api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}, Content: "empty", Owner: "director"},
+			{Key: api.Key{Type: "cell", Name: "cell-9", Namespace: "board"}, Content: "empty", Owner: "director"},
+		},
+	}
+}
+
+func TestRestoreOverInitialState(t *testing.T) {
+	seeded := newSeededConfig()
+	seededStorages := []struct {
+		name string
+		new  func(t *testing.T) storage.Storage
+	}{
+		{"memory", func(t *testing.T) storage.Storage {
+			m, err := storage.NewMemoryWithConfig(seeded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return m
+		}},
+		{"sqlite", func(t *testing.T) storage.Storage {
+			s, err := storage.NewSqlite("", seeded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		}},
+	}
+
+	for _, seededStorage := range seededStorages {
+		newStorage := seededStorage.new
+		t.Run(seededStorage.name, func(t *testing.T) {
+			from := newStorage(t)
+			sim := newSeededSimulator(t, from)
+			put(t, sim, "cell-1", "x")
+			if err := sim.Delete(&api.Key{Type: "cell", Name: "cell-9", Namespace: "board"}); err != nil {
+				t.Fatal(err)
+			}
+			snap, err := Take(sim, from)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			to := newStorage(t)
+			restored := newSeededSimulator(t, to)
+			if err := snap.Restore(restored, to); err != nil {
+				t.Fatalf("could not restore over the initial state: %v", err)
+			}
+			if revision := restored.Revision(); revision != 4 {
+				t.Errorf("got revision %v, want 4", revision)
+			}
+			messages, err := restored.GetAll(&api.Key{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 1 || messages[0].Content != "x" {
+				t.Errorf("got messages %v, want only the one of the snapshot", messages)
+			}
+			versions, err := to.GetHistory(&api.Key{Name: "cell-9"}, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(versions) != 2 || versions[1].Operation != string(simulator.OperationDelete) {
+				t.Errorf("got history %v of cell-9, want its seeded put and its delete by the restore", versions)
+			}
+
+			// Once something is written, the initial state is not replaced.
+			to = newStorage(t)
+			restored = newSeededSimulator(t, to)
+			put(t, restored, "cell-2", "o")
+			if err := snap.Restore(restored, to); status.Code(err) != codes.FailedPrecondition {
+				t.Errorf("got error %v after a write, want FailedPrecondition", err)
+			}
+		})
+	}
+}
+
+// newSeededSimulator returns a simulator which knows what the storage was
+// seeded with, like the one of Gimulator.
+func newSeededSimulator(t *testing.T, strg storage.Storage) *simulator.Simulator {
+	t.Helper()
+	seeded, err := strg.SeededRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim, err := simulator.NewSimulator(strg, simulator.Config{Seeded: seeded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sim
+}
+
+func TestRestoreKeepsResumedState(t *testing.T) {
+	dsn, err := storage.SqliteDSN(filepath.Join(t.TempDir(), "data.db"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strg, err := storage.NewSqlite(dsn, testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim := newSeededSimulator(t, strg)
+	put(t, sim, "cell-1", "live")
+	put(t, sim, "cell-2", "live")
+	sim.Close()
+	if err := strg.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The match is resumed at revision 2 with an initial state of two
+	// messages, which is not seeded into it.
+	strg, err = storage.NewSqlite(dsn, newSeededConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer strg.Close()
+	sim = newSeededSimulator(t, strg)
+
+	snap := &Snapshot{Revision: 1, Messages: []Message{{Type: "cell", Name: "cell-3", Namespace: "board", Owner: "actor1", Revision: 1}}}
+	if err := snap.Restore(sim, strg); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got error %v for a resumed match, want FailedPrecondition", err)
+	}
+	if messages, err := sim.GetAll(&api.Key{}); err != nil || len(messages) != 2 || messages[0].Content != "live" {
+		t.Errorf("got messages %v, %v after a refused restore, want the live ones", messages, err)
+	}
+}
+
+func TestRestoreErrors(t *testing.T) {
+	newSnapshot := func() *Snapshot {
+		return &Snapshot{
+			Revision: 2,
+			Messages: []Message{{Type: "cell", Name: "cell-1", Namespace: "board", Owner: "actor1", Revision: 2}},
+			Users:    []User{{Name: "actor1", Status: "running"}},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(snap *Snapshot)
+		fresh  bool
+		want   codes.Code
+	}{
+		{"not fresh", func(snap *Snapshot) {}, false, codes.FailedPrecondition},
+		{"unknown user", func(snap *Snapshot) { snap.Users[0].Name = "ghost" }, true, codes.FailedPrecondition},
+		{"unknown status", func(snap *Snapshot) { snap.Users[0].Status = "sleeping" }, true, codes.InvalidArgument},
+		{"revision after snapshot", func(snap *Snapshot) { snap.Messages[0].Revision = 3 }, true, codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		strg := testStorages[0].new(t)
+		sim := newTestSimulator(t, strg)
+		if !test.fresh {
+			put(t, sim, "cell-2", "x")
+		}
+
+		snap := newSnapshot()
+		test.change(snap)
+		if err := snap.Restore(sim, strg); status.Code(err) != test.want {
+			t.Errorf("%v: got error %v, want %v", test.name, err, test.want)
+		}
+		if test.fresh {
+			if messages, _ := sim.GetAll(&api.Key{}); len(messages) != 0 {
+				t.Errorf("%v: a failed restore stored %d messages", test.name, len(messages))
+			}
+		}
+		if user, err := strg.GetUserWithName("actor1"); err != nil || user.Status != api.Status_unknown {
+			t.Errorf("%v: got user %v, %v after a failed restore, want it unchanged", test.name, user, err)
+		}
+	}
+}
+
+func TestRestoreHistoryAndDeadlines(t *testing.T) {
+	for _, to := range testStorages {
+		t.Run(to.name, func(t *testing.T) {
+			from := testStorages[0].new(t)
+			sim := newTestSimulator(t, from)
+			defer sim.Close()
+			put(t, sim, "cell-1", "x")
+			ping := &api.Message{
+				Key:  &api.Key{Type: "ping", Name: "actor1", Namespace: "board"},
+				Meta: &api.Meta{Owner: &api.User{Name: "actor1"}},
+			}
+			if _, err := sim.PutIf(ping, nil, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+
+			snap, err := Take(sim, from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "snapshot.json")
+			if err := snap.WriteFile(path); err != nil {
+				t.Fatal(err)
+			}
+			if snap, err = ReadFile(path); err != nil {
+				t.Fatal(err)
+			}
+
+			strg := to.new(t)
+			restored := newTestSimulator(t, strg)
+			defer restored.Close()
+			if err := snap.Restore(restored, strg); err != nil {
+				t.Fatal(err)
+			}
+
+			versions, err := strg.GetHistory(&api.Key{}, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(versions) != 2 || versions[0].Operation != "put" || versions[1].Operation != "put" {
+				t.Errorf("got history %v, want a put version of every restored message", versions)
+			}
+
+			expiries, err := restored.Expiries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(expiries) != 1 || expiries[0].Key.Type != "ping" || expiries[0].Revision != 2 {
+				t.Fatalf("got deadlines %v, want the one of ping", expiries)
+			}
+			if until := time.Until(expiries[0].Deadline); until < 59*time.Minute || until > time.Hour {
+				t.Errorf("got deadline in %v, want the one of the snapshot, in about an hour", until)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/Gimulator/Gimulator/config"
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+// forEachRule calls f for every method of every rule of the config, with the
+// character and role the rule belongs to. The role of the characters other
+// than actor is the name of the character.
+func forEachRule(conf *config.Config, f func(character api.Character, role string, rule *config.Rule, method api.Method)) {
+	for role, rules := range conf.Character.Actors {
+		for i := range rules {
+			for _, method := range rules[i].Methods {
+				f(api.Character_actor, role, &rules[i], api.Method(method))
+			}
+		}
+	}
+
+	groups := []struct {
+		character api.Character
+		rules     []config.Rule
+	}{
+		{api.Character_director, conf.Character.Director},
+		{api.Character_operator, conf.Character.Operator},
+		{api.Character_master, conf.Character.Master},
+	}
+	for _, group := range groups {
+		role := api.Character_name[int32(group.character)]
+		for i := range group.rules {
+			for _, method := range group.rules[i].Methods {
+				f(group.character, role, &group.rules[i], api.Method(method))
+			}
+		}
+	}
+}
+
+// seedMarker is a storage which remembers the revision it was seeded with, see
+// SeedStorage.
+type seedMarker interface {
+	markSeeded(revision int64) error
+}
+
+// seed puts the initial state of the config into s, with the revisions 1, 2,
+// and so on, and adds them to its history if it keeps one. Nothing is put if
+// anything was ever stored in s, so a resumed storage is not seeded again.
+func seed(s MessageStorage, conf *config.Config) error {
+	if len(conf.InitialState) == 0 {
+		return nil
+	}
+
+	revision, err := s.LastRevision()
+	if err != nil {
+		return err
+	}
+	if revision != 0 {
+		return nil
+	}
+
+	owners := make(map[string]*api.User)
+	for _, cred := range conf.Credentials {
+		owners[cred.Name] = &api.User{
+			Name:      cred.Name,
+			Character: api.Character(api.Character_value[cred.Character]),
+			Role:      cred.Role,
+		}
+	}
+
+	now := time.Now()
+	changes := make([]*Change, 0, len(conf.InitialState))
+	for i := range conf.InitialState {
+		initial := &conf.InitialState[i]
+		mes := &api.Message{
+			Key: &api.Key{
+				Type:      initial.Key.Type,
+				Name:      initial.Key.Name,
+				Namespace: initial.Key.Namespace,
+			},
+			Meta:    &api.Meta{Owner: owners[initial.Owner]},
+			Content: initial.Content,
+		}
+		changes = append(changes, &Change{
+			Key:      mes.Key,
+			Message:  mes,
+			Revision: int64(i + 1),
+			Version:  &Version{Operation: "put", Revision: int64(i + 1), Time: now, Message: mes},
+		})
+	}
+
+	if err := s.Apply(changes); err != nil {
+		return err
+	}
+
+	// A crash before the mark only makes the initial state irreplaceable.
+	if marker, ok := s.(seedMarker); ok {
+		return marker.markSeeded(int64(len(changes)))
+	}
+	return nil
+}
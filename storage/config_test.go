@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Gimulator/Gimulator/config"
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+func newTestSeedConfig() *config.Config {
+	conf := newTestConfig()
+	conf.InitialState = []config.InitialMessage{
+		{Key: api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}, Content: "x", Owner: "director"},
+		{Key: api.Key{Type: "cell", Name: "cell-2", Namespace: "board"}, Content: "o", Owner: "actor1"},
+	}
+	return conf
+}
+
+func checkSeed(t *testing.T, s Storage) {
+	t.Helper()
+
+	mes, err := s.Get(&api.Key{Type: "cell", Name: "cell-2", Namespace: "board"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := mes.Meta.Owner; mes.Content != "o" || owner.Name != "actor1" || owner.Character != api.Character_actor || owner.Role != "red" {
+		t.Errorf("got message %v, want the one of the initial state", mes)
+	}
+	if revision, err := s.GetRevision(mes.Key); err != nil || revision != 2 {
+		t.Errorf("got revision %v, %v, want 2", revision, err)
+	}
+	if seeded, err := s.SeededRevision(); err != nil || seeded != 2 {
+		t.Errorf("got seeded revision %v, %v, want 2", seeded, err)
+	}
+
+	versions, err := s.GetHistory(&api.Key{}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Operation != "put" || versions[0].Message.Content != "x" {
+		t.Errorf("got history %v, want the initial state", versions)
+	}
+}
+
+func TestMemorySeed(t *testing.T) {
+	m, err := NewMemoryWithConfig(newTestSeedConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSeed(t, m)
+}
+
+func TestSqliteSeed(t *testing.T) {
+	dsn, err := SqliteDSN(filepath.Join(t.TempDir(), "data.db"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSqlite(dsn, newTestSeedConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSeed(t, s)
+
+	key := &api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}
+	if err := s.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A resumed database is not seeded again.
+	s, err = NewSqlite(dsn, newTestSeedConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Get(key); err == nil {
+		t.Error("the initial state is put again after restart")
+	}
+	if seeded, err := s.SeededRevision(); err != nil || seeded != 2 {
+		t.Errorf("got seeded revision %v, %v after restart, want 2", seeded, err)
+	}
+}
+
+func TestSqliteResumedWithoutSeed(t *testing.T) {
+	dsn, err := SqliteDSN(filepath.Join(t.TempDir(), "data.db"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSqlite(dsn, newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := &api.Meta{Owner: &api.User{Name: "actor1"}}
+	for i, name := range []string{"cell-1", "cell-3"} {
+		key := &api.Key{Type: "cell", Name: name, Namespace: "board"}
+		if err := s.Put(&api.Message{Key: key, Meta: owner, Content: "live"}, int64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The revision equals the size of the initial state, yet nothing is
+	// seeded.
+	s, err = NewSqlite(dsn, newTestSeedConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if seeded, err := s.SeededRevision(); err != nil || seeded != 0 {
+		t.Errorf("got seeded revision %v, %v for a resumed database, want 0", seeded, err)
+	}
+	if _, err := s.Get(&api.Key{Type: "cell", Name: "cell-2", Namespace: "board"}); err == nil {
+		t.Error("a resumed database is seeded")
+	}
+}
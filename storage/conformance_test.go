@@ -0,0 +1,43 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/Gimulator/Gimulator/config"
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/Gimulator/storage/storagetest"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	storagetest.TestMessageStorage(t, func(t *testing.T) storage.MessageStorage {
+		return storage.NewMemory()
+	})
+}
+
+func TestSqliteConformance(t *testing.T) {
+	storagetest.TestMessageStorage(t, func(t *testing.T) storage.MessageStorage {
+		s, err := storage.NewSqlite("", &config.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestMemoryHistoryConformance(t *testing.T) {
+	storagetest.TestHistoryStorage(t, func(t *testing.T) storage.HistoryStorage {
+		return storage.NewMemory()
+	})
+}
+
+func TestSqliteHistoryConformance(t *testing.T) {
+	storagetest.TestHistoryStorage(t, func(t *testing.T) storage.HistoryStorage {
+		s, err := storage.NewSqlite("", &config.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
@@ -1,15 +1,120 @@
 package storage
 
 import (
+	"fmt"
+	"time"
+
+	"github.com/Gimulator/Gimulator/config"
 	"github.com/Gimulator/protobuf/go/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// MessageStorage stores the messages together with their revisions. Revisions
+// are assigned by the caller and only have to be kept, not generated. An
+// implementation has to be safe for concurrent use, and storagetest checks
+// that it behaves like the ones of this package.
 type MessageStorage interface {
-	Put(message *api.Message) error
+	// Put stores the message, replacing the one with the same key. The
+	// message has an owner, and its creation time is set by the storage.
+	Put(message *api.Message, revision int64) error
+	// Delete deletes the message with the key, if there is any.
 	Delete(key *api.Key) error
+	// DeleteAll deletes the messages which match the key, where an empty
+	// field matches anything.
 	DeleteAll(key *api.Key) error
+	// Get returns the message with the key, or a NotFound error.
 	Get(key *api.Key) (*api.Message, error)
+	// GetAll returns the messages which match the key, where an empty field
+	// matches anything.
 	GetAll(key *api.Key) ([]*api.Message, error)
+	// GetRevision returns the revision of the message with the key, or a
+	// NotFound error.
+	GetRevision(key *api.Key) (int64, error)
+	// LastRevision returns the highest revision stored so far, including the
+	// revisions of deletes and the ones set by SetLastRevision, so it never
+	// goes backwards.
+	LastRevision() (int64, error)
+	// SetLastRevision raises the last revision to revision, even if no
+	// message is stored with it. A lower revision is ignored.
+	SetLastRevision(revision int64) error
+
+	// Apply applies all the changes in order, or none of them.
+	Apply(changes []*Change) error
+}
+
+// Change is a single write of a transaction. A change with a nil Message
+// deletes the message stored with Key, if there is any. Revision is the
+// revision of the write, for deletes too, and is kept as the last revision.
+// A storage which keeps history adds Version, if it is not nil, in the same
+// transaction, so the history never misses a write. A put with a non-zero
+// ExpiresAt expires then, see ExpiryStorage.
+type Change struct {
+	Key       *api.Key
+	Message   *api.Message
+	Revision  int64
+	Version   *Version
+	ExpiresAt time.Time
+}
+
+// validateChanges rejects the changes which can not be applied, so a storage
+// can check a transaction before applying any of it.
+func validateChanges(changes []*Change) error {
+	for _, change := range changes {
+		if change == nil || change.Key == nil || (change.Message != nil && (change.Message.Key == nil || change.Message.Meta == nil || change.Message.Meta.Owner == nil)) {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("could not apply change=%v without a key or an owner", change))
+		}
+		if change.Version != nil {
+			if err := validateVersion(change.Version); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Version is a change of a message kept by a HistoryStorage. For deletes,
+// Message is the last version of the deleted message.
+type Version struct {
+	Operation string
+	Revision  int64
+	Time      time.Time
+	Message   *api.Message
+}
+
+// HistoryStorage keeps every version of the messages, not only the last one,
+// so it can tell who wrote what and when.
+type HistoryStorage interface {
+	// AddVersion records a change of a message.
+	AddVersion(version *Version) error
+	// GetHistory returns the versions of the messages which match the key,
+	// where an empty field matches anything, whose revision is greater than
+	// since, oldest first. A positive limit returns only the first limit of
+	// them.
+	GetHistory(key *api.Key, since int64, limit int) ([]*Version, error)
+}
+
+// validateVersion rejects the versions which can not be added to a history.
+func validateVersion(version *Version) error {
+	if version == nil || version.Message == nil || version.Message.Key == nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("could not add version=%v without a message", version))
+	}
+	return nil
+}
+
+// Expiry is the deadline of a message which was put with a time-to-live.
+type Expiry struct {
+	Key      *api.Key
+	Revision int64
+	Deadline time.Time
+}
+
+// ExpiryStorage keeps the deadlines of the changes put with ExpiresAt, so their
+// messages still expire after a restart. A deadline is dropped when its
+// message is written again or deleted.
+type ExpiryStorage interface {
+	// GetExpiries returns the deadlines of the stored messages which have one.
+	GetExpiries() ([]*Expiry, error)
 }
 
 type UserStorage interface {
@@ -20,6 +125,37 @@ type UserStorage interface {
 	UpdateUserReadiness(name string, readiness bool) error
 }
 
+// SeedStorage is a storage which remembers whether it was seeded with the
+// initial state of the config.
+type SeedStorage interface {
+	// SeededRevision returns the revision the storage was seeded with, or
+	// zero if it was not seeded, e.g. since it was resumed with a config
+	// which had no initial state when it was created.
+	SeededRevision() (int64, error)
+}
+
+// Storage is everything Gimulator needs from a storage.
+type Storage interface {
+	MessageStorage
+	HistoryStorage
+	SeedStorage
+	UserStorage
+	RuleStorage
+	ConfigStorage
+}
+
+// ConfigStorage is a storage whose users and rules can be replaced with the
+// ones of a new config while it is in use.
+type ConfigStorage interface {
+	// Reload atomically replaces the users and rules. Users which are kept
+	// keep their readiness and status.
+	Reload(config *config.Config) error
+}
+
 type RuleStorage interface {
-	GetRules(character api.Character, role string, method api.Method) ([]*api.Key, error)
+	// GetRules returns the keys of the rules of the user's character and role
+	// for the method, with their placeholders filled in from the user.
+	GetRules(user *api.User, method api.Method) ([]*api.Key, error)
+	// GetDenyRules is like GetRules, but returns the keys of the deny rules.
+	GetDenyRules(user *api.User, method api.Method) ([]*api.Key, error)
 }
@@ -2,10 +2,15 @@ package storage
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/Gimulator/Gimulator/config"
+	"github.com/Gimulator/Gimulator/pattern"
 	"github.com/Gimulator/protobuf/go/api"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type identifier struct {
@@ -23,23 +28,79 @@ func keyToiden(key *api.Key) *identifier {
 	}
 }
 
+// Memory keeps everything in maps. It is safe for concurrent use.
 type Memory struct {
-	storage map[identifier]*api.Message
+	// mux guards the messages.
+	mux       sync.RWMutex
+	storage   map[identifier]*api.Message
+	revisions map[identifier]int64
+	// revision is the last revision, which may be the one of a delete.
+	revision int64
+	// expiries holds the deadlines of the messages put with one.
+	expiries map[identifier]time.Time
+	// seeded is the revision of the initial state, if it was seeded.
+	seeded int64
+	// history is in the order the versions are added, which is the order
+	// of their revisions.
+	history []*Version
+
+	// configMux guards the users and rules, which are read by every request
+	// and replaced by Reload.
+	configMux sync.RWMutex
+	users     map[string]*memoryUser
+	tokens    map[string]*memoryUser
+	names     []string
+	rules     []memoryRule
+}
+
+type memoryUser struct {
+	user  *api.User
+	token string
+}
+
+type memoryRule struct {
+	character api.Character
+	role      string
+	method    api.Method
+	deny      bool
+	key       api.Key
 }
 
+// NewMemory returns a Memory which only stores messages, it has no users and
+// rules until Reload is called.
 func NewMemory() *Memory {
 	return &Memory{
-		storage: make(map[identifier]*api.Message),
+		storage:   make(map[identifier]*api.Message),
+		revisions: make(map[identifier]int64),
+		expiries:  make(map[identifier]time.Time),
+		users:     make(map[string]*memoryUser),
+		tokens:    make(map[string]*memoryUser),
+	}
+}
+
+// NewMemoryWithConfig returns a Memory with the users, rules and initial state
+// of config.
+func NewMemoryWithConfig(conf *config.Config) (*Memory, error) {
+	m := NewMemory()
+	if err := m.Reload(conf); err != nil {
+		return nil, err
+	}
+	if err := seed(m, conf); err != nil {
+		return nil, err
 	}
+	return m, nil
 }
 
 func (m *Memory) Get(key *api.Key) (*api.Message, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
 	iden := keyToiden(key)
 	getMsgResult, err := m.get(iden)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("could not get any message for key=%v", iden))
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("could not find any message with key=%v", key))
 	}
-	return getMsgResult, nil
+	return copyMessage(getMsgResult), nil
 }
 
 func (m *Memory) get(iden *identifier) (*api.Message, error) {
@@ -50,59 +111,168 @@ func (m *Memory) get(iden *identifier) (*api.Message, error) {
 }
 
 //puts a message in storage
-func (m *Memory) Put(msg *api.Message) error {
-	putMsgResult := m.put(msg)
+func (m *Memory) Put(msg *api.Message, revision int64) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	putMsgResult := m.put(msg, revision)
 	if putMsgResult != nil {
 		return status.Error(codes.Internal, fmt.Sprintf("could not put message=%v in storage", msg))
 	}
 	return putMsgResult
 }
 
-func (m *Memory) put(msg *api.Message) error {
+// put stores a copy of the message, whose creation time is now, like the
+// updated_at of Sqlite.
+func (m *Memory) put(msg *api.Message, revision int64) error {
 	iden := keyToiden(msg.Key)
-	m.storage[*iden] = msg
+	stored := copyMessage(msg)
+	stored.Meta.CreationTime = timestamppb.Now()
+	m.storage[*iden] = stored
+	m.revisions[*iden] = revision
+	delete(m.expiries, *iden)
+	m.raiseRevision(revision)
 	return nil
 }
 
+// raiseRevision raises the last revision to revision, if it is lower.
+func (m *Memory) raiseRevision(revision int64) {
+	if revision > m.revision {
+		m.revision = revision
+	}
+}
+
+// Delete deletes the message with key; deleting a missing message is not an
+// error.
 func (m *Memory) Delete(key *api.Key) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.delete(keyToiden(key))
+	return nil
+}
+
+func (m *Memory) delete(iden *identifier) {
+	delete(m.storage, *iden)
+	delete(m.revisions, *iden)
+	delete(m.expiries, *iden)
+}
+
+func (m *Memory) DeleteAll(key *api.Key) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
 	iden := keyToiden(key)
-	delMsgResult := m.delete(iden)
-	if delMsgResult != nil {
-		return status.Error(codes.Internal, fmt.Sprintf("could not delete message with key=%v ", iden))
+	m.deleteall(iden)
+	return nil
+}
+
+func (m *Memory) deleteall(iden *identifier) {
+	for i := range m.storage {
+		if iden.matchKeys(&i) {
+			m.delete(&i)
+		}
 	}
-	return delMsgResult
 }
 
-func (m *Memory) delete(iden *identifier) error {
-	if _, exists := m.storage[*iden]; exists {
-		delete(m.storage, *iden)
-		return nil
+func (m *Memory) GetRevision(key *api.Key) (int64, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	iden := keyToiden(key)
+	if revision, exists := m.revisions[*iden]; exists {
+		return revision, nil
 	}
-	return fmt.Errorf("message object with key=%v does not exist", iden)
+	return 0, status.Error(codes.NotFound, fmt.Sprintf("could not find any message with key=%v", key))
+}
+
+func (m *Memory) LastRevision() (int64, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	return m.revision, nil
+}
+
+func (m *Memory) SetLastRevision(revision int64) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.raiseRevision(revision)
+	return nil
+}
+
+func (m *Memory) Apply(changes []*Change) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	// Nothing can fail once the changes are validated, so no rollback is needed.
+	if err := validateChanges(changes); err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		if change.Message == nil {
+			m.delete(keyToiden(change.Key))
+			m.raiseRevision(change.Revision)
+		} else if err := m.put(change.Message, change.Revision); err != nil {
+			return status.Error(codes.Internal, fmt.Sprintf("could not put message=%v in storage", change.Message))
+		} else if !change.ExpiresAt.IsZero() {
+			m.expiries[*keyToiden(change.Message.Key)] = change.ExpiresAt
+		}
+
+		if change.Version != nil {
+			m.history = append(m.history, copyVersion(change.Version))
+		}
+	}
+	return nil
+}
+
+func (m *Memory) SeededRevision() (int64, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	return m.seeded, nil
+}
+
+func (m *Memory) markSeeded(revision int64) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.seeded = revision
+	return nil
+}
+
+func (m *Memory) GetExpiries() ([]*Expiry, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	res := make([]*Expiry, 0, len(m.expiries))
+	for iden, deadline := range m.expiries {
+		res = append(res, &Expiry{
+			Key:      &api.Key{Type: iden.theType, Name: iden.name, Namespace: iden.namespace},
+			Revision: m.revisions[iden],
+			Deadline: deadline,
+		})
+	}
+	return res, nil
 }
 
 func (m *Memory) GetAll(key *api.Key) ([]*api.Message, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
 	iden := keyToiden(key)
-	getallMsgsResult, err := m.getall(iden)
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("could not getall messages with key=%v ", iden))
-	}
-	return getallMsgsResult, nil
+	return m.getall(iden), nil
 }
 
-func (m *Memory) getall(iden *identifier) ([]*api.Message, error) {
+func (m *Memory) getall(iden *identifier) []*api.Message {
 	result := make([]*api.Message, 0)
 	for i, o := range m.storage {
 		if iden.matchKeys(&i) {
-			result = append(result, o)
+			result = append(result, copyMessage(o))
 		}
 	}
-
-	if result != nil {
-		return result, nil
-	}
-
-	return nil, fmt.Errorf("no messages matched with key=%v ", iden)
+	return result
 }
 
 func (iden *identifier) matchKeys(key *identifier) bool {
@@ -115,3 +285,242 @@ func (iden *identifier) matchKeys(key *identifier) bool {
 	}
 	return true
 }
+
+// copyMessage copies the message, so callers and the storage can not change
+// each other's messages.
+func copyMessage(msg *api.Message) *api.Message {
+	res := &api.Message{
+		Key: &api.Key{
+			Type:      msg.Key.Type,
+			Name:      msg.Key.Name,
+			Namespace: msg.Key.Namespace,
+		},
+		Meta:    &api.Meta{},
+		Content: msg.Content,
+	}
+	if msg.Meta != nil {
+		res.Meta.CreationTime = msg.Meta.CreationTime
+		if msg.Meta.Owner != nil {
+			res.Meta.Owner = copyUser(msg.Meta.Owner)
+		}
+	}
+	return res
+}
+
+// copyVersion copies the version and its message.
+func copyVersion(version *Version) *Version {
+	return &Version{
+		Operation: version.Operation,
+		Revision:  version.Revision,
+		Time:      version.Time,
+		Message:   copyMessage(version.Message),
+	}
+}
+
+/////////////////////////////////////////////
+////////////////////////// HistoryStorage ///
+/////////////////////////////////////////////
+
+func (m *Memory) AddVersion(version *Version) error {
+	if err := validateVersion(version); err != nil {
+		return err
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.history = append(m.history, copyVersion(version))
+	return nil
+}
+
+func (m *Memory) GetHistory(key *api.Key, since int64, limit int) ([]*Version, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	iden := keyToiden(key)
+	res := make([]*Version, 0)
+	for _, version := range m.history {
+		if limit > 0 && len(res) == limit {
+			break
+		}
+		if version.Revision > since && iden.matchKeys(keyToiden(version.Message.Key)) {
+			res = append(res, copyVersion(version))
+		}
+	}
+	return res, nil
+}
+
+/////////////////////////////////////////////
+/////////////////////////// ConfigStorage ///
+/////////////////////////////////////////////
+
+func (m *Memory) Reload(conf *config.Config) error {
+	users := make(map[string]*memoryUser)
+	tokens := make(map[string]*memoryUser)
+	names := make([]string, 0, len(conf.Credentials))
+	for _, cred := range conf.Credentials {
+		if _, exists := users[cred.Name]; exists {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("could not add user with name=%v twice", cred.Name))
+		}
+		if _, exists := tokens[cred.Token]; exists {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("could not add the token of user with name=%v, it is already used", cred.Name))
+		}
+
+		u := &memoryUser{
+			user: &api.User{
+				Name:      cred.Name,
+				Character: api.Character(api.Character_value[cred.Character]),
+				Role:      cred.Role,
+				Readiness: false,
+				Status:    api.Status_unknown,
+			},
+			token: cred.Token,
+		}
+		users[cred.Name] = u
+		tokens[cred.Token] = u
+		names = append(names, cred.Name)
+	}
+
+	rules := make([]memoryRule, 0)
+	forEachRule(conf, func(character api.Character, role string, rule *config.Rule, method api.Method) {
+		rules = append(rules, memoryRule{
+			character: character,
+			role:      role,
+			method:    method,
+			deny:      rule.Deny,
+			key: api.Key{
+				Type:      rule.Key.Type,
+				Name:      rule.Key.Name,
+				Namespace: rule.Key.Namespace,
+			},
+		})
+	})
+
+	m.configMux.Lock()
+	defer m.configMux.Unlock()
+
+	for name, u := range users {
+		if prev, exists := m.users[name]; exists {
+			u.user.Readiness = prev.user.Readiness
+			u.user.Status = prev.user.Status
+		}
+	}
+	m.users, m.tokens, m.names, m.rules = users, tokens, names, rules
+
+	return nil
+}
+
+/////////////////////////////////////////////
+///////////////////////////// UserStorage ///
+/////////////////////////////////////////////
+
+func (m *Memory) GetUsers(name *string, token *string, character *api.Character, role *string, readiness *bool, st *api.Status) ([]*api.User, error) {
+	m.configMux.RLock()
+	defer m.configMux.RUnlock()
+
+	res := make([]*api.User, 0)
+	for _, n := range m.names {
+		u := m.users[n]
+		switch {
+		case name != nil && u.user.Name != *name:
+		case token != nil && u.token != *token:
+		case character != nil && u.user.Character != *character:
+		case role != nil && u.user.Role != *role:
+		case readiness != nil && u.user.Readiness != *readiness:
+		case st != nil && u.user.Status != *st:
+		default:
+			res = append(res, copyUser(u.user))
+		}
+	}
+	return res, nil
+}
+
+func (m *Memory) GetUserWithToken(token string) (*api.User, error) {
+	m.configMux.RLock()
+	defer m.configMux.RUnlock()
+
+	u, exists := m.tokens[token]
+	if !exists {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("could not find any user with token=%v", token))
+	}
+	return copyUser(u.user), nil
+}
+
+func (m *Memory) GetUserWithName(name string) (*api.User, error) {
+	m.configMux.RLock()
+	defer m.configMux.RUnlock()
+
+	u, exists := m.users[name]
+	if !exists {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("could not find any user with name=%v", name))
+	}
+	return copyUser(u.user), nil
+}
+
+func (m *Memory) UpdateUserStatus(name string, st api.Status) error {
+	m.configMux.Lock()
+	defer m.configMux.Unlock()
+
+	u, exists := m.users[name]
+	if !exists {
+		return status.Error(codes.NotFound, fmt.Sprintf("could not update status of user with name=%v: user does not exist", name))
+	}
+	u.user.Status = st
+	return nil
+}
+
+func (m *Memory) UpdateUserReadiness(name string, readiness bool) error {
+	m.configMux.Lock()
+	defer m.configMux.Unlock()
+
+	u, exists := m.users[name]
+	if !exists {
+		return status.Error(codes.NotFound, fmt.Sprintf("could not update readiness of user with name=%v: user does not exist", name))
+	}
+	u.user.Readiness = readiness
+	return nil
+}
+
+// copyUser copies the user, so callers can not change the stored one.
+func copyUser(u *api.User) *api.User {
+	return &api.User{
+		Name:      u.Name,
+		Character: u.Character,
+		Role:      u.Role,
+		Readiness: u.Readiness,
+		Status:    u.Status,
+	}
+}
+
+/////////////////////////////////////////////
+///////////////////////////// RuleStorage ///
+/////////////////////////////////////////////
+
+func (m *Memory) GetRules(user *api.User, method api.Method) ([]*api.Key, error) {
+	return m.getRules(user, method, false), nil
+}
+
+func (m *Memory) GetDenyRules(user *api.User, method api.Method) ([]*api.Key, error) {
+	return m.getRules(user, method, true), nil
+}
+
+func (m *Memory) getRules(user *api.User, method api.Method, deny bool) []*api.Key {
+	m.configMux.RLock()
+	defer m.configMux.RUnlock()
+
+	keys := make([]*api.Key, 0)
+	for i := range m.rules {
+		rule := &m.rules[i]
+		if rule.character != user.Character || rule.role != user.Role || rule.method != method || rule.deny != deny {
+			continue
+		}
+
+		// Rules are stored as templates and filled in for every user.
+		keys = append(keys, pattern.Expand(&api.Key{
+			Type:      rule.key.Type,
+			Name:      rule.key.Name,
+			Namespace: rule.key.Namespace,
+		}, user))
+	}
+	return keys
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/Gimulator/Gimulator/config"
+	"github.com/Gimulator/protobuf/go/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestConfig() *config.Config {
+	return &config.Config{
+		Character: config.Character{
+			Actors: map[string][]config.Rule{
+				"red": {
+					{Key: api.Key{Namespace: "$name"}, Methods: []config.Method{config.Method(api.Method_put)}},
+					{Key: api.Key{Name: "hidden-*"}, Methods: []config.Method{config.Method(api.Method_put)}, Deny: true},
+				},
+			},
+			Director: []config.Rule{
+				{Key: api.Key{}, Methods: []config.Method{config.Method(api.Method_get)}},
+			},
+		},
+		Credentials: []config.Credential{
+			{Name: "director", Token: "director-token", Character: "director", Role: "director"},
+			{Name: "actor1", Token: "actor1-token", Character: "actor", Role: "red"},
+		},
+	}
+}
+
+func TestMemoryUsers(t *testing.T) {
+	m, err := NewMemoryWithConfig(newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := m.GetUserWithToken("actor1-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "actor1" || user.Character != api.Character_actor || user.Role != "red" {
+		t.Errorf("got user %v", user)
+	}
+	if _, err := m.GetUserWithToken("wrong-token"); status.Code(err) != codes.NotFound {
+		t.Errorf("got error %v for a wrong token, want NotFound", err)
+	}
+
+	if err := m.UpdateUserReadiness("actor1", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.UpdateUserStatus("actor1", api.Status_running); err != nil {
+		t.Fatal(err)
+	}
+	character := api.Character_actor
+	actors, err := m.GetUsers(nil, nil, &character, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actors) != 1 || !actors[0].Readiness || actors[0].Status != api.Status_running {
+		t.Errorf("got actors %v", actors)
+	}
+
+	// Reloading keeps the readiness and status of the users which are kept.
+	conf := newTestConfig()
+	conf.Credentials[1].Token = "new-token"
+	if err := m.Reload(conf); err != nil {
+		t.Fatal(err)
+	}
+	user, err = m.GetUserWithToken("new-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Readiness || user.Status != api.Status_running {
+		t.Errorf("got user %v after reload, want it ready and running", user)
+	}
+	if _, err := m.GetUserWithToken("actor1-token"); err == nil {
+		t.Error("old token still works after reload")
+	}
+}
+
+func TestMemoryRules(t *testing.T) {
+	m, err := NewMemoryWithConfig(newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actor := &api.User{Name: "actor1", Character: api.Character_actor, Role: "red"}
+	keys, err := m.GetRules(actor, api.Method_put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Namespace != "actor1" {
+		t.Errorf("got rules %v, want the namespace of actor1", keys)
+	}
+
+	keys, err = m.GetDenyRules(actor, api.Method_put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Name != "hidden-*" {
+		t.Errorf("got deny rules %v", keys)
+	}
+
+	director := &api.User{Name: "director", Character: api.Character_director, Role: "director"}
+	if keys, _ := m.GetRules(director, api.Method_put); len(keys) != 0 {
+		t.Errorf("got rules %v of another character", keys)
+	}
+}
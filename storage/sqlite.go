@@ -3,9 +3,11 @@ package storage
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/Gimulator/Gimulator/config"
+	"github.com/Gimulator/Gimulator/pattern"
 	"github.com/Gimulator/protobuf/go/api"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
@@ -65,108 +67,100 @@ func (s *Sqlite) prepare(path string, config *config.Config) error {
 	s.DB = db
 
 	s.log.Info("starting to create tables")
-	if err := s.AutoMigrate(&User{}, &Rule{}, &Message{}); err != nil {
+	if err := s.AutoMigrate(&User{}, &Rule{}, &Message{}, &MessageVersion{}, &Room{}); err != nil {
 		s.log.WithError(err).Error("could not create tables")
 		return err
 	}
 
-	s.log.Info("starting to convert config's rules")
-	rules, err := s.convertConfigToRule(config)
-	if err != nil {
-		s.log.WithError(err).Error("could not convert config's rules")
+	s.log.Info("starting to purge deleted messages")
+	if err := s.purgeDeletedMessages(); err != nil {
+		s.log.WithError(err).Error("could not purge deleted messages")
 		return err
 	}
 
-	s.log.Info("starting to fill credential table")
-	if err := s.fillUserTable(config); err != nil {
-		s.log.WithError(err).Error("could not fill credential table")
+	if path == memoryPath {
+		// Every connection to :memory: opens a database of its own.
+		sqlDB, err := s.DB.DB()
+		if err != nil {
+			s.log.WithError(err).Error("could not open sqlite db")
+			return err
+		}
+		sqlDB.SetMaxOpenConns(1)
+	}
+
+	// Users and rules of an existing database are replaced with the ones of
+	// the config, and its messages are kept, so a restarted Gimulator
+	// resumes the match.
+	s.log.Info("starting to fill credential and role tables")
+	if err := s.Reload(config); err != nil {
+		s.log.WithError(err).Error("could not fill credential and role tables")
 		return err
 	}
 
-	s.log.Info("starting to fill role table")
-	if err := s.fillRuleTable(rules); err != nil {
-		s.log.WithError(err).Error("could not fill role table")
+	s.log.WithField("messages", len(config.InitialState)).Info("starting to seed initial state")
+	if err := seed(s, config); err != nil {
+		s.log.WithError(err).Error("could not seed initial state")
 		return err
 	}
 
 	return nil
 }
 
-func (s *Sqlite) convertConfigToRule(conf *config.Config) ([]Rule, error) {
-	rules := make([]Rule, 0)
-
-	for role, cRules := range conf.Character.Actors {
-		for _, rule := range cRules {
-			for _, method := range rule.Methods {
-				rules = append(rules, Rule{
-					Method:    api.Method(api.Method_value[method]),
-					Type:      rule.Key.Type,
-					Name:      rule.Key.Name,
-					Namespace: rule.Key.Namespace,
-					Role:      role,
-					Character: api.Character_actor,
-				})
-			}
-		}
+// SqliteDSN returns the data source name of the sqlite database at path, with
+// a journal mode such as "wal" and a synchronous setting such as "normal",
+// both of which may be empty for the defaults of sqlite. An empty path or
+// ":memory:" is an in-memory database, which has no options.
+func SqliteDSN(path, journalMode, synchronous string) (string, error) {
+	if path == "" || path == memoryPath {
+		return memoryPath, nil
 	}
 
-	for _, rule := range conf.Character.Director {
-		for _, method := range rule.Methods {
-			rules = append(rules, Rule{
-				Method:    api.Method(api.Method_value[method]),
-				Type:      rule.Key.Type,
-				Name:      rule.Key.Name,
-				Namespace: rule.Key.Namespace,
-				Role:      api.Character_name[int32(api.Character_director)],
-				Character: api.Character_director,
-			})
-		}
-	}
+	dsn := fmt.Sprintf("file:%s?cache=private&mode=rwc&_timeout=500", path)
 
-	for _, rule := range conf.Character.Operator {
-		for _, method := range rule.Methods {
-			rules = append(rules, Rule{
-				Method:    api.Method(api.Method_value[method]),
-				Type:      rule.Key.Type,
-				Name:      rule.Key.Name,
-				Namespace: rule.Key.Namespace,
-				Role:      api.Character_name[int32(api.Character_operator)],
-				Character: api.Character_operator,
-			})
-		}
+	switch strings.ToLower(journalMode) {
+	case "":
+	case "delete", "truncate", "persist", "memory", "wal", "off":
+		dsn += "&_journal_mode=" + strings.ToUpper(journalMode)
+	default:
+		return "", fmt.Errorf("invalid journal mode %q, choices are: delete, truncate, persist, memory, wal, off", journalMode)
 	}
 
-	for _, rule := range conf.Character.Master {
-		for _, method := range rule.Methods {
-			rules = append(rules, Rule{
-				Method:    api.Method(api.Method_value[method]),
-				Type:      rule.Key.Type,
-				Name:      rule.Key.Name,
-				Namespace: rule.Key.Namespace,
-				Role:      api.Character_name[int32(api.Character_master)],
-				Character: api.Character_master,
-			})
-		}
+	switch strings.ToLower(synchronous) {
+	case "":
+	case "off", "normal", "full", "extra":
+		dsn += "&_synchronous=" + strings.ToUpper(synchronous)
+	default:
+		return "", fmt.Errorf("invalid synchronous setting %q, choices are: off, normal, full, extra", synchronous)
 	}
 
-	return rules, nil
+	return dsn, nil
 }
 
-func (s *Sqlite) fillUserTable(config *config.Config) error {
-	for _, cred := range config.Credentials {
-		if err := s.insertUser(&User{
-			Name:      cred.Name,
-			Token:     cred.Token,
-			Character: api.Character(api.Character_value[cred.Character]), // Character field in config package is string type
-			Role:      cred.Role,
-			Readiness: false,
-			Status:    api.Status_unknown,
-		}); err != nil {
-			return err
-		}
+// Close closes the database.
+func (s *Sqlite) Close() error {
+	sqlDB, err := s.DB.DB()
+	if err != nil {
+		return err
 	}
+	return sqlDB.Close()
+}
 
-	return nil
+func (s *Sqlite) convertConfigToRule(conf *config.Config) ([]Rule, error) {
+	rules := make([]Rule, 0)
+
+	forEachRule(conf, func(character api.Character, role string, rule *config.Rule, method api.Method) {
+		rules = append(rules, Rule{
+			Method:    method,
+			Type:      rule.Key.Type,
+			Name:      rule.Key.Name,
+			Namespace: rule.Key.Namespace,
+			Role:      role,
+			Character: character,
+			Deny:      rule.Deny,
+		})
+	})
+
+	return rules, nil
 }
 
 func (s *Sqlite) fillRuleTable(rules []Rule) error { /////////////////////////////////////////
@@ -179,21 +173,69 @@ func (s *Sqlite) fillRuleTable(rules []Rule) error { ///////////////////////////
 }
 
 /////////////////////////////////////////////
-////////////////////////// MessageStorage ///
+/////////////////////////// ConfigStorage ///
 /////////////////////////////////////////////
 
-func (s *Sqlite) Put(message *api.Message) error {
-	// **Attention**: I suppose the owner of message was validated before calling this function.
-	// The reason is performance.
-	mes := &Message{
-		Type:      message.Key.Type,
-		Name:      message.Key.Name,
-		Namespace: message.Key.Namespace,
-		UserName:  message.Meta.Owner.Name,
-		Content:   message.Content,
+func (s *Sqlite) Reload(config *config.Config) error {
+	rules, err := s.convertConfigToRule(config)
+	if err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("could not convert config's rules: %v", err.Error()))
 	}
 
-	if err := s.insertOrUpdateMessage(mes); err != nil {
+	err = s.Transaction(func(tx *gorm.DB) error {
+		t := &Sqlite{DB: tx, log: s.log}
+
+		users, err := t.selectUsers(nil, nil, nil, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		previous := make(map[string]*User)
+		for _, user := range users {
+			previous[user.Name] = user
+		}
+
+		// Rows are removed for good, so the tokens of removed users can be
+		// given to new ones.
+		for _, model := range []interface{}{&User{}, &Rule{}} {
+			if err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(model).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, cred := range config.Credentials {
+			user := t.configToSqliteUser(cred)
+			if prev, ok := previous[user.Name]; ok {
+				user.CreatedAt = prev.CreatedAt
+				user.Readiness = prev.Readiness
+				user.Status = prev.Status
+				user.LastStatusUpdateTime = prev.LastStatusUpdateTime
+			}
+			if err := t.insertUser(user); err != nil {
+				return err
+			}
+		}
+
+		return t.fillRuleTable(rules)
+	})
+	if err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("could not reload the config, the previous one is kept: %v", err.Error()))
+	}
+	return nil
+}
+
+/////////////////////////////////////////////
+////////////////////////// MessageStorage ///
+/////////////////////////////////////////////
+
+func (s *Sqlite) Put(message *api.Message, revision int64) error {
+	err := s.Transaction(func(tx *gorm.DB) error {
+		t := &Sqlite{DB: tx, log: s.log}
+		if err := t.putMessage(message, revision, time.Time{}); err != nil {
+			return err
+		}
+		return t.saveRevision(revision)
+	})
+	if err != nil {
 		return status.Error(codes.Internal, fmt.Sprintf("could not put message=%v: %v", message, err.Error()))
 	}
 	return nil
@@ -225,6 +267,34 @@ func (s *Sqlite) GetAll(key *api.Key) ([]*api.Message, error) {
 	return res, nil
 }
 
+func (s *Sqlite) GetRevision(key *api.Key) (int64, error) {
+	messages, err := s.selectMessage(key.Type, key.Name, key.Namespace)
+	if err != nil {
+		return 0, status.Error(codes.Internal, fmt.Sprintf("could not get revision of message with key=%v: %v", key, err.Error()))
+	}
+
+	if len(messages) < 1 {
+		return 0, status.Error(codes.NotFound, fmt.Sprintf("could not find any message with key=%v", key))
+	}
+
+	return messages[0].Revision, nil
+}
+
+func (s *Sqlite) LastRevision() (int64, error) {
+	revision, err := s.selectLastRevision()
+	if err != nil {
+		return 0, status.Error(codes.Internal, fmt.Sprintf("could not get the last revision: %v", err.Error()))
+	}
+	return revision, nil
+}
+
+func (s *Sqlite) SetLastRevision(revision int64) error {
+	if err := s.saveRevision(revision); err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("could not set the last revision to %v: %v", revision, err.Error()))
+	}
+	return nil
+}
+
 func (s *Sqlite) Delete(key *api.Key) error {
 	if err := s.deleteMessage(key.Type, key.Name, key.Namespace); err != nil {
 		return status.Error(codes.Internal, fmt.Sprintf("could not delete message with key=%v: %v", key, err.Error()))
@@ -239,12 +309,65 @@ func (s *Sqlite) DeleteAll(key *api.Key) error {
 	return nil
 }
 
+func (s *Sqlite) Apply(changes []*Change) error {
+	if err := validateChanges(changes); err != nil {
+		return err
+	}
+
+	err := s.Transaction(func(tx *gorm.DB) error {
+		// A Sqlite bound to the transaction, so the usual methods can be reused.
+		t := &Sqlite{DB: tx, log: s.log}
+		var revision int64
+		for _, change := range changes {
+			if change.Revision > revision {
+				revision = change.Revision
+			}
+			if change.Message == nil {
+				if err := t.deleteMessage(change.Key.Type, change.Key.Name, change.Key.Namespace); err != nil {
+					return fmt.Errorf("could not delete message with key=%v: %v", change.Key, err)
+				}
+			} else if err := t.putMessage(change.Message, change.Revision, change.ExpiresAt); err != nil {
+				return fmt.Errorf("could not put message=%v: %v", change.Message, err)
+			}
+
+			if change.Version != nil {
+				if err := t.insertVersion(change.Version); err != nil {
+					return fmt.Errorf("could not add version of message with key=%v: %v", change.Key, err)
+				}
+			}
+		}
+		return t.saveRevision(revision)
+	})
+	if err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("could not apply changes, none of them is applied: %v", err.Error()))
+	}
+	return nil
+}
+
+// putMessage stores the message with the revision, and with its deadline if
+// expiresAt is not zero. The owner of the message is not looked up, it is
+// validated before.
+func (s *Sqlite) putMessage(message *api.Message, revision int64, expiresAt time.Time) error {
+	mes := &Message{
+		Type:      message.Key.Type,
+		Name:      message.Key.Name,
+		Namespace: message.Key.Namespace,
+		UserName:  message.Meta.Owner.Name,
+		Content:   message.Content,
+		Revision:  revision,
+	}
+	if !expiresAt.IsZero() {
+		mes.ExpiresAt = &expiresAt
+	}
+	return s.insertOrUpdateMessage(mes)
+}
+
 func (s *Sqlite) insertOrUpdateMessage(message *Message) error {
 	if err := s.Clauses(clause.OnConflict{
 		Columns: []clause.Column{
 			{Name: "name"}, {Name: "namespace"}, {Name: "type"},
 		},
-		DoUpdates: clause.AssignmentColumns([]string{"user_name", "content"}),
+		DoUpdates: clause.AssignmentColumns([]string{"user_name", "content", "revision", "updated_at", "deleted_at", "expires_at"}),
 	}).Create(message).Error; err != nil {
 		return err
 	}
@@ -272,6 +395,70 @@ func (s *Sqlite) selectMessage(typ, name, namespace string) ([]*Message, error)
 	return messages, nil
 }
 
+func (s *Sqlite) GetExpiries() ([]*Expiry, error) {
+	messages := []*Message{}
+	if err := s.Where("expires_at IS NOT NULL").Find(&messages).Error; err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("could not get the deadlines of messages: %v", err.Error()))
+	}
+
+	res := make([]*Expiry, 0, len(messages))
+	for _, mes := range messages {
+		res = append(res, &Expiry{
+			Key:      &api.Key{Type: mes.Type, Name: mes.Name, Namespace: mes.Namespace},
+			Revision: mes.Revision,
+			Deadline: *mes.ExpiresAt,
+		})
+	}
+	return res, nil
+}
+
+// selectLastRevision returns the highest revision of the room, the messages,
+// including deleted ones, and the history. Databases of older versions have no
+// room row, so the messages and the history are looked at too.
+func (s *Sqlite) selectLastRevision() (int64, error) {
+	var last int64
+	for _, model := range []interface{}{&Room{}, &Message{}, &MessageVersion{}} {
+		var revision int64
+		if err := s.Unscoped().Model(model).Select("COALESCE(MAX(revision), 0)").Scan(&revision).Error; err != nil {
+			return 0, err
+		}
+		if revision > last {
+			last = revision
+		}
+	}
+	return last, nil
+}
+
+// saveRevision raises the revision of the room to revision, if it is lower.
+func (s *Sqlite) saveRevision(revision int64) error {
+	if revision <= 0 {
+		return nil
+	}
+	return s.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"revision": gorm.Expr("MAX(revision, excluded.revision)"),
+		}),
+	}).Create(&Room{ID: roomID, Revision: revision}).Error
+}
+
+func (s *Sqlite) SeededRevision() (int64, error) {
+	var seeded int64
+	if err := s.Model(&Room{}).Select("COALESCE(MAX(seeded), 0)").Scan(&seeded).Error; err != nil {
+		return 0, status.Error(codes.Internal, fmt.Sprintf("could not get the seeded revision: %v", err.Error()))
+	}
+	return seeded, nil
+}
+
+func (s *Sqlite) markSeeded(revision int64) error {
+	return s.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"seeded"}),
+	}).Create(&Room{ID: roomID, Revision: revision, Seeded: revision}).Error
+}
+
+// deleteMessage removes the messages for good, so short-lived messages do not
+// pile up in the database. Their versions are kept in the history.
 func (s *Sqlite) deleteMessage(typ, name, namespace string) error {
 	db := s.DB
 
@@ -285,7 +472,90 @@ func (s *Sqlite) deleteMessage(typ, name, namespace string) error {
 		db = db.Where("namespace = ?", namespace)
 	}
 
-	return db.Delete(&Message{}).Error
+	return db.Unscoped().Delete(&Message{}).Error
+}
+
+// purgeDeletedMessages removes the messages which older versions only marked
+// as deleted. Their revisions are kept as the revision of the room first.
+func (s *Sqlite) purgeDeletedMessages() error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		t := &Sqlite{DB: tx, log: s.log}
+
+		revision, err := t.selectLastRevision()
+		if err != nil {
+			return err
+		}
+		if err := t.saveRevision(revision); err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Where("deleted_at IS NOT NULL").Delete(&Message{}).Error
+	})
+}
+
+///////////////////////////////////////////////
+//////////////////////////// HistoryStorage ///
+///////////////////////////////////////////////
+
+func (s *Sqlite) AddVersion(version *Version) error {
+	if err := validateVersion(version); err != nil {
+		return err
+	}
+
+	if err := s.insertVersion(version); err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("could not add version of message with key=%v: %v", version.Message.Key, err.Error()))
+	}
+	return nil
+}
+
+func (s *Sqlite) insertVersion(version *Version) error {
+	return s.Create(&MessageVersion{
+		Operation: version.Operation,
+		Revision:  version.Revision,
+		Time:      version.Time,
+		Type:      version.Message.Key.Type,
+		Name:      version.Message.Key.Name,
+		Namespace: version.Message.Key.Namespace,
+		Content:   version.Message.Content,
+		UserName:  version.Message.GetMeta().GetOwner().GetName(),
+	}).Error
+}
+
+func (s *Sqlite) GetHistory(key *api.Key, since int64, limit int) ([]*Version, error) {
+	versions, err := s.selectVersions(key.Type, key.Name, key.Namespace, since, limit)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("could not get history of messages with key=%v: %v", key, err.Error()))
+	}
+
+	res := make([]*Version, 0, len(versions))
+	for _, ver := range versions {
+		res = append(res, s.sqliteToVersion(ver))
+	}
+	return res, nil
+}
+
+func (s *Sqlite) selectVersions(typ, name, namespace string, since int64, limit int) ([]*MessageVersion, error) {
+	versions := []*MessageVersion{}
+
+	db := s.Where("revision > ?", since)
+	if typ != "" {
+		db = db.Where("type = ?", typ)
+	}
+	if name != "" {
+		db = db.Where("name = ?", name)
+	}
+	if namespace != "" {
+		db = db.Where("namespace = ?", namespace)
+	}
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
+
+	if err := db.Order("revision").Find(&versions).Error; err != nil {
+		return nil, err
+	}
+
+	return versions, nil
 }
 
 ///////////////////////////////////////////////
@@ -358,8 +628,6 @@ func (s *Sqlite) selectUserWithToken(t string) (*User, error) {
 }
 
 func (s *Sqlite) insertUser(user *User) error {
-	fmt.Println("------------------------------ user")
-	fmt.Println(user)
 	if err := s.Create(user).Error; err != nil {
 		return err
 	}
@@ -434,30 +702,37 @@ func (s *Sqlite) selectUsers(n *string, t *string, c *api.Character, r *string,
 /////////////////////////////// RuleStorage ///
 ///////////////////////////////////////////////
 
-func (s *Sqlite) GetRules(character api.Character, role string, method api.Method) ([]*api.Key, error) {
-	rules, err := s.selectRules(&character, &role, &method)
+func (s *Sqlite) GetRules(user *api.User, method api.Method) ([]*api.Key, error) {
+	return s.getRules(user, method, false)
+}
+
+func (s *Sqlite) GetDenyRules(user *api.User, method api.Method) ([]*api.Key, error) {
+	return s.getRules(user, method, true)
+}
+
+func (s *Sqlite) getRules(user *api.User, method api.Method, deny bool) ([]*api.Key, error) {
+	rules, err := s.selectRules(&user.Character, &user.Role, &method, &deny)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("could not find rules for character=%v, role=%v, and method=%v", character, role, method))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("could not find rules for character=%v, role=%v, and method=%v", user.Character, user.Role, method))
 	}
 
 	keys := make([]*api.Key, 0)
 	for _, rule := range rules {
-		keys = append(keys, s.sqliteRuleToAPIKey(rule))
+		// Rules are stored as templates and filled in for every user.
+		keys = append(keys, pattern.Expand(s.sqliteRuleToAPIKey(rule), user))
 	}
 
 	return keys, nil
 }
 
 func (s *Sqlite) insertRule(rule *Rule) error {
-	fmt.Println("------------------------------ rule")
-	fmt.Println(rule)
 	if err := s.Create(rule).Error; err != nil {
 		return err
 	}
 	return nil
 }
 
-func (s *Sqlite) selectRules(c *api.Character, r *string, m *api.Method) ([]*Rule, error) {
+func (s *Sqlite) selectRules(c *api.Character, r *string, m *api.Method, d *bool) ([]*Rule, error) {
 	rules := []*Rule{}
 
 	db := s.DB
@@ -470,6 +745,9 @@ func (s *Sqlite) selectRules(c *api.Character, r *string, m *api.Method) ([]*Rul
 	if m != nil {
 		db = db.Where("method = ?", m)
 	}
+	if d != nil {
+		db = db.Where("deny = ?", d)
+	}
 
 	if err := db.Find(&rules).Error; err != nil {
 		return nil, err
@@ -482,6 +760,12 @@ func (s *Sqlite) selectRules(c *api.Character, r *string, m *api.Method) ([]*Rul
 //////////////////////////////////// Helper ///
 ///////////////////////////////////////////////
 func (s *Sqlite) sqliteToAPIMessage(src *Message) *api.Message {
+	// The owner may be removed from the config since the message is put.
+	owner := src.User
+	if owner == nil {
+		owner = &User{Name: src.UserName}
+	}
+
 	return &api.Message{
 		Key: &api.Key{
 			Type:      src.Type,
@@ -489,13 +773,33 @@ func (s *Sqlite) sqliteToAPIMessage(src *Message) *api.Message {
 			Namespace: src.Namespace,
 		},
 		Meta: &api.Meta{
-			Owner:        s.sqliteToAPIUser(src.User),
+			Owner:        s.sqliteToAPIUser(owner),
 			CreationTime: timestamppb.New(src.UpdatedAt),
 		},
 		Content: src.Content,
 	}
 }
 
+func (s *Sqlite) sqliteToVersion(src *MessageVersion) *Version {
+	return &Version{
+		Operation: src.Operation,
+		Revision:  src.Revision,
+		Time:      src.Time,
+		Message: &api.Message{
+			Key: &api.Key{
+				Type:      src.Type,
+				Name:      src.Name,
+				Namespace: src.Namespace,
+			},
+			Meta: &api.Meta{
+				Owner:        &api.User{Name: src.UserName},
+				CreationTime: timestamppb.New(src.Time),
+			},
+			Content: src.Content,
+		},
+	}
+}
+
 func (s *Sqlite) sqliteToAPIUser(src *User) *api.User {
 	return &api.User{
 		Name:      src.Name,
@@ -506,6 +810,17 @@ func (s *Sqlite) sqliteToAPIUser(src *User) *api.User {
 	}
 }
 
+func (s *Sqlite) configToSqliteUser(cred config.Credential) *User {
+	return &User{
+		Name:      cred.Name,
+		Token:     cred.Token,
+		Character: api.Character(api.Character_value[cred.Character]), // Character field in config package is string type
+		Role:      cred.Role,
+		Readiness: false,
+		Status:    api.Status_unknown,
+	}
+}
+
 func (s *Sqlite) sqliteRuleToAPIKey(src *Rule) *api.Key {
 	return &api.Key{
 		Type:      src.Type,
@@ -540,6 +855,7 @@ type Rule struct {
 	Namespace string        `gorm:"notNull;default:''"`
 	Role      string        `gorm:"notNull;default:''"`
 	Character api.Character `gorm:"notNull;default:0"`
+	Deny      bool          `gorm:"notNull;default:false"`
 }
 
 // We don't inherit from gorm.Model for this model since our primary key is different from the default one that gorm provides
@@ -551,6 +867,35 @@ type Message struct {
 	Name      string         `gorm:"primaryKey;autoIncrement:false;notNull"`
 	Namespace string         `gorm:"primaryKey;autoIncrement:false;notNull"`
 	Content   string         `gorm:"notNull;default:''"`
+	Revision  int64          `gorm:"notNull;default:0;index"`
+	ExpiresAt *time.Time     `gorm:"index"`
 	UserName  string         `gorm:"notNull"`
 	User      *User          `gorm:"foreignKey:UserName;references:Name;notNull"`
 }
+
+// roomID is the ID of the only row of Room.
+const roomID = 1
+
+// Room holds the last revision of the room in a single row, since the revision
+// of a delete is kept by no message, and the revision its initial state was
+// seeded with.
+type Room struct {
+	ID       uint  `gorm:"primaryKey;autoIncrement:false"`
+	Revision int64 `gorm:"notNull;default:0"`
+	Seeded   int64 `gorm:"notNull;default:0"`
+}
+
+// MessageVersion is a row of the history of messages, which is only appended
+// to. It has no foreign key to User, since users may be removed from the config
+// while their versions are kept.
+type MessageVersion struct {
+	ID        uint      `gorm:"primaryKey"`
+	Operation string    `gorm:"notNull"`
+	Revision  int64     `gorm:"notNull;index"`
+	Time      time.Time `gorm:"notNull"`
+	Type      string    `gorm:"notNull;index:idx_message_version_key"`
+	Name      string    `gorm:"notNull;index:idx_message_version_key"`
+	Namespace string    `gorm:"notNull;index:idx_message_version_key"`
+	Content   string    `gorm:"notNull;default:''"`
+	UserName  string    `gorm:"notNull"`
+}
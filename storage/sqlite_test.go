@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Gimulator/protobuf/go/api"
+)
+
+func TestSqliteRestart(t *testing.T) {
+	dsn, err := SqliteDSN(filepath.Join(t.TempDir(), "data.db"), "wal", "normal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSqlite(dsn, newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}
+	if err := s.Put(&api.Message{Key: key, Meta: &api.Meta{Owner: &api.User{Name: "actor1"}}, Content: "x"}, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateUserReadiness("actor1", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewSqlite(dsn, newTestConfig())
+	if err != nil {
+		t.Fatalf("could not resume from an existing database: %v", err)
+	}
+	defer s.Close()
+
+	mes, err := s.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mes.Content != "x" || mes.Meta.Owner.Name != "actor1" {
+		t.Errorf("got message %v after restart", mes)
+	}
+	if revision, err := s.LastRevision(); err != nil || revision != 7 {
+		t.Errorf("got last revision %v, %v after restart, want 7", revision, err)
+	}
+
+	user, err := s.GetUserWithName("actor1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Readiness {
+		t.Error("readiness of actor1 is lost after restart")
+	}
+	keys, err := s.GetRules(user, api.Method_put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Errorf("got rules %v after restart, want them once", keys)
+	}
+}
+
+func TestSqliteRestartAfterDelete(t *testing.T) {
+	dsn, err := SqliteDSN(filepath.Join(t.TempDir(), "data.db"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSqlite(dsn, newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}
+	if err := s.Put(&api.Message{Key: key, Meta: &api.Meta{Owner: &api.User{Name: "actor1"}}, Content: "x"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Apply([]*Change{{Key: key, Revision: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewSqlite(dsn, newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if revision, err := s.LastRevision(); err != nil || revision != 2 {
+		t.Errorf("got last revision %v, %v after restart, want the revision of the delete, 2", revision, err)
+	}
+}
+
+func TestSqliteDeleteRemovesRows(t *testing.T) {
+	dsn, err := SqliteDSN(filepath.Join(t.TempDir(), "data.db"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSqlite(dsn, newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := &api.Meta{Owner: &api.User{Name: "actor1"}}
+	ping := &api.Key{Type: "ping", Name: "actor1", Namespace: "board"}
+	if err := s.Put(&api.Message{Key: ping, Meta: owner}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Apply([]*Change{{Key: ping, Revision: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A message which an older version only marked as deleted.
+	old := &api.Key{Type: "offer", Name: "turn", Namespace: "board"}
+	if err := s.Put(&api.Message{Key: old, Meta: owner}, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DB.Where("type = ?", old.Type).Delete(&Message{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DB.Delete(&Room{ID: roomID}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewSqlite(dsn, newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var rows int64
+	if err := s.DB.Unscoped().Model(&Message{}).Count(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Errorf("got %d message rows after deleting every message, want none", rows)
+	}
+	if revision, err := s.LastRevision(); err != nil || revision != 3 {
+		t.Errorf("got last revision %v, %v after purging, want 3", revision, err)
+	}
+}
+
+func TestSqliteRestartKeepsExpiries(t *testing.T) {
+	dsn, err := SqliteDSN(filepath.Join(t.TempDir(), "data.db"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSqlite(dsn, newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := &api.Meta{Owner: &api.User{Name: "actor1"}}
+	ping := &api.Key{Type: "ping", Name: "actor1", Namespace: "board"}
+	cell := &api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}
+	deadline := time.Unix(1600000000, 0).UTC()
+	if err := s.Apply([]*Change{
+		{Key: ping, Message: &api.Message{Key: ping, Meta: owner}, Revision: 1, ExpiresAt: deadline},
+		{Key: cell, Message: &api.Message{Key: cell, Meta: owner}, Revision: 2, ExpiresAt: deadline},
+		{Key: cell, Message: &api.Message{Key: cell, Meta: owner}, Revision: 3},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewSqlite(dsn, newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	expiries, err := s.GetExpiries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expiries) != 1 {
+		t.Fatalf("got %d deadlines after restart, want only the one of ping", len(expiries))
+	}
+	if e := expiries[0]; e.Key.Type != "ping" || e.Revision != 1 || !e.Deadline.Equal(deadline) {
+		t.Errorf("got deadline %v of key=%v with revision %v, want %v of ping with revision 1", e.Deadline, e.Key, e.Revision, deadline)
+	}
+}
+
+func TestSqliteDSN(t *testing.T) {
+	if dsn, _ := SqliteDSN("", "wal", ""); dsn != memoryPath {
+		t.Errorf("got %q for an empty path, want %q", dsn, memoryPath)
+	}
+	if _, err := SqliteDSN("data.db", "journal", ""); err == nil {
+		t.Error("invalid journal mode is accepted")
+	}
+	if _, err := SqliteDSN("data.db", "", "sometimes"); err == nil {
+		t.Error("invalid synchronous setting is accepted")
+	}
+}
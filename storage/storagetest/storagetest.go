@@ -0,0 +1,565 @@
+// Package storagetest checks that an implementation of storage.MessageStorage
+// behaves like the ones of the storage package, so Gimulator can run on top of
+// it. Run it from a test of the implementation:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.TestMessageStorage(t, func(t *testing.T) storage.MessageStorage {
+//			return NewMyStorage()
+//		})
+//	}
+//
+// A storage which keeps history is checked with TestHistoryStorage too. Run
+// the tests with -race, since storages have to be safe for concurrent use.
+package storagetest
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Gimulator/Gimulator/storage"
+	"github.com/Gimulator/protobuf/go/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestMessageStorage runs every check against a new, empty storage returned by
+// newStorage.
+func TestMessageStorage(t *testing.T, newStorage func(t *testing.T) storage.MessageStorage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s storage.MessageStorage)
+	}{
+		{"GetMissing", testGetMissing},
+		{"PutGet", testPutGet},
+		{"PutReplaces", testPutReplaces},
+		{"PutCopies", testPutCopies},
+		{"Delete", testDelete},
+		{"DeleteMissing", testDeleteMissing},
+		{"PutAfterDelete", testPutAfterDelete},
+		{"GetAll", testGetAll},
+		{"DeleteAll", testDeleteAll},
+		{"LastRevision", testLastRevision},
+		{"Apply", testApply},
+		{"ApplyNothingOnError", testApplyNothingOnError},
+		{"Concurrent", testConcurrent},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, newStorage(t))
+		})
+	}
+}
+
+func newMessage(typ, name, namespace, content string) *api.Message {
+	return &api.Message{
+		Key: &api.Key{
+			Type:      typ,
+			Name:      name,
+			Namespace: namespace,
+		},
+		Meta: &api.Meta{
+			Owner: &api.User{Name: "tester"},
+		},
+		Content: content,
+	}
+}
+
+func put(t *testing.T, s storage.MessageStorage, mes *api.Message, revision int64) {
+	t.Helper()
+	if err := s.Put(mes, revision); err != nil {
+		t.Fatalf("could not put message=%v: %v", mes, err)
+	}
+}
+
+func names(messages []*api.Message) []string {
+	res := make([]string, 0, len(messages))
+	for _, mes := range messages {
+		res = append(res, mes.Key.Name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func testGetMissing(t *testing.T, s storage.MessageStorage) {
+	key := &api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}
+
+	if _, err := s.Get(key); status.Code(err) != codes.NotFound {
+		t.Errorf("got error %v from Get of a missing message, want NotFound", err)
+	}
+	if _, err := s.GetRevision(key); status.Code(err) != codes.NotFound {
+		t.Errorf("got error %v from GetRevision of a missing message, want NotFound", err)
+	}
+}
+
+func testPutGet(t *testing.T, s storage.MessageStorage) {
+	mes := newMessage("cell", "cell-1", "board", "x")
+	put(t, s, mes, 1)
+
+	got, err := s.Get(mes.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Key.Type != "cell" || got.Key.Name != "cell-1" || got.Key.Namespace != "board" || got.Content != "x" {
+		t.Errorf("got message %v, want %v", got, mes)
+	}
+	if got.Meta == nil || got.Meta.Owner == nil || got.Meta.Owner.Name != "tester" {
+		t.Errorf("got meta %v, want the owner tester", got.Meta)
+	}
+	if got.Meta != nil && got.Meta.CreationTime == nil {
+		t.Error("creation time of the message is not set")
+	}
+
+	revision, err := s.GetRevision(mes.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != 1 {
+		t.Errorf("got revision %v, want 1", revision)
+	}
+}
+
+func testPutReplaces(t *testing.T, s storage.MessageStorage) {
+	put(t, s, newMessage("cell", "cell-1", "board", "x"), 1)
+	put(t, s, newMessage("cell", "cell-1", "board", "y"), 2)
+
+	got, err := s.Get(&api.Key{Type: "cell", Name: "cell-1", Namespace: "board"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Content != "y" {
+		t.Errorf("got content %q, want y", got.Content)
+	}
+
+	revision, err := s.GetRevision(got.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != 2 {
+		t.Errorf("got revision %v, want 2", revision)
+	}
+
+	all, err := s.GetAll(&api.Key{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 {
+		t.Errorf("got %d messages, want 1", len(all))
+	}
+}
+
+func testPutCopies(t *testing.T, s storage.MessageStorage) {
+	mes := newMessage("cell", "cell-1", "board", "x")
+	put(t, s, mes, 1)
+	mes.Content = "changed after put"
+
+	got, err := s.Get(&api.Key{Type: "cell", Name: "cell-1", Namespace: "board"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Content = "changed after get"
+
+	got, err = s.Get(&api.Key{Type: "cell", Name: "cell-1", Namespace: "board"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Content != "x" {
+		t.Errorf("got content %q, the stored message is changed by its caller", got.Content)
+	}
+}
+
+func testDelete(t *testing.T, s storage.MessageStorage) {
+	mes := newMessage("cell", "cell-1", "board", "x")
+	put(t, s, mes, 1)
+	put(t, s, newMessage("cell", "cell-2", "board", "x"), 2)
+
+	if err := s.Delete(mes.Key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(mes.Key); status.Code(err) != codes.NotFound {
+		t.Errorf("got error %v from Get of a deleted message, want NotFound", err)
+	}
+	if _, err := s.GetRevision(mes.Key); status.Code(err) != codes.NotFound {
+		t.Errorf("got error %v from GetRevision of a deleted message, want NotFound", err)
+	}
+	if _, err := s.Get(&api.Key{Type: "cell", Name: "cell-2", Namespace: "board"}); err != nil {
+		t.Errorf("another message is deleted too: %v", err)
+	}
+}
+
+func testDeleteMissing(t *testing.T, s storage.MessageStorage) {
+	if err := s.Delete(&api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}); err != nil {
+		t.Errorf("got error %v from Delete of a missing message, want nil", err)
+	}
+}
+
+func testPutAfterDelete(t *testing.T, s storage.MessageStorage) {
+	mes := newMessage("cell", "cell-1", "board", "x")
+	put(t, s, mes, 1)
+	if err := s.Delete(mes.Key); err != nil {
+		t.Fatal(err)
+	}
+	put(t, s, newMessage("cell", "cell-1", "board", "y"), 3)
+
+	got, err := s.Get(mes.Key)
+	if err != nil {
+		t.Fatalf("could not get a message which is put again after delete: %v", err)
+	}
+	if got.Content != "y" {
+		t.Errorf("got content %q, want y", got.Content)
+	}
+}
+
+func putBoard(t *testing.T, s storage.MessageStorage) {
+	put(t, s, newMessage("cell", "cell-1", "board", "x"), 1)
+	put(t, s, newMessage("cell", "cell-2", "board", "x"), 2)
+	put(t, s, newMessage("cell", "cell-3", "other", "x"), 3)
+	put(t, s, newMessage("row", "row-1", "board", "x"), 4)
+}
+
+func testGetAll(t *testing.T, s storage.MessageStorage) {
+	putBoard(t, s)
+
+	tests := []struct {
+		key  *api.Key
+		want []string
+	}{
+		{&api.Key{}, []string{"cell-1", "cell-2", "cell-3", "row-1"}},
+		{&api.Key{Type: "cell"}, []string{"cell-1", "cell-2", "cell-3"}},
+		{&api.Key{Namespace: "board"}, []string{"cell-1", "cell-2", "row-1"}},
+		{&api.Key{Type: "cell", Namespace: "board"}, []string{"cell-1", "cell-2"}},
+		{&api.Key{Type: "cell", Name: "cell-3", Namespace: "other"}, []string{"cell-3"}},
+		{&api.Key{Type: "column"}, []string{}},
+	}
+
+	for _, test := range tests {
+		messages, err := s.GetAll(test.key)
+		if err != nil {
+			t.Errorf("could not get all messages with key=%v: %v", test.key, err)
+			continue
+		}
+		if got := names(messages); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("got %v for key=%v, want %v", got, test.key, test.want)
+		}
+	}
+}
+
+func testDeleteAll(t *testing.T, s storage.MessageStorage) {
+	putBoard(t, s)
+
+	if err := s.DeleteAll(&api.Key{Type: "cell", Namespace: "board"}); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := s.GetAll(&api.Key{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(messages); fmt.Sprint(got) != fmt.Sprint([]string{"cell-3", "row-1"}) {
+		t.Errorf("got %v after DeleteAll, want [cell-3 row-1]", got)
+	}
+}
+
+func testLastRevision(t *testing.T, s storage.MessageStorage) {
+	revision, err := s.LastRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != 0 {
+		t.Errorf("got last revision %v of an empty storage, want 0", revision)
+	}
+
+	put(t, s, newMessage("cell", "cell-1", "board", "x"), 5)
+	put(t, s, newMessage("cell", "cell-2", "board", "x"), 3)
+
+	checkLastRevision(t, s, 5)
+
+	// A delete has a revision of its own, which no message keeps.
+	if err := s.Apply([]*storage.Change{{Key: &api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}, Revision: 6}}); err != nil {
+		t.Fatal(err)
+	}
+	checkLastRevision(t, s, 6)
+
+	if err := s.SetLastRevision(9); err != nil {
+		t.Fatal(err)
+	}
+	checkLastRevision(t, s, 9)
+
+	// The last revision never goes backwards.
+	if err := s.SetLastRevision(7); err != nil {
+		t.Fatal(err)
+	}
+	put(t, s, newMessage("cell", "cell-3", "board", "x"), 8)
+	checkLastRevision(t, s, 9)
+}
+
+func checkLastRevision(t *testing.T, s storage.MessageStorage, want int64) {
+	t.Helper()
+	revision, err := s.LastRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != want {
+		t.Errorf("got last revision %v, want %v", revision, want)
+	}
+}
+
+func testApply(t *testing.T, s storage.MessageStorage) {
+	put(t, s, newMessage("cell", "cell-1", "board", "x"), 1)
+
+	err := s.Apply([]*storage.Change{
+		{Key: &api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}},
+		{Key: &api.Key{Type: "cell", Name: "cell-2", Namespace: "board"}, Message: newMessage("cell", "cell-2", "board", "x"), Revision: 2},
+		{Key: &api.Key{Type: "cell", Name: "cell-2", Namespace: "board"}, Message: newMessage("cell", "cell-2", "board", "y"), Revision: 3},
+		{Key: &api.Key{Type: "cell", Name: "cell-3", Namespace: "board"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get(&api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}); status.Code(err) != codes.NotFound {
+		t.Errorf("got error %v for a message deleted by Apply, want NotFound", err)
+	}
+	got, err := s.Get(&api.Key{Type: "cell", Name: "cell-2", Namespace: "board"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Content != "y" {
+		t.Errorf("got content %q, the changes are not applied in order", got.Content)
+	}
+	if revision, err := s.GetRevision(got.Key); err != nil || revision != 3 {
+		t.Errorf("got revision %v, %v, want 3", revision, err)
+	}
+}
+
+func testApplyNothingOnError(t *testing.T, s storage.MessageStorage) {
+	put(t, s, newMessage("cell", "cell-1", "board", "x"), 1)
+
+	err := s.Apply([]*storage.Change{
+		{Key: &api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}},
+		{Key: &api.Key{Type: "cell", Name: "cell-2", Namespace: "board"}, Message: newMessage("cell", "cell-2", "board", "x"), Revision: 2},
+		{Key: nil},
+	})
+	if err == nil {
+		t.Fatal("a change without a key is applied")
+	}
+
+	messages, err := s.GetAll(&api.Key{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(messages); fmt.Sprint(got) != fmt.Sprint([]string{"cell-1"}) {
+		t.Errorf("got %v after a failed Apply, want [cell-1]", got)
+	}
+}
+
+func testConcurrent(t *testing.T, s storage.MessageStorage) {
+	const workers, writes = 8, 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*writes)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				mes := newMessage("cell", fmt.Sprintf("cell-%d-%d", w, i), "board", "x")
+				if err := s.Put(mes, int64(w*writes+i+1)); err != nil {
+					errs <- err
+					continue
+				}
+				if _, err := s.Get(mes.Key); err != nil {
+					errs <- err
+				}
+				if _, err := s.GetAll(&api.Key{Namespace: "board"}); err != nil {
+					errs <- err
+				}
+				if i%2 == 1 {
+					if err := s.Delete(mes.Key); err != nil {
+						errs <- err
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	messages, err := s.GetAll(&api.Key{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != workers*writes/2 {
+		t.Errorf("got %d messages, want %d", len(messages), workers*writes/2)
+	}
+}
+
+// TestHistoryStorage runs every check of the history against a new, empty
+// storage returned by newStorage.
+func TestHistoryStorage(t *testing.T, newStorage func(t *testing.T) storage.HistoryStorage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s storage.HistoryStorage)
+	}{
+		{"Empty", testHistoryEmpty},
+		{"Versions", testHistoryVersions},
+		{"Filter", testHistoryFilter},
+		{"InvalidVersion", testHistoryInvalidVersion},
+		{"Apply", testHistoryApply},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, newStorage(t))
+		})
+	}
+}
+
+func addVersion(t *testing.T, s storage.HistoryStorage, op string, revision int64, mes *api.Message) {
+	t.Helper()
+	version := &storage.Version{
+		Operation: op,
+		Revision:  revision,
+		Time:      time.Unix(1600000000+revision, 0).UTC(),
+		Message:   mes,
+	}
+	if err := s.AddVersion(version); err != nil {
+		t.Fatalf("could not add version=%v: %v", version, err)
+	}
+}
+
+func addHistory(t *testing.T, s storage.HistoryStorage) {
+	addVersion(t, s, "put", 1, newMessage("cell", "cell-1", "board", "x"))
+	addVersion(t, s, "put", 2, newMessage("cell", "cell-2", "board", "x"))
+	addVersion(t, s, "put", 3, newMessage("cell", "cell-1", "board", "o"))
+	addVersion(t, s, "delete", 4, newMessage("cell", "cell-1", "board", "o"))
+	addVersion(t, s, "put", 5, newMessage("row", "row-1", "board", "x"))
+}
+
+func revisions(versions []*storage.Version) []int64 {
+	res := make([]int64, 0, len(versions))
+	for _, version := range versions {
+		res = append(res, version.Revision)
+	}
+	return res
+}
+
+func testHistoryEmpty(t *testing.T, s storage.HistoryStorage) {
+	versions, err := s.GetHistory(&api.Key{}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 0 {
+		t.Errorf("got %d versions from an empty history, want 0", len(versions))
+	}
+}
+
+func testHistoryVersions(t *testing.T, s storage.HistoryStorage) {
+	addHistory(t, s)
+
+	versions, err := s.GetHistory(&api.Key{Type: "cell", Name: "cell-1", Namespace: "board"}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := revisions(versions); fmt.Sprint(got) != fmt.Sprint([]int64{1, 3, 4}) {
+		t.Fatalf("got revisions %v, want [1 3 4]", got)
+	}
+
+	want := []struct {
+		op      string
+		content string
+	}{{"put", "x"}, {"put", "o"}, {"delete", "o"}}
+	for i, version := range versions {
+		if version.Operation != want[i].op || version.Message.Content != want[i].content {
+			t.Errorf("got version %v %q, want %v %q", version.Operation, version.Message.Content, want[i].op, want[i].content)
+		}
+		if owner := version.Message.GetMeta().GetOwner().GetName(); owner != "tester" {
+			t.Errorf("got owner %q, want tester", owner)
+		}
+		if want := time.Unix(1600000000+version.Revision, 0); !version.Time.Equal(want) {
+			t.Errorf("got time %v, want %v", version.Time, want)
+		}
+	}
+}
+
+func testHistoryFilter(t *testing.T, s storage.HistoryStorage) {
+	addHistory(t, s)
+
+	tests := []struct {
+		key   *api.Key
+		since int64
+		limit int
+		want  []int64
+	}{
+		{&api.Key{}, 0, 0, []int64{1, 2, 3, 4, 5}},
+		{&api.Key{Type: "cell"}, 0, 0, []int64{1, 2, 3, 4}},
+		{&api.Key{Namespace: "board"}, 2, 0, []int64{3, 4, 5}},
+		{&api.Key{}, 0, 2, []int64{1, 2}},
+		{&api.Key{Type: "cell"}, 1, 2, []int64{2, 3}},
+		{&api.Key{}, 5, 0, []int64{}},
+	}
+
+	for _, test := range tests {
+		versions, err := s.GetHistory(test.key, test.since, test.limit)
+		if err != nil {
+			t.Errorf("could not get history with key=%v: %v", test.key, err)
+			continue
+		}
+		if got := revisions(versions); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("got revisions %v for key=%v, since=%v and limit=%v, want %v", got, test.key, test.since, test.limit, test.want)
+		}
+	}
+}
+
+// testHistoryApply checks that the versions of changes are added together with
+// the changes, and not at all if the changes are not applied.
+func testHistoryApply(t *testing.T, s storage.HistoryStorage) {
+	ms, ok := s.(storage.MessageStorage)
+	if !ok {
+		t.Skip("the storage does not store messages")
+	}
+
+	mes := newMessage("cell", "cell-1", "board", "x")
+	version := func(op string, revision int64) *storage.Version {
+		return &storage.Version{Operation: op, Revision: revision, Time: time.Unix(1600000000+revision, 0).UTC(), Message: mes}
+	}
+	if err := ms.Apply([]*storage.Change{
+		{Key: mes.Key, Message: mes, Revision: 1, Version: version("put", 1)},
+		{Key: mes.Key, Revision: 2, Version: version("delete", 2)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ms.Apply([]*storage.Change{
+		{Key: mes.Key, Message: mes, Revision: 3, Version: version("put", 3)},
+		{Key: mes.Key, Revision: 4, Version: &storage.Version{Operation: "delete", Revision: 4}},
+	}); err == nil {
+		t.Fatal("changes with a version without a message are applied")
+	}
+
+	versions, err := s.GetHistory(&api.Key{}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := revisions(versions); fmt.Sprint(got) != fmt.Sprint([]int64{1, 2}) {
+		t.Errorf("got revisions %v, want [1 2]", got)
+	}
+	if _, err := ms.Get(mes.Key); status.Code(err) != codes.NotFound {
+		t.Errorf("got error %v for a message whose changes are not applied, want NotFound", err)
+	}
+}
+
+func testHistoryInvalidVersion(t *testing.T, s storage.HistoryStorage) {
+	if err := s.AddVersion(&storage.Version{Operation: "put", Revision: 1}); err == nil {
+		t.Error("a version without a message is added")
+	}
+}